@@ -0,0 +1,263 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"message-core/downstream"
+	"message-core/pkg/xtopic"
+	"message-core/websocket"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	log "github.com/sirupsen/logrus"
+)
+
+const kickReason = "Server: Disconnected by administrator"
+
+var (
+	errBrokerNotStarted = errors.New("mqtt broker is not started")
+	errClientNotFound   = errors.New("client is not connected")
+	errInvalidFilter    = errors.New("invalid topic filter")
+	errInvalidProtocol  = errors.New("invalid protocol")
+)
+
+// Options contains the services managed by the admin api
+type Options struct {
+	// Broker returns the mqtt broker, nil until it is started
+	Broker func() *mqtt.Server
+	// ConnectedAt returns when a mqtt client established its session
+	ConnectedAt func(clientID string) (time.Time, bool)
+	Websocket   *websocket.Server
+	// Deliver publishes a message to mqtt and websocket clients
+	Deliver func(cmd downstream.Command) error
+	// InvalidateUser removes the cached credentials and rules of a user
+	InvalidateUser func(ctx context.Context, username string) error
+}
+
+// Handler serves the admin api
+type Handler struct {
+	opts Options
+}
+
+// NewHandler admin handler constructor
+func NewHandler(opts Options) *Handler {
+	return &Handler{opts: opts}
+}
+
+func (h *Handler) broker(c *gin.Context) (*mqtt.Server, bool) {
+	server := h.opts.Broker()
+	if server == nil {
+		abort(c, http.StatusServiceUnavailable, errBrokerNotStarted)
+		return nil, false
+	}
+	return server, true
+}
+
+// ListClients lists the mqtt and websocket clients, filtered by the protocol query
+func (h *Handler) ListClients(c *gin.Context) {
+	protocol := c.Query("protocol")
+	if protocol != "" && protocol != ProtocolMQTT && protocol != ProtocolWS {
+		abort(c, http.StatusBadRequest, errInvalidProtocol)
+		return
+	}
+
+	clients := []ClientInfo{}
+	if protocol != ProtocolWS {
+		server, ok := h.broker(c)
+		if !ok {
+			return
+		}
+		clients = append(clients, h.mqttClients(server)...)
+	}
+	if protocol != ProtocolMQTT {
+		clients = append(clients, h.wsClients()...)
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Protocol != clients[j].Protocol {
+			return clients[i].Protocol < clients[j].Protocol
+		}
+		return clients[i].ID < clients[j].ID
+	})
+	respond(c, http.StatusOK, clients)
+}
+
+func (h *Handler) mqttClients(server *mqtt.Server) (clients []ClientInfo) {
+	for _, cl := range server.Clients.GetAll() {
+		if cl.Net.Inline {
+			continue
+		}
+		filters := []string{}
+		for filter := range cl.State.Subscriptions.GetAll() {
+			filters = append(filters, filter)
+		}
+		sort.Strings(filters)
+
+		info := ClientInfo{
+			ID:            cl.ID,
+			Protocol:      ProtocolMQTT,
+			Username:      string(cl.Properties.Username),
+			Remote:        cl.Net.Remote,
+			Listener:      cl.Net.Listener,
+			Connected:     !cl.Closed(),
+			Subscriptions: filters,
+		}
+		if h.opts.ConnectedAt != nil {
+			info.ConnectedAt, _ = h.opts.ConnectedAt(cl.ID)
+		}
+		clients = append(clients, info)
+	}
+	return
+}
+
+func (h *Handler) wsClients() (clients []ClientInfo) {
+	for _, session := range h.opts.Websocket.Sessions() {
+		filters := h.opts.Websocket.Filters(session.ClientID)
+		sort.Strings(filters)
+
+		info := ClientInfo{
+			ID:            session.ClientID,
+			Protocol:      ProtocolWS,
+			Username:      session.Username,
+			Connected:     true,
+			ConnectedAt:   session.ConnectedAt,
+			Subscriptions: filters,
+		}
+		if session.Conn != nil {
+			info.Remote = session.Conn.RemoteAddr().String()
+		}
+		clients = append(clients, info)
+	}
+	return
+}
+
+// KickClient disconnects the mqtt or websocket client
+func (h *Handler) KickClient(c *gin.Context) {
+	clientID := c.Param("id")
+
+	if server := h.opts.Broker(); server != nil {
+		if cl, ok := server.Clients.Get(clientID); ok && !cl.Closed() {
+			if err := server.DisconnectClient(cl, packets.ErrAdministrativeAction); err != nil {
+				log.WithField("ADMIN_KICK_CLIENT_ERROR", clientID).WithError(err).Warn()
+			}
+			// the broker leaves the connection open when passive disconnect is enabled
+			cl.Stop(packets.ErrAdministrativeAction)
+			log.WithField("Admin kicked mqtt client", clientID).Info()
+			respond(c, http.StatusOK, nil)
+			return
+		}
+	}
+
+	if h.opts.Websocket.Kick(clientID, kickReason) {
+		log.WithField("Admin kicked websocket client", clientID).Info()
+		respond(c, http.StatusOK, nil)
+		return
+	}
+
+	abort(c, http.StatusNotFound, errClientNotFound)
+}
+
+// PublishMessage publishes a message to mqtt and websocket clients,
+// the body is the envelope of the downstream kafka commands.
+func (h *Handler) PublishMessage(c *gin.Context) {
+	var envelope downstream.Envelope
+	if err := c.ShouldBindJSON(&envelope); err != nil {
+		abort(c, http.StatusBadRequest, err)
+		return
+	}
+	cmd, err := envelope.Command()
+	if err != nil {
+		abort(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.opts.Deliver(cmd); err != nil {
+		abort(c, http.StatusInternalServerError, err)
+		return
+	}
+	log.WithField("Admin published message", cmd.Topic).Info()
+	respond(c, http.StatusOK, nil)
+}
+
+// ListRetained lists the retained messages matching the filter query, all of them by default
+func (h *Handler) ListRetained(c *gin.Context) {
+	filter := c.DefaultQuery("filter", xtopic.MultiLevelWildcard)
+	if !xtopic.IsValidFilter(filter) {
+		abort(c, http.StatusBadRequest, errInvalidFilter)
+		return
+	}
+	server, ok := h.broker(c)
+	if !ok {
+		return
+	}
+
+	messages := []RetainedMessage{}
+	for _, pk := range server.Topics.Messages(filter) {
+		messages = append(messages, RetainedMessage{
+			Topic:   pk.TopicName,
+			Payload: string(pk.Payload),
+			Qos:     pk.FixedHeader.Qos,
+			Created: pk.Created,
+		})
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].Topic < messages[j].Topic
+	})
+	respond(c, http.StatusOK, messages)
+}
+
+// ClearRetained clears the retained messages matching the required filter query
+func (h *Handler) ClearRetained(c *gin.Context) {
+	filter := c.Query("filter")
+	if !xtopic.IsValidFilter(filter) {
+		abort(c, http.StatusBadRequest, errInvalidFilter)
+		return
+	}
+	server, ok := h.broker(c)
+	if !ok {
+		return
+	}
+
+	cleared := ClearRetainedResponse{Topics: []string{}}
+	for _, pk := range server.Topics.Messages(filter) {
+		// an empty retained message removes the retained message of the topic and its stored copy
+		if err := server.Publish(pk.TopicName, []byte{}, true, 0); err != nil {
+			abort(c, http.StatusInternalServerError, err)
+			return
+		}
+		cleared.Topics = append(cleared.Topics, pk.TopicName)
+	}
+	log.WithField("Admin cleared retained messages", cleared.Topics).Info()
+	respond(c, http.StatusOK, cleared)
+}
+
+// InvalidateUserCache removes the cached credentials and rules of the user,
+// its next connection is validated by the platform.
+func (h *Handler) InvalidateUserCache(c *gin.Context) {
+	username := c.Param("username")
+	if err := h.opts.InvalidateUser(c.Request.Context(), username); err != nil {
+		abort(c, http.StatusInternalServerError, err)
+		return
+	}
+	log.WithField("Admin invalidated user cache", username).Info()
+	respond(c, http.StatusOK, nil)
+}
+
+func respond(c *gin.Context, status int, data interface{}) {
+	c.JSON(status, Response{
+		StatusCode: status,
+		Message:    http.StatusText(status),
+		Data:       data,
+	})
+}
+
+func abort(c *gin.Context, status int, err error) {
+	c.AbortWithStatusJSON(status, Response{
+		StatusCode: status,
+		Message:    err.Error(),
+	})
+}
@@ -0,0 +1,206 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"message-core/downstream"
+	"message-core/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "secret"
+
+type testAPI struct {
+	router      *gin.Engine
+	broker      *mqtt.Server
+	ws          *websocket.Server
+	delivered   []downstream.Command
+	invalidated []string
+}
+
+func newTestAPI(t *testing.T) *testAPI {
+	logger := zerolog.New(os.Stderr).Level(zerolog.Disabled)
+	broker := mqtt.New(nil)
+	broker.Log = &logger
+	// as the service broker, disconnecting a client leaves its connection open
+	broker.Options.Capabilities.Compatibilities.PassiveClientDisconnect = true
+	require.NoError(t, broker.Serve())
+	t.Cleanup(func() { broker.Close() })
+
+	api := &testAPI{broker: broker, ws: websocket.NewServer()}
+	connectedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	api.router = NewRouter(testToken, NewHandler(Options{
+		Broker: func() *mqtt.Server { return broker },
+		ConnectedAt: func(clientID string) (time.Time, bool) {
+			return connectedAt, true
+		},
+		Websocket: api.ws,
+		Deliver: func(cmd downstream.Command) error {
+			api.delivered = append(api.delivered, cmd)
+			return nil
+		},
+		InvalidateUser: func(ctx context.Context, username string) error {
+			api.invalidated = append(api.invalidated, username)
+			return nil
+		},
+	}))
+	return api
+}
+
+func (api *testAPI) do(t *testing.T, method, target, body string, data interface{}) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+
+	if data != nil {
+		resp := Response{Data: data}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	}
+	return rec.Code
+}
+
+func TestRequireToken(t *testing.T) {
+	api := newTestAPI(t)
+
+	for _, header := range []http.Header{
+		{},
+		{"Authorization": []string{"Bearer wrong"}},
+		{TokenHeader: []string{"wrong"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/v1/clients", nil)
+		req.Header = header
+		rec := httptest.NewRecorder()
+		api.router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/v1/clients", nil)
+	req.Header.Set(TokenHeader, testToken)
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// no request is accepted without a configured token
+	router := NewRouter("", NewHandler(Options{}))
+	req = httptest.NewRequest(http.MethodGet, "/api/admin/v1/clients", nil)
+	req.Header.Set(TokenHeader, "")
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestListAndKickClients(t *testing.T) {
+	api := newTestAPI(t)
+
+	conn, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	written := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(remote)
+		written <- data
+	}()
+	cl := api.broker.NewClient(conn, "tcp", "device-1", false)
+	cl.Properties.ProtocolVersion = 5
+	cl.Properties.Username = []byte("device1")
+	cl.State.Subscriptions.Add("device1/private", packets.Subscription{Filter: "device1/private"})
+	api.broker.Clients.Add(cl)
+
+	session := websocket.NewSession("ws-1", "device2", nil, 1, websocket.DropOldest)
+	api.ws.Register(session)
+	api.ws.Subscribe(session, "device2/#")
+
+	var clients []ClientInfo
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodGet, "/api/admin/v1/clients", "", &clients))
+	require.Len(t, clients, 2)
+	assert.Equal(t, "device-1", clients[0].ID)
+	assert.Equal(t, ProtocolMQTT, clients[0].Protocol)
+	assert.Equal(t, "device1", clients[0].Username)
+	assert.Equal(t, []string{"device1/private"}, clients[0].Subscriptions)
+	assert.Equal(t, 2024, clients[0].ConnectedAt.Year())
+	assert.Equal(t, "ws-1", clients[1].ID)
+	assert.Equal(t, []string{"device2/#"}, clients[1].Subscriptions)
+
+	clients = nil
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodGet, "/api/admin/v1/clients?protocol=ws", "", &clients))
+	require.Len(t, clients, 1)
+	assert.Equal(t, ProtocolWS, clients[0].Protocol)
+	assert.Equal(t, http.StatusBadRequest, api.do(t, http.MethodGet, "/api/admin/v1/clients?protocol=coap", "", nil))
+
+	assert.Equal(t, http.StatusOK, api.do(t, http.MethodDelete, "/api/admin/v1/clients/ws-1", "", nil))
+	select {
+	case <-session.Done():
+	default:
+		t.Fatal("websocket session was not closed")
+	}
+
+	assert.Equal(t, http.StatusOK, api.do(t, http.MethodDelete, "/api/admin/v1/clients/device-1", "", nil))
+	assert.True(t, cl.Closed(), "the mqtt client is stopped")
+	assert.ErrorIs(t, cl.StopCause(), packets.ErrAdministrativeAction)
+	select {
+	case data := <-written:
+		require.NotEmpty(t, data)
+		assert.Equal(t, byte(packets.Disconnect<<4), data[0], "the client gets a disconnect first")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mqtt connection was not closed")
+	}
+	assert.Equal(t, http.StatusNotFound, api.do(t, http.MethodDelete, "/api/admin/v1/clients/device-1", "", nil))
+
+	assert.Equal(t, http.StatusNotFound, api.do(t, http.MethodDelete, "/api/admin/v1/clients/unknown", "", nil))
+}
+
+func TestPublishMessage(t *testing.T) {
+	api := newTestAPI(t)
+
+	body := `{"topic":"device1/private","message":"on","qos":1,"retain":true}`
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodPost, "/api/admin/v1/messages", body, nil))
+	require.Len(t, api.delivered, 1)
+	assert.Equal(t, downstream.Command{Topic: "device1/private", Payload: []byte("on"), Qos: 1, Retain: true}, api.delivered[0])
+
+	assert.Equal(t, http.StatusBadRequest, api.do(t, http.MethodPost, "/api/admin/v1/messages", `{"message":"on"}`, nil))
+	assert.Equal(t, http.StatusBadRequest, api.do(t, http.MethodPost, "/api/admin/v1/messages", `not json`, nil))
+}
+
+func TestListAndClearRetained(t *testing.T) {
+	api := newTestAPI(t)
+	require.NoError(t, api.broker.Publish("device1/private", []byte("a"), true, 0))
+	require.NoError(t, api.broker.Publish("device2/private", []byte("b"), true, 0))
+
+	var messages []RetainedMessage
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodGet, "/api/admin/v1/retained", "", &messages))
+	require.Len(t, messages, 2)
+	assert.Equal(t, "device1/private", messages[0].Topic)
+	assert.Equal(t, "a", messages[0].Payload)
+
+	assert.Equal(t, http.StatusBadRequest, api.do(t, http.MethodDelete, "/api/admin/v1/retained", "", nil))
+
+	var cleared ClearRetainedResponse
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodDelete, "/api/admin/v1/retained?filter=device1/%23", "", &cleared))
+	assert.Equal(t, []string{"device1/private"}, cleared.Topics)
+
+	messages = nil
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodGet, "/api/admin/v1/retained", "", &messages))
+	require.Len(t, messages, 1)
+	assert.Equal(t, "device2/private", messages[0].Topic)
+}
+
+func TestInvalidateUserCache(t *testing.T) {
+	api := newTestAPI(t)
+
+	require.Equal(t, http.StatusOK, api.do(t, http.MethodDelete, "/api/admin/v1/cache/users/device1", "", nil))
+	assert.Equal(t, []string{"device1"}, api.invalidated)
+}
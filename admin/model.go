@@ -0,0 +1,41 @@
+package admin
+
+import "time"
+
+// protocols of the listed clients
+const (
+	ProtocolMQTT = "mqtt"
+	ProtocolWS   = "ws"
+)
+
+// Response is the body of every admin api response
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Message    string      `json:"message"`
+	Data       interface{} `json:"data,omitempty"`
+}
+
+// ClientInfo describes a mqtt or websocket client
+type ClientInfo struct {
+	ID            string    `json:"id"`
+	Protocol      string    `json:"protocol"`
+	Username      string    `json:"username"`
+	Remote        string    `json:"remote,omitempty"`
+	Listener      string    `json:"listener,omitempty"`
+	Connected     bool      `json:"connected"`
+	ConnectedAt   time.Time `json:"connected_at,omitempty"`
+	Subscriptions []string  `json:"subscriptions"`
+}
+
+// RetainedMessage is a message retained by the broker for a topic
+type RetainedMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Created int64  `json:"created"`
+}
+
+// ClearRetainedResponse reports the topics whose retained message was cleared
+type ClearRetainedResponse struct {
+	Topics []string `json:"topics"`
+}
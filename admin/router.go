@@ -0,0 +1,48 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// header carrying the admin token when no bearer authorization is sent
+const TokenHeader = "X-Admin-Token"
+
+var errUnauthorized = errors.New("invalid admin token")
+
+// NewRouter returns the admin api routes, every route requires the admin token
+func NewRouter(token string, handler *Handler) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery())
+
+	api := router.Group("/api/admin/v1", RequireToken(token))
+	api.GET("/clients", handler.ListClients)
+	api.DELETE("/clients/:id", handler.KickClient)
+	api.POST("/messages", handler.PublishMessage)
+	api.GET("/retained", handler.ListRetained)
+	api.DELETE("/retained", handler.ClearRetained)
+	api.DELETE("/cache/users/:username", handler.InvalidateUserCache)
+
+	return router
+}
+
+// RequireToken rejects requests without the admin token, an empty token rejects every request
+func RequireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		got := c.GetHeader(TokenHeader)
+		if bearer := c.GetHeader("Authorization"); strings.HasPrefix(bearer, "Bearer ") {
+			got = strings.TrimPrefix(bearer, "Bearer ")
+		}
+
+		if len(token) == 0 || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			abort(c, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
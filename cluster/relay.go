@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	goredis "github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+)
+
+// Message is a message relayed between instances
+type Message struct {
+	// Origin is the node id of the instance which published the message
+	Origin  string `json:"origin"`
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	Qos     byte   `json:"qos,omitempty"`
+	Retain  bool   `json:"retain,omitempty"`
+}
+
+// DeliverFunc delivers a message relayed by another instance to the local clients
+type DeliverFunc func(topic string, payload []byte)
+
+// Relay shares published messages with the other instances over a redis pub/sub channel,
+// each instance ignores the messages it published itself.
+type Relay struct {
+	db      *goredis.Client
+	channel string
+	nodeID  string
+	deliver DeliverFunc
+	queue   chan Message
+	sub     *goredis.PubSub
+	wg      sync.WaitGroup
+	// mu guards closed, the queue is closed once
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewRelay create new relay, up to queueSize messages wait to be sent to redis
+func NewRelay(db *goredis.Client, channel, nodeID string, queueSize int, deliver DeliverFunc) *Relay {
+	return &Relay{
+		db:      db,
+		channel: channel,
+		nodeID:  nodeID,
+		deliver: deliver,
+		queue:   make(chan Message, queueSize),
+	}
+}
+
+// NodeID returns the id of this instance
+func (r *Relay) NodeID() string {
+	return r.nodeID
+}
+
+// Start subscribes to the channel and starts relaying messages
+func (r *Relay) Start(ctx context.Context) error {
+	r.sub = r.db.Subscribe(ctx, r.channel)
+	// wait for the subscription so no message published after Start is missed
+	if _, err := r.sub.Receive(ctx); err != nil {
+		r.sub.Close()
+		return err
+	}
+
+	r.wg.Add(2)
+	go r.receive()
+	go r.send()
+	return nil
+}
+
+// Broadcast queues the message for the other instances without blocking,
+// it returns false when the queue is full.
+func (r *Relay) Broadcast(topic string, payload []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return false
+	}
+	select {
+	case r.queue <- Message{Origin: r.nodeID, Topic: topic, Payload: payload}:
+		return true
+	default:
+		log.WithField("CLUSTER_RELAY_QUEUE_FULL", topic).Warn("Drop message relayed to the cluster")
+		return false
+	}
+}
+
+// Close stops receiving messages and sends the queued ones
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.queue)
+	r.mu.Unlock()
+
+	var err error
+	if r.sub != nil {
+		err = r.sub.Close()
+	}
+	r.wg.Wait()
+	return err
+}
+
+func (r *Relay) receive() {
+	defer r.wg.Done()
+
+	for msg := range r.sub.Channel() {
+		var m Message
+		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+			log.WithField("CLUSTER_RELAY_INVALID_MESSAGE", msg.Payload).WithError(err).Warn()
+			continue
+		}
+		// this instance already delivered its own messages
+		if m.Origin == r.nodeID {
+			continue
+		}
+		r.deliver(m.Topic, m.Payload)
+	}
+}
+
+func (r *Relay) send() {
+	defer r.wg.Done()
+
+	for m := range r.queue {
+		data, err := json.Marshal(m)
+		if err != nil {
+			continue
+		}
+		if err := r.db.Publish(context.Background(), r.channel, data).Err(); err != nil {
+			log.WithField("CLUSTER_RELAY_PUBLISH_ERROR", m.Topic).WithError(err).Error()
+		}
+	}
+}
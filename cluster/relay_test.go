@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deliveries records the messages delivered to the local clients of a node
+type deliveries struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (d *deliveries) deliver(topic string, payload []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.messages = append(d.messages, Message{Topic: topic, Payload: payload})
+}
+
+func (d *deliveries) get() []Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Message(nil), d.messages...)
+}
+
+func newTestRelay(t *testing.T, addr, nodeID string) (*Relay, *deliveries) {
+	db := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { db.Close() })
+
+	d := &deliveries{}
+	relay := NewRelay(db, "test-ws", nodeID, 10, d.deliver)
+	require.NoError(t, relay.Start(context.Background()))
+	t.Cleanup(func() { relay.Close() })
+	return relay, d
+}
+
+func TestRelayDeliversToOtherNodesOnce(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, fromA := newTestRelay(t, mr.Addr(), "node-a")
+	_, fromB := newTestRelay(t, mr.Addr(), "node-b")
+	_, fromC := newTestRelay(t, mr.Addr(), "node-c")
+
+	require.True(t, a.Broadcast("device1", []byte("hello")))
+
+	expected := []Message{{Topic: "device1", Payload: []byte("hello")}}
+	require.Eventually(t, func() bool {
+		return len(fromB.get()) == 1 && len(fromC.get()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, expected, fromB.get())
+	assert.Equal(t, expected, fromC.get())
+
+	// the origin delivers its own messages locally, the echo is ignored
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, fromA.get())
+	assert.Len(t, fromB.get(), 1)
+}
+
+func TestRelayCloseSendsQueuedMessages(t *testing.T) {
+	mr := miniredis.RunT(t)
+	_, fromB := newTestRelay(t, mr.Addr(), "node-b")
+
+	db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.Close() })
+	a := NewRelay(db, "test-ws", "node-a", 10, func(string, []byte) {})
+	require.NoError(t, a.Start(context.Background()))
+
+	for i := 0; i < 5; i++ {
+		require.True(t, a.Broadcast("device1", []byte("hello")))
+	}
+	require.NoError(t, a.Close())
+	assert.False(t, a.Broadcast("device1", []byte("late")), "closed relay drops messages")
+
+	require.Eventually(t, func() bool {
+		return len(fromB.get()) == 5
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,456 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"message-core/pkg/xtopic"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// Listener is the listener name of the inline clients publishing the messages routed
+// by the other nodes, their publishes are never routed again.
+const Listener = "cluster"
+
+const (
+	defaultRouterPrefix       = "message-core-mqtt"
+	defaultRouterSyncInterval = 10 * time.Second
+	sharePrefix               = "$share/"
+)
+
+var errRouterNotConfigured = errors.New("cluster router requires a mqtt server and a redis client")
+
+// RouterOptions contains the configuration of the cluster router
+type RouterOptions struct {
+	Server *mqtt.Server
+	// Client is the shared redis client, it is not closed by the router
+	Client *goredis.Client
+	NodeID string
+	// Prefix of the redis keys and channels of the router
+	Prefix string
+	// SyncInterval is how often the subscriptions of the nodes are refreshed,
+	// a node without refresh for 3 intervals is removed from the routes.
+	SyncInterval time.Duration
+	// QueueSize is the number of messages waiting to be routed before new ones are dropped
+	QueueSize int
+}
+
+// route is a message waiting to be published on the channel of a node
+type route struct {
+	channel string
+	message Message
+}
+
+// Router forwards the mqtt publishes to the nodes having matching subscribers.
+//
+// Each node stores the filters subscribed by its clients in a redis set and announces
+// its changes on a control channel, so every node knows the filters of the others.
+// A publish is sent on the channel of each node with a matching filter, retained
+// messages are sent to every node so they all keep the retained message.
+// The node injects the messages it receives with an inline client on the cluster
+// listener, whose publishes are not routed again.
+type Router struct {
+	mqtt.HookBase
+	server   *mqtt.Server
+	db       *goredis.Client
+	nodeID   string
+	prefix   string
+	interval time.Duration
+	sub      *goredis.PubSub
+	queue    chan route
+	changed  chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	// mu guards the filters of the remote nodes and the closed state
+	mu     sync.RWMutex
+	remote map[string][]string
+	local  []string
+	closed bool
+}
+
+func (r *Router) ID() string {
+	return "cluster-router"
+}
+
+func (r *Router) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnPublished,
+	}, []byte{b})
+}
+
+// Init subscribes to the channels of the node and starts routing messages
+func (r *Router) Init(config any) error {
+	opts, ok := config.(*RouterOptions)
+	if !ok {
+		return mqtt.ErrInvalidConfigType
+	}
+	if opts.Server == nil || opts.Client == nil {
+		return errRouterNotConfigured
+	}
+
+	r.server = opts.Server
+	r.db = opts.Client
+	r.nodeID = opts.NodeID
+	r.prefix = opts.Prefix
+	if len(r.prefix) == 0 {
+		r.prefix = defaultRouterPrefix
+	}
+	r.interval = opts.SyncInterval
+	if r.interval <= 0 {
+		r.interval = defaultRouterSyncInterval
+	}
+	r.queue = make(chan route, opts.QueueSize)
+	r.changed = make(chan struct{}, 1)
+	r.done = make(chan struct{})
+	r.remote = map[string][]string{}
+
+	ctx := context.Background()
+	r.sub = r.db.Subscribe(ctx, r.nodeChannel(r.nodeID), r.broadcastChannel(), r.controlChannel())
+	// wait for the subscription so no route announced after Init is missed
+	if _, err := r.sub.Receive(ctx); err != nil {
+		r.sub.Close()
+		return err
+	}
+	if err := r.sync(ctx, true); err != nil {
+		r.Log.Warn().Err(err).Msg("failed to sync cluster routes")
+	}
+
+	r.wg.Add(3)
+	go r.receive()
+	go r.send()
+	go r.syncLoop()
+
+	r.Log.Info().Str("node", r.nodeID).Str("prefix", r.prefix).Msg("initialised")
+	return nil
+}
+
+// Stop removes the routes of the node and sends the queued messages
+func (r *Router) Stop() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.queue)
+	close(r.done)
+	r.mu.Unlock()
+
+	err := r.sub.Close()
+	r.wg.Wait()
+
+	// the other nodes stop routing to this node without waiting for the key to expire
+	ctx := context.Background()
+	if delErr := r.db.Del(ctx, r.filtersKey(r.nodeID)).Err(); delErr != nil {
+		r.Log.Warn().Err(delErr).Msg("failed to remove cluster routes")
+	} else {
+		r.db.Publish(ctx, r.controlChannel(), r.nodeID)
+	}
+	return err
+}
+
+// OnSubscribed announces the new filters to the other nodes
+func (r *Router) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	r.notifyChanged()
+}
+
+// OnUnsubscribed announces the removed filters to the other nodes
+func (r *Router) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	r.notifyChanged()
+}
+
+// OnPublished routes the message to the nodes having matching subscribers
+func (r *Router) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	// the message was routed by another node, routing it again would loop
+	if cl.Net.Listener == Listener {
+		return
+	}
+	// $SYS topics describe this node only
+	if strings.HasPrefix(pk.TopicName, "$") {
+		return
+	}
+
+	m := Message{
+		Origin:  r.nodeID,
+		Topic:   pk.TopicName,
+		Payload: pk.Payload,
+		Qos:     pk.FixedHeader.Qos,
+		Retain:  pk.FixedHeader.Retain,
+	}
+	if m.Retain {
+		r.enqueue(route{channel: r.broadcastChannel(), message: m})
+		return
+	}
+	for _, node := range r.Nodes(pk.TopicName) {
+		r.enqueue(route{channel: r.nodeChannel(node), message: m})
+	}
+}
+
+// Nodes returns the remote nodes having a subscriber matching the topic
+func (r *Router) Nodes(topic string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := []string{}
+	for node, filters := range r.remote {
+		for _, filter := range filters {
+			if xtopic.Match(filter, topic) {
+				nodes = append(nodes, node)
+				break
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (r *Router) enqueue(rt route) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return
+	}
+	select {
+	case r.queue <- rt:
+	default:
+		r.Log.Warn().Str("topic", rt.message.Topic).Msg("cluster route queue is full, message dropped")
+	}
+}
+
+func (r *Router) notifyChanged() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Router) filtersKey(node string) string {
+	return r.prefix + ":filters:" + node
+}
+
+func (r *Router) nodeChannel(node string) string {
+	return r.prefix + ":node:" + node
+}
+
+func (r *Router) broadcastChannel() string {
+	return r.prefix + ":all"
+}
+
+func (r *Router) controlChannel() string {
+	return r.prefix + ":control"
+}
+
+// localFilters returns the filters subscribed by the clients of this node,
+// including the persistent sessions of disconnected clients.
+func (r *Router) localFilters() []string {
+	set := map[string]struct{}{}
+	for _, cl := range r.server.Clients.GetAll() {
+		for filter := range cl.State.Subscriptions.GetAll() {
+			// a shared subscription matches the topics of its filter
+			if strings.HasPrefix(filter, sharePrefix) {
+				parts := strings.SplitN(filter, "/", 3)
+				if len(parts) < 3 {
+					continue
+				}
+				filter = parts[2]
+			}
+			set[filter] = struct{}{}
+		}
+	}
+
+	filters := make([]string, 0, len(set))
+	for filter := range set {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+func (r *Router) syncLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		var refresh bool
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			refresh = true
+		case <-r.changed:
+		}
+		if err := r.sync(context.Background(), refresh); err != nil {
+			r.Log.Warn().Err(err).Msg("failed to sync cluster routes")
+		}
+	}
+}
+
+// sync stores the filters of this node when they changed, refresh also extends
+// their expiry and reloads the filters of the other nodes.
+func (r *Router) sync(ctx context.Context, refresh bool) error {
+	local := r.localFilters()
+	r.mu.RLock()
+	changed := !equalFilters(local, r.local)
+	r.mu.RUnlock()
+
+	if changed || refresh {
+		key := r.filtersKey(r.nodeID)
+		_, err := r.db.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			if len(local) > 0 {
+				members := make([]interface{}, len(local))
+				for i, filter := range local {
+					members[i] = filter
+				}
+				pipe.SAdd(ctx, key, members...)
+				pipe.Expire(ctx, key, 3*r.interval)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		r.mu.Lock()
+		r.local = local
+		r.mu.Unlock()
+	}
+	if changed {
+		if err := r.db.Publish(ctx, r.controlChannel(), r.nodeID).Err(); err != nil {
+			return err
+		}
+	}
+	if refresh {
+		return r.loadRemote(ctx)
+	}
+	return nil
+}
+
+// loadRemote replaces the routes with the filters stored by the other nodes
+func (r *Router) loadRemote(ctx context.Context) error {
+	remote := map[string][]string{}
+	pattern := r.filtersKey("*")
+	iter := r.db.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		node := strings.TrimPrefix(iter.Val(), r.filtersKey(""))
+		if node == r.nodeID {
+			continue
+		}
+		filters, err := r.db.SMembers(ctx, iter.Val()).Result()
+		if err != nil {
+			return err
+		}
+		if len(filters) > 0 {
+			remote[node] = filters
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.remote = remote
+	r.mu.Unlock()
+	return nil
+}
+
+// loadNode reloads the filters of a node after it announced a change
+func (r *Router) loadNode(ctx context.Context, node string) error {
+	filters, err := r.db.SMembers(ctx, r.filtersKey(node)).Result()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(filters) == 0 {
+		delete(r.remote, node)
+		return nil
+	}
+	r.remote[node] = filters
+	return nil
+}
+
+func (r *Router) receive() {
+	defer r.wg.Done()
+
+	for msg := range r.sub.Channel() {
+		if msg.Channel == r.controlChannel() {
+			if msg.Payload == r.nodeID {
+				continue
+			}
+			if err := r.loadNode(context.Background(), msg.Payload); err != nil {
+				r.Log.Warn().Err(err).Str("node", msg.Payload).Msg("failed to load cluster routes")
+			}
+			continue
+		}
+
+		var m Message
+		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
+			r.Log.Warn().Err(err).Str("channel", msg.Channel).Msg("invalid cluster message")
+			continue
+		}
+		// the broadcast channel echoes the messages of this node
+		if m.Origin == r.nodeID {
+			continue
+		}
+		r.inject(m)
+	}
+}
+
+// inject publishes a routed message to the local subscribers
+func (r *Router) inject(m Message) {
+	cl := r.server.NewClient(nil, Listener, Listener+"-"+m.Origin, true)
+	err := r.server.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    m.Qos,
+			Retain: m.Retain,
+		},
+		TopicName: m.Topic,
+		Payload:   m.Payload,
+		PacketID:  uint16(m.Qos), // required by the validity checks like server.Publish
+	})
+	if err != nil {
+		r.Log.Warn().Err(err).Str("topic", m.Topic).Str("origin", m.Origin).Msg("failed to inject cluster message")
+	}
+}
+
+func (r *Router) send() {
+	defer r.wg.Done()
+
+	for rt := range r.queue {
+		data, err := json.Marshal(rt.message)
+		if err != nil {
+			continue
+		}
+		if err := r.db.Publish(context.Background(), rt.channel, data).Err(); err != nil {
+			r.Log.Error().Err(err).Str("topic", rt.message.Topic).Msg("failed to route cluster message")
+		}
+	}
+}
+
+func equalFilters(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package cluster
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// publishedHook records the messages published on a node with the listener of their client
+type publishedHook struct {
+	mqtt.HookBase
+	mu        sync.Mutex
+	listeners []string
+	messages  []Message
+}
+
+func (h *publishedHook) ID() string {
+	return "test-published"
+}
+
+func (h *publishedHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mqtt.OnPublished}, []byte{b})
+}
+
+func (h *publishedHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.listeners = append(h.listeners, cl.Net.Listener)
+	h.messages = append(h.messages, Message{Topic: pk.TopicName, Payload: pk.Payload})
+}
+
+func (h *publishedHook) get() ([]string, []Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]string(nil), h.listeners...), append([]Message(nil), h.messages...)
+}
+
+type testNode struct {
+	server    *mqtt.Server
+	router    *Router
+	published *publishedHook
+}
+
+func newTestNode(t *testing.T, addr, nodeID string) *testNode {
+	logger := zerolog.New(os.Stderr).Level(zerolog.Disabled)
+	server := mqtt.New(nil)
+	// the hooks share the logger of the server
+	*server.Log = logger
+
+	db := goredis.NewClient(&goredis.Options{Addr: addr})
+	t.Cleanup(func() { db.Close() })
+
+	node := &testNode{server: server, router: new(Router), published: new(publishedHook)}
+	require.NoError(t, server.AddHook(node.published, nil))
+	require.NoError(t, server.AddHook(node.router, &RouterOptions{
+		Server:       server,
+		Client:       db,
+		NodeID:       nodeID,
+		Prefix:       "test-mqtt",
+		SyncInterval: 50 * time.Millisecond,
+		QueueSize:    10,
+	}))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() { server.Close() })
+	return node
+}
+
+// subscribe adds a client subscribed to the filter, as restored from the storage
+func (n *testNode) subscribe(clientID, filter string) {
+	cl := n.server.NewClient(nil, "tcp", clientID, false)
+	cl.State.Subscriptions.Add(filter, packets.Subscription{Filter: filter})
+	n.server.Clients.Add(cl)
+	n.router.notifyChanged()
+}
+
+func TestRouterForwardsToSubscribedNodes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestNode(t, mr.Addr(), "node-a")
+	b := newTestNode(t, mr.Addr(), "node-b")
+	c := newTestNode(t, mr.Addr(), "node-c")
+
+	b.subscribe("device-1", "sensors/#")
+	c.subscribe("device-2", "$share/group/alerts/+")
+	require.Eventually(t, func() bool {
+		return len(a.router.Nodes("sensors/1")) == 1 && len(a.router.Nodes("alerts/1")) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"node-b"}, a.router.Nodes("sensors/1"))
+	assert.Equal(t, []string{"node-c"}, a.router.Nodes("alerts/1"))
+	assert.Empty(t, a.router.Nodes("other/1"))
+
+	require.NoError(t, a.server.Publish("sensors/1", []byte("21"), false, 0))
+	require.NoError(t, a.server.Publish("other/1", []byte("x"), false, 0))
+
+	require.Eventually(t, func() bool {
+		_, messages := b.published.get()
+		return len(messages) == 1
+	}, time.Second, 10*time.Millisecond)
+	listeners, messages := b.published.get()
+	assert.Equal(t, []string{Listener}, listeners)
+	assert.Equal(t, []Message{{Topic: "sensors/1", Payload: []byte("21")}}, messages)
+
+	// the routed message is not routed back, the unmatched one is not routed at all
+	time.Sleep(100 * time.Millisecond)
+	_, messages = a.published.get()
+	assert.Len(t, messages, 2)
+	_, messages = b.published.get()
+	assert.Len(t, messages, 1)
+	_, messages = c.published.get()
+	assert.Empty(t, messages)
+}
+
+func TestRouterBroadcastsRetainedMessages(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestNode(t, mr.Addr(), "node-a")
+	b := newTestNode(t, mr.Addr(), "node-b")
+
+	require.NoError(t, a.server.Publish("config/device-1", []byte("on"), true, 1))
+	require.Eventually(t, func() bool {
+		return len(b.server.Topics.Messages("config/#")) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []byte("on"), b.server.Topics.Messages("config/#")[0].Payload)
+}
+
+func TestRouterStopRemovesRoutes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestNode(t, mr.Addr(), "node-a")
+	b := newTestNode(t, mr.Addr(), "node-b")
+
+	b.subscribe("device-1", "sensors/#")
+	require.Eventually(t, func() bool {
+		return len(a.router.Nodes("sensors/1")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, b.router.Stop())
+	assert.False(t, mr.Exists("test-mqtt:filters:node-b"))
+	require.Eventually(t, func() bool {
+		return len(a.router.Nodes("sensors/1")) == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"message-core/admin"
+	"message-core/cluster"
+	hook "message-core/custom-hook"
+	"message-core/downstream"
+	"message-core/kafka"
+	"message-core/mqtt"
+	"message-core/pkg/config"
+	"message-core/pkg/health"
+	"message-core/pkg/lifecycle"
+	"message-core/pkg/tracing"
+	"message-core/pkg/xservice/platform"
+	"message-core/redis"
+	"message-core/websocket"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"go.elastic.co/apm"
+)
+
+const tracingProviderAPM = "apm"
+
+// Components returns the service components in start order,
+// they are drained in reverse order: the servers stop accepting connections
+// and close their clients first, then kafka is flushed and redis closed.
+func Components() []lifecycle.Component {
+	return []lifecycle.Component{
+		tracer(),
+		adminServer(),
+		{
+			Name: "redis",
+			Start: func(ctx context.Context) error {
+				redis.InitRedisClient()
+				return nil
+			},
+			Stop: func(ctx context.Context) error {
+				return redis.Close()
+			},
+		},
+		wsRelay(),
+		{
+			Name: "platform",
+			Start: func(ctx context.Context) error {
+				// create new connection to services
+				platform.NewClien()
+				return nil
+			},
+			// cache the rules being fetched
+			Stop: func(ctx context.Context) error {
+				return platform.Drain(ctx)
+			},
+		},
+		platformInvalidation(),
+		{
+			Name: "kafka-producer",
+			Start: func(ctx context.Context) error {
+				kafka.InitKafkaProducer()
+				return nil
+			},
+			// flush the pending messages
+			Stop: func(ctx context.Context) error {
+				return kafka.Close()
+			},
+		},
+		{
+			Name: "kafka-bridge",
+			// forward mqtt publishes to kafka
+			Start: func(ctx context.Context) error {
+				kafka.InitBridge()
+				return nil
+			},
+			// hand the queued messages over to the producer
+			Stop: func(ctx context.Context) error {
+				if bridge := kafka.GetBridge(); bridge != nil {
+					bridge.Close()
+				}
+				return nil
+			},
+		},
+		{
+			Name: "mqtt-broker",
+			Start: func(ctx context.Context) error {
+				return mqtt.InstanceMQTTBroker()
+			},
+			Stop: func(ctx context.Context) error {
+				return mqtt.CloseMQTTBroker()
+			},
+		},
+		downstreamConsumer(),
+		wsServer(),
+	}
+}
+
+// tracer sets the tracer of the publishes, the spans still buffered are sent on stop
+func tracer() lifecycle.Component {
+	return lifecycle.Component{
+		Name: "tracing",
+		Start: func(ctx context.Context) error {
+			switch provider := config.TracingConfig().Provider; provider {
+			case "":
+				logrus.Info("Tracing disabled, no provider configured")
+			case tracingProviderAPM:
+				tracing.SetTracer(tracing.NewAPMTracer(apm.DefaultTracer))
+				logrus.Info("Tracing with Elastic APM")
+			default:
+				return fmt.Errorf("unknown TRACING_PROVIDER %q", provider)
+			}
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			if config.TracingConfig().Provider == tracingProviderAPM {
+				apm.DefaultTracer.Flush(ctx.Done())
+			}
+			return nil
+		},
+	}
+}
+
+// wsRelay shares the websocket messages with the other instances when the cluster is enabled
+func wsRelay() lifecycle.Component {
+	var relay *cluster.Relay
+
+	return lifecycle.Component{
+		Name: "cluster-ws-relay",
+		Start: func(ctx context.Context) error {
+			clusterCfg := config.ClusterConfig()
+			if !clusterCfg.Enabled {
+				logrus.Info("Cluster disabled, websocket messages are delivered on this instance only")
+				return nil
+			}
+
+			wsServer := websocket.GetServerConn()
+			relay = cluster.NewRelay(
+				redis.GetRedisClient(),
+				clusterCfg.WSChannel,
+				clusterCfg.GetNodeID(),
+				clusterCfg.QueueSize,
+				wsServer.PublishLocal,
+			)
+			if err := relay.Start(ctx); err != nil {
+				return err
+			}
+			wsServer.SetRelay(relay)
+			logrus.WithField("Cluster node id", relay.NodeID()).Info("Cluster websocket relay started")
+			return nil
+		},
+		// send the queued messages, a closed relay drops the later ones
+		Stop: func(ctx context.Context) error {
+			if relay == nil {
+				return nil
+			}
+			return relay.Close()
+		},
+	}
+}
+
+// platformInvalidation evicts the platform cache entries named by the invalidation events
+// of the redis channel and of the kafka topic, each is disabled when not configured.
+func platformInvalidation() lifecycle.Component {
+	var listener *platform.InvalidationListener
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	return lifecycle.Component{
+		Name: "platform-invalidation",
+		Start: func(startCtx context.Context) error {
+			if channel := config.PlatformConfig().InvalidationChannel; len(channel) > 0 {
+				listener = platform.NewInvalidationListener(redis.GetRedisClient(), channel)
+				if err := listener.Start(startCtx); err != nil {
+					return err
+				}
+			}
+
+			kafkaCfg := config.KafkaConfig()
+			if len(kafkaCfg.TopicPlatformInvalidation) == 0 || len(kafkaCfg.GetBrokers()) == 0 {
+				close(done)
+				return nil
+			}
+			consumer := kafka.NewConsumerGroup(
+				kafkaCfg.GetBrokers(),
+				kafkaCfg.GroupID+"-platform-invalidation",
+				logrus.WithField("consumer", "platform-invalidation"),
+			)
+			worker := kafka.NewRetryWorker(platform.HandleInvalidationMessage, kafka.NewRetryOptions())
+			go func() {
+				defer close(done)
+				consumer.ConsumeTopic(ctx, []string{kafkaCfg.TopicPlatformInvalidation}, 0, worker)
+			}()
+			return nil
+		},
+		Stop: func(stopCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+			case <-stopCtx.Done():
+				return stopCtx.Err()
+			}
+			if listener == nil {
+				return nil
+			}
+			return listener.Close()
+		},
+	}
+}
+
+// downstreamConsumer delivers kafka commands to devices until it is stopped,
+// the message being processed is committed before the consumer returns.
+func downstreamConsumer() lifecycle.Component {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	return lifecycle.Component{
+		Name: "kafka-downstream-consumer",
+		Start: func(context.Context) error {
+			go func() {
+				defer close(done)
+				downstream.InitConsumer(ctx)
+			}()
+			return nil
+		},
+		Stop: func(stopCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-stopCtx.Done():
+				return stopCtx.Err()
+			}
+		},
+	}
+}
+
+// wsServer serves the websocket clients, on stop it stops accepting
+// connections and sends a close frame to the connected clients.
+func wsServer() lifecycle.Component {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/socket", websocket.HandleWS)
+	server := httpServer("websocket-server", config.WebsocketConfig().Address, mux)
+
+	return lifecycle.Component{
+		Name: server.Name,
+		Start: func(ctx context.Context) error {
+			// authenticate websocket clients like mqtt clients
+			websocket.GetServerConn().SetAuthenticator(new(hook.WSAuthenticator))
+			return server.Start(ctx)
+		},
+		Stop: func(ctx context.Context) error {
+			// upgraded connections are not tracked by the http server
+			if err := server.Stop(ctx); err != nil {
+				return err
+			}
+			return websocket.GetServerConn().Shutdown(ctx)
+		},
+	}
+}
+
+// adminServer serves the prometheus metrics, the health probes and the admin api,
+// it starts first so the probes answer while the other components start.
+func adminServer() lifecycle.Component {
+	serviceCfg := config.ServiceConfig()
+	checker := health.NewChecker(time.Duration(serviceCfg.ReadinessTimeout) * time.Second)
+	checker.Add("redis", redis.Ping)
+	checker.Add("mqtt", mqtt.Ready)
+	checker.Add("platform", platform.Ping)
+	if kafkaCfg := config.KafkaConfig(); len(kafkaCfg.GetBrokers()) > 0 {
+		checker.Add("kafka", kafka.PingBrokers)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", checker.LiveHandler)
+	mux.HandleFunc("/readyz", checker.ReadyHandler)
+	mux.Handle("/api/admin/", admin.NewRouter(serviceCfg.AdminToken, admin.NewHandler(admin.Options{
+		Broker:         mqtt.GetServer,
+		ConnectedAt:    mqtt.ConnectedAt,
+		Websocket:      websocket.GetServerConn(),
+		Deliver:        downstream.NewProcessor().Deliver,
+		InvalidateUser: platform.InvalidateUser,
+	})))
+	if len(serviceCfg.AdminToken) == 0 {
+		logrus.Warn("ADMIN_TOKEN is not set, the admin api rejects every request")
+	}
+
+	return httpServer("admin-server", serviceCfg.AdminAddress, mux)
+}
+
+// httpServer listens on address when started and shuts down gracefully when stopped
+func httpServer(name, address string, handler http.Handler) lifecycle.Component {
+	srv := &http.Server{Handler: handler}
+
+	return lifecycle.Component{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			ln, err := net.Listen("tcp", address)
+			if err != nil {
+				return err
+			}
+			go func() {
+				if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logrus.WithField("component", name).WithError(err).Error("Error when serving http")
+				}
+			}()
+			return nil
+		},
+		Stop: srv.Shutdown,
+	}
+}
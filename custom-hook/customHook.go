@@ -4,22 +4,51 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"message-core/kafka"
+	"message-core/pkg/metrics"
+	"message-core/pkg/ruleengine"
+	"message-core/pkg/tracing"
 	"message-core/pkg/xservice/platform"
 	"message-core/websocket"
+	"sync"
+	"time"
 
 	"github.com/mochi-co/mqtt/v2"
 	"github.com/mochi-co/mqtt/v2/packets"
-	"github.com/spf13/cast"
 )
 
 // configuration for the broker
 const (
 	ACLWriteonly = "writeonly"
+	// WebsocketListener is the listener of the clients publishing for websocket sessions
+	WebsocketListener = "websocket"
+	// droppedByRulesUnavailable is the rule id of the packets dropped while the rules cannot be fetched
+	droppedByRulesUnavailable = "rules_unavailable"
 )
 
+// Options contains the configuration of the custom hook
+type Options struct {
+	// Server publishes the copies made by rules
+	Server *mqtt.Server
+	// AlertQueueSize alerts raised by rules wait for the AlertWorkers publishing them to kafka,
+	// the alerts raised while the queue is full are dropped
+	AlertQueueSize int
+	AlertWorkers   int
+}
+
 type CustomHook struct {
 	mqtt.HookBase
+	server *mqtt.Server
+	// connected maps client ids to their *session
+	connected sync.Map
+	alerts    alertPool
+}
+
+// session is the established connection of a client
+type session struct {
+	client      *mqtt.Client
+	connectedAt time.Time
 }
 
 func (h *CustomHook) ID() string {
@@ -29,6 +58,7 @@ func (h *CustomHook) ID() string {
 func (h *CustomHook) Provides(b byte) bool {
 	return bytes.Contains([]byte{
 		mqtt.OnConnect,
+		mqtt.OnSessionEstablished,
 		mqtt.OnDisconnect,
 		mqtt.OnSubscribed,
 		mqtt.OnUnsubscribed,
@@ -36,14 +66,28 @@ func (h *CustomHook) Provides(b byte) bool {
 		mqtt.OnPublish,
 		mqtt.OnACLCheck,
 		mqtt.OnConnectAuthenticate,
+		mqtt.OnPacketSent,
+		mqtt.OnPublishDropped,
 	}, []byte{b})
 }
 
 func (h *CustomHook) Init(config any) error {
+	opts, ok := config.(*Options)
+	if !ok {
+		opts = &Options{}
+	}
+	h.server = opts.Server
+	h.alerts.start(opts.AlertQueueSize, opts.AlertWorkers, h.Log)
 	h.Log.Info().Msg("initialised")
 	return nil
 }
 
+// Stop publishes the queued alerts
+func (h *CustomHook) Stop() error {
+	h.alerts.stop()
+	return nil
+}
+
 func (h *CustomHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) bool {
 	return true
 }
@@ -51,24 +95,39 @@ func (h *CustomHook) OnConnectAuthenticate(cl *mqtt.Client, pk packets.Packet) b
 func (h *CustomHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
 	err := h.TopicVerifyConnect(cl, pk)
 	if err != nil {
+		metrics.AuthFailed(metrics.ProtocolMQTT)
 		h.Log.Error().Err(err).
 			Str("username", string(pk.Connect.Username)).
-			Str("password", string(pk.Connect.Password)).
 			Str("client", cl.ID).
 			Msg("Client disconnected")
 		return err
 	}
 	h.Log.Info().
 		Str("username", string(pk.Connect.Username)).
-		Str("password", string(pk.Connect.Password)).
 		Str("client", cl.ID).
 		Msg("Client connected")
 	return nil
 }
 
+// OnSessionEstablished counts the connected client
+func (h *CustomHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	metrics.ClientConnected(metrics.ProtocolMQTT)
+	h.connected.Store(cl.ID, &session{client: cl, connectedAt: time.Now()})
+}
+
+// ConnectedAt returns when the client established its current session
+func (h *CustomHook) ConnectedAt(clientID string) (time.Time, bool) {
+	value, ok := h.connected.Load(clientID)
+	if !ok {
+		return time.Time{}, false
+	}
+	return value.(*session).connectedAt, true
+}
+
 func (h *CustomHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
 	ACL, err := h.TopicVerifyACL(cl, topic)
 	if err != nil {
+		metrics.ACLDenied(clientProtocol(cl), aclAction(write))
 		h.Log.Error().
 			Err(err).
 			Str("client", cl.ID).
@@ -78,6 +137,7 @@ func (h *CustomHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool
 	}
 	if ACL == ACLWriteonly {
 		if !write {
+			metrics.ACLDenied(clientProtocol(cl), aclAction(write))
 			h.Log.Error().
 				Err(err).
 				Str("client", cl.ID).
@@ -92,6 +152,11 @@ func (h *CustomHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool
 }
 
 func (h *CustomHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	metrics.ClientDisconnected(metrics.ProtocolMQTT)
+	// a session taken over by the same client id belongs to the new client
+	if value, ok := h.connected.Load(cl.ID); ok && value.(*session).client == cl {
+		h.connected.CompareAndDelete(cl.ID, value)
+	}
 	h.Log.Info().Str("client", cl.ID).Bool("expire", expire).Err(err).Msg("client disconnected")
 }
 
@@ -104,8 +169,18 @@ func (h *CustomHook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
 }
 
 func (h *CustomHook) TopicVerifyConnect(cl *mqtt.Client, pk packets.Packet) (err error) {
+	err = VerifyClientCertificate(cl.Net.Conn, string(pk.Connect.Username))
+	if err != nil {
+		return err
+	}
+
+	// the platform request carries the trace id as its request id
+	ctx, span := tracing.Start(context.Background(), "mqtt connect", tracing.TypeMessaging)
+	defer span.End()
+	span.SetAttribute("mqtt.client_id", cl.ID)
+
 	err = platform.ValidationUser(
-		context.Background(),
+		ctx,
 		platform.GatewayValidationRequest{
 			UserName: string(pk.Connect.Username),
 			Password: string(pk.Connect.Password),
@@ -118,94 +193,203 @@ func (h *CustomHook) TopicVerifyConnect(cl *mqtt.Client, pk packets.Packet) (err
 }
 
 func (h *CustomHook) TopicVerifyACL(cl *mqtt.Client, topic string) (ACL string, err error) {
+	return VerifyTopicACL(string(cl.Properties.Username), topic)
+}
 
-	topicActual, ACL, err := SplitTopicACL(topic)
-	if err != nil {
-		return
-	}
-
-	if string(cl.Properties.Username) != topicActual {
-		err = fmt.Errorf("Not meet username and topic: %s <> %s",
-			string(cl.Properties.Username),
-			topicActual)
-		return
+func (h *CustomHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	// commands injected by the broker itself are delivered to websocket by the sender
+	if cl.Net.Inline {
+		return pk, nil
 	}
 
-	return
-}
+	metrics.Published(clientProtocol(cl), pk.TopicName, len(pk.Payload))
 
-func (h *CustomHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
-	topicActual, _, err := SplitTopicACL(pk.TopicName)
-	if err != nil {
-		return packets.Packet{}, nil
+	if _, _, err := SplitTopicACL(pk.TopicName); err != nil {
+		metrics.ACLDenied(clientProtocol(cl), metrics.ActionPublish)
+		return h.rejectPublish(cl, pk, packets.ErrNotAuthorized)
 	}
-	websocket.GetServerConn().Publish(topicActual, pk.Payload)
 
-	npk := h.ApplyRuleForPacket(pk, pk.TopicName)
+	// the trace of a MQTTv5 publish continues the trace of its user properties
+	ctx := tracing.Extract(context.Background(), (*tracing.UserProperties)(&pk.Properties.User))
+	ctx, span := tracing.Start(ctx, "mqtt publish", tracing.TypeMessaging)
+	defer span.End()
+	span.SetAttribute("mqtt.topic", pk.TopicName)
+	span.SetAttribute("mqtt.client_id", cl.ID)
+
 	// apply rules here.
 	// first - check username to get the topic name.
 	// second - get rule from redis if exists.
 	// finnal - modify the message if rule exists.
+	_, ruleSpan := tracing.Start(ctx, "apply rules", tracing.TypeInternal)
+	npk, result := h.ApplyRuleForPacket(cl, pk, pk.TopicName)
+	ruleSpan.End()
+	if result.Dropped {
+		metrics.RuleDropped(clientProtocol(cl), pk.TopicName, result.DroppedBy)
+		span.SetAttribute("mqtt.dropped_by", result.DroppedBy)
+		return h.rejectPublish(cl, pk, packets.ErrImplementationSpecificError)
+	}
+
+	// subscribers and the kafka bridge continue the trace
+	tracing.Inject(ctx, (*tracing.UserProperties)(&npk.Properties.User))
+
+	_, fanOutSpan := tracing.Start(ctx, "websocket fan-out", tracing.TypeMessaging)
+	websocket.GetServerConn().Publish(WebsocketTopic(npk.TopicName), npk.Payload)
+	fanOutSpan.End()
+	h.PublishCopies(npk, result.Copies)
+	h.RaiseAlerts(cl, npk, result.Alerts)
 
 	return npk, nil
 }
 
+// rejectPublish discards the message and acknowledges it when its qos is 1 or 2, the broker
+// does not acknowledge the rejected messages and the publisher would retransmit them.
+// MQTTv5 publishers receive the reason code, it also ends the qos 2 flow without a PUBREL.
+func (h *CustomHook) rejectPublish(cl *mqtt.Client, pk packets.Packet, reason packets.Code) (packets.Packet, error) {
+	if pk.FixedHeader.Qos == 0 {
+		return pk, packets.ErrRejectPacket
+	}
+
+	ack := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Puback,
+		},
+		PacketID:   pk.PacketID,
+		ReasonCode: reason.Code,
+		Properties: packets.Properties{
+			ReasonString: reason.Reason,
+		},
+	}
+	if pk.FixedHeader.Qos == 2 {
+		ack.FixedHeader.Type = packets.Pubrec
+	}
+	if err := cl.WritePacket(ack); err != nil {
+		h.Log.Debug().Err(err).Str("client", cl.ID).Msg("failed to acknowledge rejected publish")
+	}
+	return pk, packets.ErrRejectPacket
+}
+
 func (h *CustomHook) OnPublished(cl *mqtt.Client, pk packets.Packet) {
 	// send to websocket server.
 	h.Log.Info().Str("client", cl.ID).Str("payload", string(pk.Payload)).Msg("published to client")
+
+	h.ForwardToKafka(cl, pk)
+}
+
+// OnPacketSent counts the messages delivered to mqtt subscribers
+func (h *CustomHook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		metrics.Delivered(metrics.ProtocolMQTT, pk.TopicName)
+	}
 }
 
-func (h *CustomHook) ApplyRuleForPacket(pk packets.Packet, userName string) (npk packets.Packet) {
+// OnPublishDropped counts the messages dropped because the subscriber does not keep up
+func (h *CustomHook) OnPublishDropped(cl *mqtt.Client, pk packets.Packet) {
+	metrics.Dropped(metrics.ProtocolMQTT, pk.TopicName, metrics.ReasonSlowConsumer)
+}
+
+// ForwardToKafka forwards accepted publishes of devices to the mapped kafka topic.
+// Messages injected by inline clients are skipped to avoid kafka -> mqtt -> kafka loops.
+func (h *CustomHook) ForwardToKafka(cl *mqtt.Client, pk packets.Packet) {
+	bridge := kafka.GetBridge()
+	if bridge == nil || cl.Net.Inline || len(pk.TopicName) == 0 {
+		return
+	}
+
+	// the consumers continue the trace of the publish
+	var headers tracing.KafkaHeaders
+	tracing.Copy((*tracing.UserProperties)(&pk.Properties.User), &headers)
+
+	bridge.Forward(kafka.BridgeMessage{
+		Topic:    pk.TopicName,
+		Payload:  pk.Payload,
+		Qos:      pk.FixedHeader.Qos,
+		Retain:   pk.FixedHeader.Retain,
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Headers:  headers,
+	})
+}
+
+// ApplyRuleForPacket applies the rules of the user to json payloads and
+// returns the packet with its payload and topic changed by the rule actions.
+func (h *CustomHook) ApplyRuleForPacket(
+	cl *mqtt.Client,
+	pk packets.Packet,
+	userName string,
+) (npk packets.Packet, result ruleengine.Result) {
 	dataPacket := make(map[string]interface{})
 	err := json.Unmarshal(pk.Payload, &dataPacket)
 	if err != nil {
 		// if error when unmarshalling => return original packet
-		return pk
+		return pk, result
+	}
+
+	dataRules, err := platform.GetRules(context.Background(), userName)
+	if errors.Is(err, platform.ErrRulesUnavailable) {
+		// the rules of a connected user were invalidated, the packet must not skip them
+		h.Log.Error().Err(err).Str("topic", pk.TopicName).Msg("ApplyRuleForPacket Error")
+		return packets.Packet{}, ruleengine.Result{Dropped: true, DroppedBy: droppedByRulesUnavailable}
+	}
+	if err != nil {
+		// if error when getting rules => return original packet
+		return pk, result
+	}
+
+	rules := make([]ruleengine.Rule, 0, len(dataRules.AdvancedRules)+1)
+	rules = append(rules, dataRules.AdvancedRules...)
+	if rule, ok := LegacyRule(dataRules.Rules); ok {
+		rules = append(rules, rule)
 	}
 
-	dataRules, err := platform.GetRuleCache(context.Background(), userName)
+	if len(rules) == 0 {
+		return pk, result
+	}
+
+	msg := &ruleengine.Message{
+		Topic:    pk.TopicName,
+		ClientID: cl.ID,
+		Username: string(cl.Properties.Username),
+		Payload:  dataPacket,
+	}
+	result, err = ruleengine.Apply(rules, msg)
+	for _, ruleErr := range result.Errors {
+		// a mistyped value does not match the condition, the other rules still apply
+		h.Log.Warn().Err(ruleErr).Str("topic", pk.TopicName).Msg("ApplyRuleForPacket condition not evaluated")
+	}
 	if err != nil {
-		// if error when unmarshalling => return original packet
-		return pk
-	}
-
-	if len(dataRules.Rules) == 0 {
-		return pk
-	}
-
-	mapRule := make(map[string]platform.RulesDevices)
-	for _, rule := range dataRules.Rules {
-		mapRule[rule.Atribute] = rule
-	}
-
-	for atribute, value := range dataPacket {
-		if _, exist := mapRule[atribute]; exist {
-			switch mapRule[atribute].Comparison {
-			case "EQUAL":
-				if cast.ToFloat32(value) != cast.ToFloat32(mapRule[atribute].RuleValue) {
-					return packets.Packet{}
-				}
-				continue
-			case "NOT EQUAL":
-				if cast.ToFloat32(value) == cast.ToFloat32(mapRule[atribute].RuleValue) {
-					return packets.Packet{}
-				}
-				continue
-			case "GREATER THAN":
-				if cast.ToFloat32(value) < cast.ToFloat32(mapRule[atribute].RuleValue) {
-					return packets.Packet{}
-				}
-				continue
-			case "LESS THAN":
-				if cast.ToFloat32(value) > cast.ToFloat32(mapRule[atribute].RuleValue) {
-					return packets.Packet{}
-				}
-				continue
-			}
+		// if error when applying rules => return original packet
+		h.Log.Error().Err(err).Str("topic", pk.TopicName).Msg("ApplyRuleForPacket Error")
+		return pk, ruleengine.Result{}
+	}
+	if result.Dropped {
+		return packets.Packet{}, result
+	}
+
+	npk = pk
+	npk.TopicName = msg.Topic
+	if result.Modified {
+		payload, err := json.Marshal(msg.Payload)
+		if err != nil {
+			h.Log.Error().Err(err).Str("topic", pk.TopicName).Msg("ApplyRuleForPacket Error")
+			return pk, ruleengine.Result{}
 		}
+		npk.Payload = payload
+	}
 
+	return npk, result
+}
+
+// clientProtocol returns the protocol the client publishes with
+func clientProtocol(cl *mqtt.Client) string {
+	if cl.Net.Listener == WebsocketListener {
+		return metrics.ProtocolWS
 	}
-	return pk
+	return metrics.ProtocolMQTT
 }
 
-// const options = ["EQUAL", "NOT EQUAL", "GREATER THAN", "LESS THAN"];
+func aclAction(write bool) string {
+	if write {
+		return metrics.ActionPublish
+	}
+	return metrics.ActionSubscribe
+}
@@ -0,0 +1,144 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"message-core/pkg/config"
+	"message-core/pkg/xservice/platform"
+	"message-core/redis"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPlatform caches the platform validations in miniredis and answers a
+// legacy rule keeping the temp below the stored threshold
+func newTestPlatform(t *testing.T, threshold *atomic.Value) (*httptest.Server, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", mr.Addr())
+	config.SetConfig()
+	redis.InitRedisClient()
+	t.Cleanup(func() { redis.Close() })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(platform.PlatformBaseResponse{
+			StatusCode: http.StatusOK,
+			Data: platform.RulesDevicesResponse{RulesDevices: []platform.RulesDevices{
+				{Atribute: "temp", Comparison: "LESS THAN", RuleValue: threshold.Load().(string)},
+			}},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	platform.SetCacheKey("test-key")
+	platform.Configure(platform.Options{BaseURL: srv.URL, Timeout: time.Second, ServiceToken: "service-token"})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, platform.Drain(ctx))
+		platform.Configure(platform.Options{})
+	})
+	return srv, mr
+}
+
+func TestOnPublishAppliesRulesAfterInvalidation(t *testing.T) {
+	var threshold atomic.Value
+	threshold.Store("50")
+	srv, mr := newTestPlatform(t, &threshold)
+
+	h := new(CustomHook)
+	h.SetOpts(&storageLogger, nil)
+	require.NoError(t, h.Init(&Options{}))
+	t.Cleanup(func() { h.Stop() })
+
+	// the rules are cached last once the validation is done
+	ctx := context.Background()
+	for _, device := range []string{"device1", "device2"} {
+		require.NoError(t, platform.ValidationUser(ctx, platform.GatewayValidationRequest{UserName: device, Password: "s3cr3t"}))
+		require.Eventually(t, func() bool {
+			rules, err := platform.GetRuleCache(ctx, device)
+			return err == nil && rules.UserState == platform.UserStateValidated
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// publish reports whether the publish of the device is forwarded
+	publish := func(device string) bool {
+		cl := mqtt.New(nil).NewClient(nil, "tcp", "client-"+device, false)
+		cl.Properties.Username = []byte(device)
+		_, err := h.OnPublish(cl, packets.Packet{
+			FixedHeader: packets.FixedHeader{Type: packets.Publish},
+			TopicName:   device,
+			Payload:     []byte(`{"temp": 60}`),
+		})
+		if err != nil {
+			require.ErrorIs(t, err, packets.ErrRejectPacket)
+		}
+		return err == nil
+	}
+	assert.False(t, publish("device1"), "dropped by the rules")
+
+	// the platform raises the threshold and invalidates the rules of the connected device
+	threshold.Store("100")
+	require.NoError(t, platform.InvalidationEvent{Username: "device1", Type: platform.InvalidationRules}.Apply(ctx))
+	require.Eventually(t, func() bool {
+		return publish("device1")
+	}, 5*time.Second, 10*time.Millisecond, "the new rules apply once fetched again")
+
+	// the expired rules still apply while the platform is down
+	srv.Close()
+	threshold.Store("10")
+	mr.FastForward(time.Hour)
+	assert.True(t, publish("device1"), "the last known rules apply")
+	assert.False(t, publish("device2"), "the last known rules apply")
+
+	// the invalidated rules are not skipped while the platform is unavailable
+	require.NoError(t, platform.InvalidationEvent{Username: "device2", Type: platform.InvalidationRules}.Apply(ctx))
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "client-device2", false)
+	_, result := h.ApplyRuleForPacket(cl, packets.Packet{TopicName: "device2", Payload: []byte(`{"temp": 1}`)}, "device2")
+	assert.Equal(t, droppedByRulesUnavailable, result.DroppedBy, "dropped while the rules are unavailable")
+}
+
+func TestOnPublishAcknowledgesRejectedMessages(t *testing.T) {
+	h := new(CustomHook)
+	h.SetOpts(&storageLogger, nil)
+	require.NoError(t, h.Init(&Options{}))
+	t.Cleanup(func() { h.Stop() })
+	server := mqtt.New(nil)
+	*server.Log = storageLogger
+
+	// the topic is denied by the acl
+	pk := publishPacket(1, `{"temp": 60}`)
+	pk.TopicName = "/telemetry"
+
+	cl, written := pipeClient(server, "client-1", 5)
+	_, err := h.OnPublish(cl, pk)
+	assert.ErrorIs(t, err, packets.ErrRejectPacket)
+	cl.Stop(nil)
+	data := <-written
+	require.Greater(t, len(data), 4)
+	assert.Equal(t, byte(packets.Puback<<4), data[0])
+	assert.Equal(t, []byte{0, 7}, data[2:4], "packet id")
+	assert.Equal(t, packets.ErrNotAuthorized.Code, data[4])
+
+	pk.FixedHeader.Qos = 2
+	cl, written = pipeClient(server, "client-2", 4)
+	_, err = h.OnPublish(cl, pk)
+	assert.ErrorIs(t, err, packets.ErrRejectPacket)
+	cl.Stop(nil)
+	assert.Equal(t, []byte{packets.Pubrec << 4, 2, 0, 7}, <-written, "MQTTv3 acks have no reason code")
+
+	pk.FixedHeader.Qos = 0
+	cl, written = pipeClient(server, "client-3", 5)
+	_, err = h.OnPublish(cl, pk)
+	assert.ErrorIs(t, err, packets.ErrRejectPacket)
+	cl.Stop(nil)
+	assert.Empty(t, <-written, "qos 0 messages are not acknowledged")
+}
@@ -0,0 +1,239 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"message-core/pkg/metrics"
+	"message-core/pkg/ratelimit"
+	"message-core/websocket"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// actions on a publish exceeding a rate limit
+const (
+	// RateLimitDrop drops the message
+	RateLimitDrop = "drop"
+	// RateLimitDisconnect drops the message and disconnects the client
+	RateLimitDisconnect = "disconnect"
+	// RateLimitQuota drops the message and acknowledges it with the quota exceeded
+	// reason code to MQTTv5 clients, other clients get the message dropped
+	RateLimitQuota = "quota"
+)
+
+// scopes of the rate limits
+const (
+	scopeClient = "client"
+	scopeUser   = "user"
+)
+
+// limits of the rate limits
+const (
+	limitConnects = "connects"
+	limitMessages = "messages"
+	limitBytes    = "bytes"
+)
+
+const rateLimitKickReason = "Server: Rate limit exceeded"
+
+var errInvalidRateLimitAction = errors.New("invalid rate limit action")
+
+// RateLimits are the limits of a client id or of a username
+type RateLimits struct {
+	Connects ratelimit.Limit
+	Messages ratelimit.Limit
+	Bytes    ratelimit.Limit
+}
+
+// RateLimitOptions contains the configuration of the rate limit hook
+type RateLimitOptions struct {
+	Server  *mqtt.Server
+	Limiter *ratelimit.Limiter
+	Client  RateLimits
+	User    RateLimits
+	// Action on a publish exceeding a limit, RateLimitDrop by default
+	Action string
+}
+
+// RateLimitHook limits the connects, messages and bytes per second of each client id
+// and username. It must be added before the custom hook so limited messages are not
+// delivered to websocket clients. Limits are not enforced when redis fails.
+type RateLimitHook struct {
+	mqtt.HookBase
+	server  *mqtt.Server
+	limiter *ratelimit.Limiter
+	client  RateLimits
+	user    RateLimits
+	action  string
+	ctx     context.Context
+}
+
+func (h *RateLimitHook) ID() string {
+	return "rate-limit"
+}
+
+func (h *RateLimitHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnConnect,
+		mqtt.OnPublish,
+	}, []byte{b})
+}
+
+func (h *RateLimitHook) Init(config any) error {
+	opts, ok := config.(*RateLimitOptions)
+	if !ok || opts.Server == nil || opts.Limiter == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.action = opts.Action
+	switch h.action {
+	case "":
+		h.action = RateLimitDrop
+	case RateLimitDrop, RateLimitDisconnect, RateLimitQuota:
+	default:
+		return errInvalidRateLimitAction
+	}
+
+	h.ctx = context.Background()
+	h.server = opts.Server
+	h.limiter = opts.Limiter
+	h.client = opts.Client
+	h.user = opts.User
+
+	h.Log.Info().Str("action", h.action).Msg("initialised")
+	return nil
+}
+
+// OnConnect rejects the connection when the client id or username reconnects too often
+func (h *RateLimitHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	if cl.Net.Inline {
+		return nil
+	}
+
+	scope, ok := h.allow(limitConnects, cl.ID, string(pk.Connect.Username),
+		h.client.Connects, h.user.Connects, 1)
+	if ok {
+		return nil
+	}
+
+	metrics.RateLimited(scope, limitConnects, RateLimitDisconnect)
+	h.Log.Warn().Str("client", cl.ID).Str("scope", scope).Msg("connect rate limit exceeded")
+
+	code := packets.ErrQuotaExceeded
+	if cl.Properties.ProtocolVersion < 5 {
+		code = packets.ErrServerUnavailable
+	}
+	if err := h.server.SendConnack(cl, code, false, nil); err != nil {
+		h.Log.Debug().Err(err).Str("client", cl.ID).Msg("failed to send connack")
+	}
+	return code
+}
+
+// AllowConnect reports whether the username may connect again, it limits the websocket
+// clients with the connect limit of the username as their client ids are generated
+func (h *RateLimitHook) AllowConnect(username string) bool {
+	if h.take(limitConnects+":"+scopeUser+":"+username, h.user.Connects, 1) {
+		return true
+	}
+
+	metrics.RateLimited(scopeUser, limitConnects, RateLimitDisconnect)
+	h.Log.Warn().Str("username", username).Str("scope", scopeUser).Msg("websocket connect rate limit exceeded")
+	return false
+}
+
+// OnPublish rejects the message when the client id or username exceeds its messages or bytes per second
+func (h *RateLimitHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	// messages injected by the broker itself were limited where they come from
+	if cl.Net.Inline {
+		return pk, nil
+	}
+
+	username := string(cl.Properties.Username)
+	limit := limitMessages
+	scope, ok := h.allow(limit, cl.ID, username, h.client.Messages, h.user.Messages, 1)
+	if ok {
+		limit = limitBytes
+		scope, ok = h.allow(limit, cl.ID, username, h.client.Bytes, h.user.Bytes, len(pk.Payload))
+	}
+	if ok {
+		return pk, nil
+	}
+
+	metrics.RateLimited(scope, limit, h.action)
+	metrics.Dropped(clientProtocol(cl), pk.TopicName, metrics.ReasonRateLimited)
+	h.Log.Warn().
+		Str("client", cl.ID).
+		Str("topic", pk.TopicName).
+		Str("scope", scope).
+		Str("limit", limit).
+		Msg("publish rate limit exceeded")
+
+	switch h.action {
+	case RateLimitDisconnect:
+		h.disconnect(cl)
+	case RateLimitQuota:
+		h.quotaExceeded(cl, pk)
+	}
+	return pk, packets.ErrRejectPacket
+}
+
+// allow takes cost tokens from the buckets of the client id and of the username,
+// it returns the scope of the exceeded limit.
+func (h *RateLimitHook) allow(limit, clientID, username string, client, user ratelimit.Limit, cost int) (string, bool) {
+	if !h.take(limit+":"+scopeClient+":"+clientID, client, cost) {
+		return scopeClient, false
+	}
+	if len(username) > 0 && !h.take(limit+":"+scopeUser+":"+username, user, cost) {
+		return scopeUser, false
+	}
+	return "", true
+}
+
+func (h *RateLimitHook) take(key string, limit ratelimit.Limit, cost int) bool {
+	allowed, err := h.limiter.Allow(h.ctx, key, limit, cost)
+	if err != nil {
+		h.Log.Warn().Err(err).Msg("failed to check rate limit, limit not enforced")
+		return true
+	}
+	return allowed
+}
+
+func (h *RateLimitHook) disconnect(cl *mqtt.Client) {
+	// websocket clients publish through a client created for each message
+	if cl.Net.Listener == WebsocketListener {
+		websocket.GetServerConn().Kick(cl.ID, rateLimitKickReason)
+		return
+	}
+
+	if err := h.server.DisconnectClient(cl, packets.ErrQuotaExceeded); err != nil {
+		h.Log.Debug().Err(err).Str("client", cl.ID).Msg("failed to send disconnect")
+	}
+	// the broker leaves the connection open when passive disconnect is enabled
+	cl.Stop(packets.ErrQuotaExceeded)
+}
+
+// quotaExceeded acknowledges the rejected qos 1 and 2 messages of MQTTv5 clients
+func (h *RateLimitHook) quotaExceeded(cl *mqtt.Client, pk packets.Packet) {
+	if cl.Properties.ProtocolVersion < 5 || pk.FixedHeader.Qos == 0 {
+		return
+	}
+
+	ack := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Puback,
+		},
+		PacketID:   pk.PacketID,
+		ReasonCode: packets.ErrQuotaExceeded.Code,
+		Properties: packets.Properties{
+			ReasonString: packets.ErrQuotaExceeded.Reason,
+		},
+	}
+	if pk.FixedHeader.Qos == 2 {
+		ack.FixedHeader.Type = packets.Pubrec
+	}
+	if err := cl.WritePacket(ack); err != nil {
+		h.Log.Debug().Err(err).Str("client", cl.ID).Msg("failed to send quota exceeded ack")
+	}
+}
@@ -0,0 +1,168 @@
+package hook
+
+import (
+	"io"
+	"message-core/pkg/ratelimit"
+	"net"
+	"testing"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newRateLimitHook(t *testing.T, opts RateLimitOptions) (*RateLimitHook, *mqtt.Server) {
+	mr := miniredis.RunT(t)
+	db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.Close() })
+
+	server := mqtt.New(nil)
+	*server.Log = storageLogger
+	opts.Server = server
+	opts.Limiter = ratelimit.NewLimiter(db, "test:")
+
+	h := new(RateLimitHook)
+	h.SetOpts(&storageLogger, nil)
+	require.NoError(t, h.Init(&opts))
+	return h, server
+}
+
+// pipeClient returns a client whose written packets are read from the returned channel
+func pipeClient(server *mqtt.Server, id string, version byte) (*mqtt.Client, <-chan []byte) {
+	conn, remote := net.Pipe()
+	written := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(remote)
+		written <- data
+	}()
+
+	cl := server.NewClient(conn, "tcp", id, false)
+	cl.Properties.ProtocolVersion = version
+	cl.Properties.Username = []byte("user")
+	return cl, written
+}
+
+func publishPacket(qos byte, payload string) packets.Packet {
+	return packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: qos},
+		TopicName:   "user/telemetry",
+		Payload:     []byte(payload),
+		PacketID:    7,
+	}
+}
+
+func TestRateLimitHookInit(t *testing.T) {
+	h := new(RateLimitHook)
+	h.SetOpts(&storageLogger, nil)
+	assert.ErrorIs(t, h.Init(nil), mqtt.ErrInvalidConfigType)
+	assert.ErrorIs(t, h.Init(&RateLimitOptions{}), mqtt.ErrInvalidConfigType)
+	assert.ErrorIs(t, h.Init(&RateLimitOptions{
+		Server:  mqtt.New(nil),
+		Limiter: ratelimit.NewLimiter(nil, ""),
+		Action:  "ignore",
+	}), errInvalidRateLimitAction)
+}
+
+func TestRateLimitHookDropsMessages(t *testing.T) {
+	h, server := newRateLimitHook(t, RateLimitOptions{
+		Client: RateLimits{Messages: ratelimit.Limit{Rate: 0.001, Burst: 2}},
+		User:   RateLimits{Bytes: ratelimit.Limit{Rate: 0.001, Burst: 10}},
+	})
+	assert.Equal(t, RateLimitDrop, h.action)
+
+	cl := server.NewClient(nil, "tcp", "client-1", false)
+	cl.Properties.Username = []byte("user")
+	for i := 0; i < 2; i++ {
+		_, err := h.OnPublish(cl, publishPacket(0, "1"))
+		require.NoError(t, err)
+	}
+	_, err := h.OnPublish(cl, publishPacket(0, "1"))
+	assert.ErrorIs(t, err, packets.ErrRejectPacket, "client messages exceeded")
+
+	// the bytes of the user are shared by its clients
+	other := server.NewClient(nil, "tcp", "client-2", false)
+	other.Properties.Username = []byte("user")
+	_, err = h.OnPublish(other, publishPacket(0, "123456789"))
+	assert.ErrorIs(t, err, packets.ErrRejectPacket, "user bytes exceeded")
+	assert.False(t, other.Closed())
+
+	// inline clients are not limited
+	inline := server.NewClient(nil, "local", "inline", true)
+	for i := 0; i < 3; i++ {
+		_, err = h.OnPublish(inline, publishPacket(0, "12345678"))
+		require.NoError(t, err)
+	}
+}
+
+func TestRateLimitHookDisconnects(t *testing.T) {
+	h, server := newRateLimitHook(t, RateLimitOptions{
+		Client: RateLimits{Messages: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+		Action: RateLimitDisconnect,
+	})
+
+	cl, _ := pipeClient(server, "client-1", 5)
+	_, err := h.OnPublish(cl, publishPacket(0, "1"))
+	require.NoError(t, err)
+	_, err = h.OnPublish(cl, publishPacket(0, "1"))
+	assert.ErrorIs(t, err, packets.ErrRejectPacket)
+	assert.True(t, cl.Closed())
+	assert.ErrorIs(t, cl.StopCause(), packets.ErrQuotaExceeded)
+}
+
+func TestRateLimitHookQuotaExceeded(t *testing.T) {
+	h, server := newRateLimitHook(t, RateLimitOptions{
+		Client: RateLimits{Messages: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+		Action: RateLimitQuota,
+	})
+
+	cl, written := pipeClient(server, "client-1", 5)
+	_, err := h.OnPublish(cl, publishPacket(1, "1"))
+	require.NoError(t, err)
+	_, err = h.OnPublish(cl, publishPacket(1, "1"))
+	assert.ErrorIs(t, err, packets.ErrRejectPacket)
+	assert.False(t, cl.Closed())
+
+	cl.Stop(nil)
+	data := <-written
+	require.Greater(t, len(data), 4)
+	assert.Equal(t, byte(packets.Puback<<4), data[0])
+	assert.Equal(t, []byte{0, 7}, data[2:4], "packet id")
+	assert.Equal(t, packets.ErrQuotaExceeded.Code, data[4])
+}
+
+func TestRateLimitHookRejectsConnects(t *testing.T) {
+	h, server := newRateLimitHook(t, RateLimitOptions{
+		User: RateLimits{Connects: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})
+	pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte("user")}}
+
+	cl, _ := pipeClient(server, "client-1", 5)
+	require.NoError(t, h.OnConnect(cl, pk))
+
+	cl, written := pipeClient(server, "client-2", 5)
+	assert.ErrorIs(t, h.OnConnect(cl, pk), packets.ErrQuotaExceeded)
+	cl.Stop(nil)
+	data := <-written
+	require.Greater(t, len(data), 3)
+	assert.Equal(t, byte(packets.Connack<<4), data[0])
+	assert.Equal(t, packets.ErrQuotaExceeded.Code, data[3])
+}
+
+func TestRateLimitHookAllowConnect(t *testing.T) {
+	h, server := newRateLimitHook(t, RateLimitOptions{
+		User: RateLimits{Connects: ratelimit.Limit{Rate: 0.001, Burst: 1}},
+	})
+
+	assert.True(t, h.AllowConnect("user"))
+	assert.False(t, h.AllowConnect("user"))
+	assert.True(t, h.AllowConnect("other"))
+
+	// websocket and mqtt connects share the bucket of the username
+	cl, _ := pipeClient(server, "client-1", 5)
+	pk := packets.Packet{Connect: packets.ConnectParams{Username: []byte("other")}}
+	assert.ErrorIs(t, h.OnConnect(cl, pk), packets.ErrQuotaExceeded)
+	cl.Stop(nil)
+}
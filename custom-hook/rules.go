@@ -0,0 +1,213 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	mkafka "message-core/kafka"
+	"message-core/pkg/config"
+	"message-core/pkg/metrics"
+	"message-core/pkg/ruleengine"
+	"message-core/pkg/xservice/platform"
+	"message-core/websocket"
+	"sync"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/segmentio/kafka-go"
+)
+
+const legacyRuleID = "legacy"
+
+// alerts queued and workers publishing them when not configured
+const (
+	defaultAlertQueueSize = 1000
+	defaultAlertWorkers   = 4
+)
+
+// legacyOperators are the comparisons supported by platform.RulesDevices,
+// rules with any other comparison are ignored.
+var legacyOperators = map[string]bool{
+	ruleengine.OperatorLegacyEqual:       true,
+	ruleengine.OperatorLegacyNotEqual:    true,
+	ruleengine.OperatorLegacyGreaterThan: true,
+	ruleengine.OperatorLegacyLessThan:    true,
+}
+
+// LegacyRule converts the platform attribute rules into a single rule dropping
+// messages whose top level attributes do not meet every comparison.
+// The last rule of an attribute wins and missing attributes are not checked.
+func LegacyRule(rules []platform.RulesDevices) (rule ruleengine.Rule, ok bool) {
+	mapRule := make(map[string]platform.RulesDevices)
+	order := []string{}
+	for _, rule := range rules {
+		if _, exist := mapRule[rule.Atribute]; !exist {
+			order = append(order, rule.Atribute)
+		}
+		mapRule[rule.Atribute] = rule
+	}
+
+	conditions := []ruleengine.Condition{}
+	for _, atribute := range order {
+		if !legacyOperators[mapRule[atribute].Comparison] {
+			continue
+		}
+		conditions = append(conditions, ruleengine.Condition{
+			Path:          atribute,
+			Operator:      mapRule[atribute].Comparison,
+			Value:         mapRule[atribute].RuleValue,
+			Literal:       true,
+			IgnoreMissing: true,
+		})
+	}
+	if len(conditions) == 0 {
+		return rule, false
+	}
+
+	return ruleengine.Rule{
+		ID: legacyRuleID,
+		Match: ruleengine.Group{
+			Logic:      ruleengine.LogicAnd,
+			Not:        true,
+			Conditions: conditions,
+		},
+		Actions: []ruleengine.Action{{Type: ruleengine.ActionDrop}},
+	}, true
+}
+
+// AlertEvent is published to kafka by alert actions
+type AlertEvent struct {
+	RuleID    string          `json:"rule_id"`
+	Message   string          `json:"message"`
+	Topic     string          `json:"topic"`
+	ClientID  string          `json:"client_id"`
+	Username  string          `json:"username"`
+	Payload   json.RawMessage `json:"payload"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// PublishCopies publishes the packet to the topics copied by rules,
+// copies are published inline so rules are not applied to them again.
+func (h *CustomHook) PublishCopies(pk packets.Packet, topics []string) {
+	for _, topic := range topics {
+		if h.server == nil {
+			h.Log.Warn().Str("topic", topic).Msg("Skip rule copy, no server configured")
+			return
+		}
+		if err := h.server.Publish(topic, pk.Payload, false, pk.FixedHeader.Qos); err != nil {
+			h.Log.Error().Err(err).Str("topic", topic).Msg("PublishCopies Error")
+			continue
+		}
+		websocket.GetServerConn().Publish(WebsocketTopic(topic), pk.Payload)
+	}
+}
+
+// RaiseAlerts publishes the alerts raised by rules to kafka
+func (h *CustomHook) RaiseAlerts(cl *mqtt.Client, pk packets.Packet, alerts []ruleengine.Alert) {
+	for _, alert := range alerts {
+		topic := alert.Topic
+		if len(topic) == 0 {
+			topic = config.KafkaConfig().TopicAlert
+		}
+		if len(topic) == 0 {
+			h.Log.Warn().Str("rule", alert.RuleID).Msg("Skip rule alert, no kafka topic configured")
+			continue
+		}
+
+		value, err := json.Marshal(AlertEvent{
+			RuleID:    alert.RuleID,
+			Message:   alert.Message,
+			Topic:     pk.TopicName,
+			ClientID:  cl.ID,
+			Username:  string(cl.Properties.Username),
+			Payload:   pk.Payload,
+			Timestamp: time.Now().Unix(),
+		})
+		if err != nil {
+			h.Log.Error().Err(err).Str("rule", alert.RuleID).Msg("RaiseAlerts Error")
+			continue
+		}
+
+		// never block the broker on kafka
+		if !h.alerts.queue(kafka.Message{
+			Topic: topic,
+			Key:   []byte(cl.ID),
+			Value: value,
+		}) {
+			metrics.AlertDropped(alert.RuleID)
+			h.Log.Warn().Str("rule", alert.RuleID).Str("topic", topic).Msg("Drop rule alert, the alert queue is full")
+		}
+	}
+}
+
+// alertPool publishes the alerts to kafka with a bounded queue and a fixed number of workers
+type alertPool struct {
+	messages chan kafka.Message
+	workers  sync.WaitGroup
+	publish  func(ctx context.Context, msgs ...kafka.Message) error
+	log      *zerolog.Logger
+	// mu guards closed, the queue is closed once
+	mu     sync.RWMutex
+	closed bool
+}
+
+// start creates the queue and starts the workers publishing it
+func (p *alertPool) start(queueSize, workers int, log *zerolog.Logger) {
+	if queueSize <= 0 {
+		queueSize = defaultAlertQueueSize
+	}
+	if workers <= 0 {
+		workers = defaultAlertWorkers
+	}
+	if p.publish == nil {
+		p.publish = mkafka.PublishMessage
+	}
+
+	p.log = log
+	p.messages = make(chan kafka.Message, queueSize)
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.run()
+	}
+}
+
+// queue queues the alert without blocking, it returns false when the queue is full or closed
+func (p *alertPool) queue(msg kafka.Message) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed || p.messages == nil {
+		return false
+	}
+	select {
+	case p.messages <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *alertPool) run() {
+	defer p.workers.Done()
+
+	for msg := range p.messages {
+		if err := p.publish(context.Background(), msg); err != nil {
+			p.log.Error().Err(err).Str("topic", msg.Topic).Msg("RaiseAlerts Error")
+		}
+	}
+}
+
+// stop stops accepting alerts and waits until the queued ones are published
+func (p *alertPool) stop() {
+	p.mu.Lock()
+	if p.closed || p.messages == nil {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.messages)
+	p.mu.Unlock()
+
+	p.workers.Wait()
+}
@@ -0,0 +1,142 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"message-core/pkg/ruleengine"
+	"message-core/pkg/xservice/platform"
+	"testing"
+	"time"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/segmentio/kafka-go"
+	"github.com/spf13/cast"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// legacyPass is the former hard-coded evaluation of platform.RulesDevices
+func legacyPass(dataPacket map[string]interface{}, rules []platform.RulesDevices) bool {
+	mapRule := make(map[string]platform.RulesDevices)
+	for _, rule := range rules {
+		mapRule[rule.Atribute] = rule
+	}
+	for atribute, value := range dataPacket {
+		rule, exist := mapRule[atribute]
+		if !exist {
+			continue
+		}
+		switch rule.Comparison {
+		case "EQUAL":
+			if cast.ToFloat32(value) != cast.ToFloat32(rule.RuleValue) {
+				return false
+			}
+		case "NOT EQUAL":
+			if cast.ToFloat32(value) == cast.ToFloat32(rule.RuleValue) {
+				return false
+			}
+		case "GREATER THAN":
+			if cast.ToFloat32(value) < cast.ToFloat32(rule.RuleValue) {
+				return false
+			}
+		case "LESS THAN":
+			if cast.ToFloat32(value) > cast.ToFloat32(rule.RuleValue) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestLegacyRuleEvaluatesLikeFormerRules(t *testing.T) {
+	rules := []platform.RulesDevices{
+		{Atribute: "temp", Comparison: "GREATER THAN", RuleValue: "20"},
+		{Atribute: "temp", Comparison: "LESS THAN", RuleValue: "30"},
+		{Atribute: "mode", Comparison: "EQUAL", RuleValue: "1"},
+		{Atribute: "door", Comparison: "NOT EQUAL", RuleValue: "0"},
+		{Atribute: "label", Comparison: "UNKNOWN", RuleValue: "x"},
+	}
+	payloads := []string{
+		`{"temp": 25, "mode": 1, "door": 1}`,
+		`{"temp": 30, "mode": "1", "door": true}`,
+		`{"temp": 31}`,
+		`{"temp": 10, "mode": 1}`,
+		`{"mode": 2}`,
+		`{"door": 0}`,
+		`{"door": "open", "label": "y"}`,
+		`{"mode": null}`,
+		`{"other": 1}`,
+		`{"a.b": 1, "a": {"b": 2}}`,
+	}
+
+	rule, ok := LegacyRule(rules)
+	require.True(t, ok)
+	for _, raw := range payloads {
+		data := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal([]byte(raw), &data))
+
+		result, err := ruleengine.Apply([]ruleengine.Rule{rule}, &ruleengine.Message{Payload: data})
+		assert.NoError(t, err)
+		assert.Equal(t, legacyPass(data, rules), !result.Dropped, raw)
+	}
+
+	_, ok = LegacyRule([]platform.RulesDevices{{Atribute: "x", Comparison: "UNKNOWN"}})
+	assert.False(t, ok)
+}
+
+// alertsDropped returns the alerts of the rule dropped so far
+func alertsDropped(t *testing.T, ruleID string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != "message_core_alerts_dropped_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if m.GetLabel()[0].GetValue() == ruleID {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestRaiseAlertsDropsWhenQueueIsFull(t *testing.T) {
+	published := make(chan kafka.Message, 10)
+	unblock := make(chan struct{})
+	h := new(CustomHook)
+	h.SetOpts(&storageLogger, nil)
+	h.alerts.publish = func(ctx context.Context, msgs ...kafka.Message) error {
+		<-unblock
+		for _, msg := range msgs {
+			published <- msg
+		}
+		return nil
+	}
+	require.NoError(t, h.Init(&Options{AlertQueueSize: 1, AlertWorkers: 1}))
+
+	cl := mqtt.New(nil).NewClient(nil, "tcp", "client-1", false)
+	pk := packets.Packet{TopicName: "device1", Payload: []byte(`{"temp": 90}`)}
+	alert := []ruleengine.Alert{{RuleID: "overheat", Topic: "alerts", Message: "too hot"}}
+	dropped := alertsDropped(t, "overheat")
+
+	// the worker blocks on the first alert and the second one fills the queue
+	h.RaiseAlerts(cl, pk, alert)
+	require.Eventually(t, func() bool { return len(h.alerts.messages) == 0 }, time.Second, time.Millisecond)
+	h.RaiseAlerts(cl, pk, alert)
+	h.RaiseAlerts(cl, pk, alert)
+	assert.Equal(t, dropped+1, alertsDropped(t, "overheat"))
+
+	close(unblock)
+	require.NoError(t, h.Stop())
+	require.Len(t, published, 2, "the queued alerts are published on stop")
+	msg := <-published
+	assert.Equal(t, "alerts", msg.Topic)
+	assert.Equal(t, []byte("client-1"), msg.Key)
+
+	h.RaiseAlerts(cl, pk, alert)
+	assert.Equal(t, dropped+2, alertsDropped(t, "overheat"), "no alert is queued once stopped")
+	require.NoError(t, h.Stop())
+}
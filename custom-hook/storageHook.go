@@ -0,0 +1,330 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding"
+	"errors"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/hooks/storage"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/mochi-co/mqtt/v2/system"
+)
+
+// default prefix of the hash sets holding the broker state
+const defaultStoragePrefix = "mqtt-"
+
+var errStorageNotOpen = errors.New("storage redis client is not set")
+
+// StorageOptions contains the configuration of the storage hook
+type StorageOptions struct {
+	// Client is the shared redis client, it is not closed by the hook
+	Client *goredis.Client
+	Prefix string
+}
+
+// StorageHook persists clients, subscriptions, retained and inflight messages
+// to redis hash sets, so they are restored when the broker restarts.
+type StorageHook struct {
+	mqtt.HookBase
+	db     *goredis.Client
+	prefix string
+	ctx    context.Context
+}
+
+func (h *StorageHook) ID() string {
+	return "redis-storage"
+}
+
+func (h *StorageHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{
+		mqtt.OnSessionEstablished,
+		mqtt.OnDisconnect,
+		mqtt.OnSubscribed,
+		mqtt.OnUnsubscribed,
+		mqtt.OnRetainMessage,
+		mqtt.OnQosPublish,
+		mqtt.OnQosComplete,
+		mqtt.OnQosDropped,
+		mqtt.OnWillSent,
+		mqtt.OnSysInfoTick,
+		mqtt.OnClientExpired,
+		mqtt.OnRetainedExpired,
+		mqtt.StoredClients,
+		mqtt.StoredInflightMessages,
+		mqtt.StoredRetainedMessages,
+		mqtt.StoredSubscriptions,
+		mqtt.StoredSysInfo,
+	}, []byte{b})
+}
+
+func (h *StorageHook) Init(config any) error {
+	opts, ok := config.(*StorageOptions)
+	if !ok || opts.Client == nil {
+		return mqtt.ErrInvalidConfigType
+	}
+
+	h.ctx = context.Background()
+	h.db = opts.Client
+	h.prefix = opts.Prefix
+	if len(h.prefix) == 0 {
+		h.prefix = defaultStoragePrefix
+	}
+
+	h.Log.Info().Str("prefix", h.prefix).Msg("initialised")
+	return nil
+}
+
+// hKey returns the hash set key of a storage type
+func (h *StorageHook) hKey(t string) string {
+	return h.prefix + t
+}
+
+func (h *StorageHook) hset(t, id string, in encoding.BinaryMarshaler) {
+	if h.db == nil {
+		h.Log.Error().Err(errStorageNotOpen).Msg("failed to hset data")
+		return
+	}
+	if err := h.db.HSet(h.ctx, h.hKey(t), id, in).Err(); err != nil {
+		h.Log.Error().Err(err).Str("type", t).Str("id", id).Msg("failed to hset data")
+	}
+}
+
+func (h *StorageHook) hdel(t, id string) {
+	if h.db == nil {
+		h.Log.Error().Err(errStorageNotOpen).Msg("failed to hdel data")
+		return
+	}
+	if err := h.db.HDel(h.ctx, h.hKey(t), id).Err(); err != nil {
+		h.Log.Error().Err(err).Str("type", t).Str("id", id).Msg("failed to hdel data")
+	}
+}
+
+// hgetall returns the stored rows of a storage type
+func (h *StorageHook) hgetall(t string) (map[string]string, error) {
+	if h.db == nil {
+		return nil, errStorageNotOpen
+	}
+	rows, err := h.db.HGetAll(h.ctx, h.hKey(t)).Result()
+	if err != nil && !errors.Is(err, goredis.Nil) {
+		h.Log.Error().Err(err).Str("type", t).Msg("failed to hgetall data")
+		return nil, err
+	}
+	return rows, nil
+}
+
+func clientKey(cl *mqtt.Client) string {
+	return cl.ID
+}
+
+func subscriptionKey(cl *mqtt.Client, filter string) string {
+	return cl.ID + ":" + filter
+}
+
+func inflightKey(cl *mqtt.Client, pk packets.Packet) string {
+	return cl.ID + ":" + pk.FormatID()
+}
+
+func storageMessage(id, t string, pk packets.Packet) *storage.Message {
+	props := pk.Properties.Copy(false)
+	return &storage.Message{
+		ID:          id,
+		T:           t,
+		FixedHeader: pk.FixedHeader,
+		TopicName:   pk.TopicName,
+		Payload:     pk.Payload,
+		Created:     pk.Created,
+		Origin:      pk.Origin,
+		Properties: storage.MessageProperties{
+			PayloadFormat:          props.PayloadFormat,
+			MessageExpiryInterval:  props.MessageExpiryInterval,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			SubscriptionIdentifier: props.SubscriptionIdentifier,
+			TopicAlias:             props.TopicAlias,
+			User:                   props.User,
+		},
+	}
+}
+
+// OnSessionEstablished stores the client once its session is established
+func (h *StorageHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+// OnWillSent stores the client without its sent will message
+func (h *StorageHook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	h.updateClient(cl)
+}
+
+func (h *StorageHook) updateClient(cl *mqtt.Client) {
+	props := cl.Properties.Props.Copy(false)
+	h.hset(storage.ClientKey, clientKey(cl), &storage.Client{
+		ID:              clientKey(cl),
+		T:               storage.ClientKey,
+		Remote:          cl.Net.Remote,
+		Listener:        cl.Net.Listener,
+		Username:        cl.Properties.Username,
+		Clean:           cl.Properties.Clean,
+		ProtocolVersion: cl.Properties.ProtocolVersion,
+		Properties: storage.ClientProperties{
+			SessionExpiryInterval: props.SessionExpiryInterval,
+			AuthenticationMethod:  props.AuthenticationMethod,
+			AuthenticationData:    props.AuthenticationData,
+			RequestProblemInfo:    props.RequestProblemInfo,
+			RequestResponseInfo:   props.RequestResponseInfo,
+			ReceiveMaximum:        props.ReceiveMaximum,
+			TopicAliasMaximum:     props.TopicAliasMaximum,
+			User:                  props.User,
+			MaximumPacketSize:     props.MaximumPacketSize,
+		},
+		Will: storage.ClientWill(cl.Properties.Will),
+	})
+}
+
+// OnDisconnect removes the client when its session expires
+func (h *StorageHook) OnDisconnect(cl *mqtt.Client, _ error, expire bool) {
+	if !expire || cl.StopCause() == packets.ErrSessionTakenOver {
+		return
+	}
+	h.hdel(storage.ClientKey, clientKey(cl))
+}
+
+// OnSubscribed stores the client subscriptions
+func (h *StorageHook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	for i, filter := range pk.Filters {
+		h.hset(storage.SubscriptionKey, subscriptionKey(cl, filter.Filter), &storage.Subscription{
+			ID:                subscriptionKey(cl, filter.Filter),
+			T:                 storage.SubscriptionKey,
+			Client:            cl.ID,
+			Qos:               reasonCodes[i],
+			Filter:            filter.Filter,
+			Identifier:        filter.Identifier,
+			NoLocal:           filter.NoLocal,
+			RetainHandling:    filter.RetainHandling,
+			RetainAsPublished: filter.RetainAsPublished,
+		})
+	}
+}
+
+// OnUnsubscribed removes the client subscriptions
+func (h *StorageHook) OnUnsubscribed(cl *mqtt.Client, pk packets.Packet) {
+	for _, filter := range pk.Filters {
+		h.hdel(storage.SubscriptionKey, subscriptionKey(cl, filter.Filter))
+	}
+}
+
+// OnRetainMessage stores the retained message of a topic, or removes it when cleared
+func (h *StorageHook) OnRetainMessage(cl *mqtt.Client, pk packets.Packet, r int64) {
+	if r == -1 {
+		h.hdel(storage.RetainedKey, pk.TopicName)
+		return
+	}
+	h.hset(storage.RetainedKey, pk.TopicName, storageMessage(pk.TopicName, storage.RetainedKey, pk))
+}
+
+// OnRetainedExpired removes an expired retained message
+func (h *StorageHook) OnRetainedExpired(filter string) {
+	h.hdel(storage.RetainedKey, filter)
+}
+
+// OnQosPublish stores an inflight message
+func (h *StorageHook) OnQosPublish(cl *mqtt.Client, pk packets.Packet, sent int64, resends int) {
+	in := storageMessage(inflightKey(cl, pk), storage.InflightKey, pk)
+	in.Sent = sent
+	h.hset(storage.InflightKey, inflightKey(cl, pk), in)
+}
+
+// OnQosComplete removes a resolved inflight message
+func (h *StorageHook) OnQosComplete(cl *mqtt.Client, pk packets.Packet) {
+	h.hdel(storage.InflightKey, inflightKey(cl, pk))
+}
+
+// OnQosDropped removes a dropped inflight message
+func (h *StorageHook) OnQosDropped(cl *mqtt.Client, pk packets.Packet) {
+	h.OnQosComplete(cl, pk)
+}
+
+// OnClientExpired removes an expired client
+func (h *StorageHook) OnClientExpired(cl *mqtt.Client) {
+	h.hdel(storage.ClientKey, clientKey(cl))
+}
+
+// OnSysInfoTick stores the latest system info
+func (h *StorageHook) OnSysInfoTick(sys *system.Info) {
+	h.hset(storage.SysInfoKey, storage.SysInfoKey, &storage.SystemInfo{
+		ID:   storage.SysInfoKey,
+		T:    storage.SysInfoKey,
+		Info: *sys,
+	})
+}
+
+// StoredClients returns the stored clients
+func (h *StorageHook) StoredClients() (v []storage.Client, err error) {
+	rows, err := h.hgetall(storage.ClientKey)
+	for _, row := range rows {
+		var d storage.Client
+		if err := d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error().Err(err).Str("data", row).Msg("failed to unmarshal client data")
+			continue
+		}
+		v = append(v, d)
+	}
+	return v, err
+}
+
+// StoredSubscriptions returns the stored subscriptions
+func (h *StorageHook) StoredSubscriptions() (v []storage.Subscription, err error) {
+	rows, err := h.hgetall(storage.SubscriptionKey)
+	for _, row := range rows {
+		var d storage.Subscription
+		if err := d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error().Err(err).Str("data", row).Msg("failed to unmarshal subscription data")
+			continue
+		}
+		v = append(v, d)
+	}
+	return v, err
+}
+
+// StoredRetainedMessages returns the stored retained messages
+func (h *StorageHook) StoredRetainedMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.RetainedKey)
+}
+
+// StoredInflightMessages returns the stored inflight messages
+func (h *StorageHook) StoredInflightMessages() (v []storage.Message, err error) {
+	return h.storedMessages(storage.InflightKey)
+}
+
+func (h *StorageHook) storedMessages(t string) (v []storage.Message, err error) {
+	rows, err := h.hgetall(t)
+	for _, row := range rows {
+		var d storage.Message
+		if err := d.UnmarshalBinary([]byte(row)); err != nil {
+			h.Log.Error().Err(err).Str("data", row).Msg("failed to unmarshal message data")
+			continue
+		}
+		v = append(v, d)
+	}
+	return v, err
+}
+
+// StoredSysInfo returns the stored system info
+func (h *StorageHook) StoredSysInfo() (v storage.SystemInfo, err error) {
+	if h.db == nil {
+		return v, errStorageNotOpen
+	}
+	row, err := h.db.HGet(h.ctx, h.hKey(storage.SysInfoKey), storage.SysInfoKey).Result()
+	if err != nil {
+		if errors.Is(err, goredis.Nil) {
+			return v, nil
+		}
+		return v, err
+	}
+	err = v.UnmarshalBinary([]byte(row))
+	return v, err
+}
@@ -0,0 +1,188 @@
+package hook
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var storageLogger = zerolog.New(os.Stderr).Level(zerolog.Disabled)
+
+func newStorageHook(t *testing.T) (*StorageHook, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.Close() })
+
+	h := new(StorageHook)
+	h.SetOpts(&storageLogger, nil)
+	require.NoError(t, h.Init(&StorageOptions{Client: db, Prefix: "test-"}))
+	return h, mr
+}
+
+func storageClient() *mqtt.Client {
+	return &mqtt.Client{
+		ID: "cl1",
+		Net: mqtt.ClientConnection{
+			Remote:   "127.0.0.1:1883",
+			Listener: "t1",
+		},
+		Properties: mqtt.ClientProperties{
+			Username:        []byte("user"),
+			ProtocolVersion: 5,
+		},
+	}
+}
+
+func TestStorageHookInitRequiresClient(t *testing.T) {
+	h := new(StorageHook)
+	h.SetOpts(&storageLogger, nil)
+	assert.ErrorIs(t, h.Init(nil), mqtt.ErrInvalidConfigType)
+	assert.ErrorIs(t, h.Init(&StorageOptions{}), mqtt.ErrInvalidConfigType)
+}
+
+func TestStorageHookClients(t *testing.T) {
+	h, mr := newStorageHook(t)
+	cl := storageClient()
+
+	h.OnSessionEstablished(cl, packets.Packet{})
+	assert.True(t, mr.Exists("test-CL"))
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	require.Len(t, clients, 1)
+	assert.Equal(t, "cl1", clients[0].ID)
+	assert.Equal(t, []byte("user"), clients[0].Username)
+	assert.Equal(t, "t1", clients[0].Listener)
+
+	// a disconnect keeps the session unless it expires
+	h.OnDisconnect(cl, nil, false)
+	clients, _ = h.StoredClients()
+	assert.Len(t, clients, 1)
+
+	h.OnDisconnect(cl, nil, true)
+	clients, _ = h.StoredClients()
+	assert.Empty(t, clients)
+}
+
+func TestStorageHookSubscriptions(t *testing.T) {
+	h, _ := newStorageHook(t)
+	cl := storageClient()
+	pk := packets.Packet{Filters: packets.Subscriptions{{Filter: "a/+/c"}, {Filter: "d/#"}}}
+
+	h.OnSubscribed(cl, pk, []byte{1, 0})
+	subs, err := h.StoredSubscriptions()
+	require.NoError(t, err)
+	require.Len(t, subs, 2)
+	for _, sub := range subs {
+		assert.Equal(t, "cl1", sub.Client)
+		if sub.Filter == "a/+/c" {
+			assert.Equal(t, byte(1), sub.Qos)
+		}
+	}
+
+	h.OnUnsubscribed(cl, packets.Packet{Filters: packets.Subscriptions{{Filter: "a/+/c"}}})
+	subs, _ = h.StoredSubscriptions()
+	require.Len(t, subs, 1)
+	assert.Equal(t, "d/#", subs[0].Filter)
+}
+
+func TestStorageHookRetainedMessages(t *testing.T) {
+	h, _ := newStorageHook(t)
+	cl := storageClient()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Retain: true},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		Created:     time.Now().Unix(),
+	}
+
+	h.OnRetainMessage(cl, pk, 1)
+	msgs, err := h.StoredRetainedMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "a/b/c", msgs[0].TopicName)
+	assert.Equal(t, []byte("hello"), msgs[0].Payload)
+
+	h.OnRetainMessage(cl, pk, -1)
+	msgs, _ = h.StoredRetainedMessages()
+	assert.Empty(t, msgs)
+
+	h.OnRetainMessage(cl, pk, 1)
+	h.OnRetainedExpired("a/b/c")
+	msgs, _ = h.StoredRetainedMessages()
+	assert.Empty(t, msgs)
+}
+
+func TestStorageHookInflightMessages(t *testing.T) {
+	h, _ := newStorageHook(t)
+	cl := storageClient()
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{Type: packets.Publish, Qos: 1},
+		TopicName:   "a/b/c",
+		Payload:     []byte("hello"),
+		PacketID:    7,
+	}
+
+	h.OnQosPublish(cl, pk, 100, 0)
+	msgs, err := h.StoredInflightMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "cl1:7", msgs[0].ID)
+	assert.Equal(t, int64(100), msgs[0].Sent)
+
+	h.OnQosComplete(cl, pk)
+	msgs, _ = h.StoredInflightMessages()
+	assert.Empty(t, msgs)
+
+	h.OnQosPublish(cl, pk, 100, 0)
+	h.OnQosDropped(cl, pk)
+	msgs, _ = h.StoredInflightMessages()
+	assert.Empty(t, msgs)
+}
+
+func TestStorageHookSkipsCorruptRows(t *testing.T) {
+	h, mr := newStorageHook(t)
+	mr.HSet("test-CL", "broken", "not json")
+	h.OnSessionEstablished(storageClient(), packets.Packet{})
+
+	clients, err := h.StoredClients()
+	require.NoError(t, err)
+	assert.Len(t, clients, 1)
+}
+
+func TestStorageHookRestoresOnStartup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.Close() })
+
+	newServer := func() *mqtt.Server {
+		server := mqtt.New(nil)
+		server.Log = &storageLogger
+		require.NoError(t, server.AddHook(new(StorageHook), &StorageOptions{Client: db}))
+		return server
+	}
+
+	first := newServer()
+	go first.Serve()
+	require.NoError(t, first.Publish("a/b/c", []byte("retained"), true, 0))
+	require.Eventually(t, func() bool {
+		return mr.Exists(defaultStoragePrefix + "RET")
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, first.Close())
+
+	second := newServer()
+	require.NoError(t, second.Serve())
+	defer second.Close()
+
+	retained := second.Topics.Messages("a/b/c")
+	require.Len(t, retained, 1)
+	assert.Equal(t, []byte("retained"), retained[0].Payload)
+}
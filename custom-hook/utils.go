@@ -1,7 +1,9 @@
 package hook
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
 	"strings"
 )
 
@@ -30,6 +32,33 @@ func SplitTopicACL(fullTopic string) (topic, acl string, err error) {
 	return
 }
 
+// WebsocketTopic returns the topic websocket clients subscribe to for a mqtt topic,
+// the acl suffix is removed from acl topics.
+func WebsocketTopic(fullTopic string) string {
+	topic, _, err := SplitTopicACL(fullTopic)
+	if err != nil {
+		return fullTopic
+	}
+	return topic
+}
+
+// VerifyTopicACL checks the username owns the topic and returns the topic acl
+func VerifyTopicACL(userName, topic string) (ACL string, err error) {
+	topicActual, ACL, err := SplitTopicACL(topic)
+	if err != nil {
+		return
+	}
+
+	if userName != topicActual {
+		err = fmt.Errorf("Not meet username and topic: %s <> %s",
+			userName,
+			topicActual)
+		return
+	}
+
+	return
+}
+
 func SplitTopicUserNameFromFullUsername(
 	fullUserName string,
 ) (userName, topic string, err error) {
@@ -48,3 +77,22 @@ func SplitTopicUserNameFromFullUsername(
 	}
 	return userNameExtracted[0], userNameExtracted[1], nil
 }
+
+// VerifyClientCertificate checks the common name of a verified client certificate
+// matches the username, connections without a client certificate are not checked.
+func VerifyClientCertificate(conn net.Conn, userName string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return nil
+	}
+	if commonName := chains[0][0].Subject.CommonName; commonName != userName {
+		return fmt.Errorf("Not meet username and client certificate: %s <> %s",
+			userName,
+			commonName)
+	}
+	return nil
+}
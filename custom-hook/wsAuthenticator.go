@@ -0,0 +1,32 @@
+package hook
+
+import (
+	"context"
+	"fmt"
+	"message-core/pkg/xservice/platform"
+)
+
+// WSAuthenticator authenticates websocket clients the same way as mqtt clients
+type WSAuthenticator struct{}
+
+// Authenticate validates the credentials against the platform and its cached user state
+func (a *WSAuthenticator) Authenticate(ctx context.Context, userName, password string) error {
+	return platform.ValidationUser(
+		ctx,
+		platform.GatewayValidationRequest{
+			UserName: userName,
+			Password: password,
+		})
+}
+
+// VerifyRead checks the username is allowed to subscribe to the topic
+func (a *WSAuthenticator) VerifyRead(userName, topic string) error {
+	ACL, err := VerifyTopicACL(userName, topic)
+	if err != nil {
+		return err
+	}
+	if ACL == ACLWriteonly {
+		return fmt.Errorf("Deny message subscribe because topic writeonly: %s", topic)
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package hook
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWSAuthenticatorVerifyRead(t *testing.T) {
+	a := &WSAuthenticator{}
+
+	assert.NoError(t, a.VerifyRead("device1", "device1"))
+	assert.NoError(t, a.VerifyRead("device1", "device1/private"))
+	assert.Error(t, a.VerifyRead("device1", "device1/writeonly"), "writeonly topics are not readable")
+	assert.Error(t, a.VerifyRead("device1", "device2"), "topics of other users")
+	assert.Error(t, a.VerifyRead("device1", "device1/a/b"), "invalid topic")
+}
@@ -0,0 +1,145 @@
+package downstream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	hook "message-core/custom-hook"
+	mkafka "message-core/kafka"
+	"message-core/mqtt"
+	"message-core/pkg/config"
+	"message-core/pkg/retry"
+	"message-core/pkg/tracing"
+	"message-core/websocket"
+	"strconv"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+var errMissingTopic = errors.New("missing target topic")
+
+// Processor delivers kafka command messages to mqtt and websocket clients
+type Processor struct{}
+
+// NewProcessor downstream processor constructor
+func NewProcessor() *Processor {
+	return &Processor{}
+}
+
+// InitConsumer start consuming downstream topics, it blocks until ctx is done
+func InitConsumer(ctx context.Context) {
+	kafkaCfg := config.KafkaConfig()
+	topics := kafkaCfg.GetTopicsConsume()
+	if len(topics) == 0 || len(kafkaCfg.GetBrokers()) == 0 {
+		log.Info("Kafka downstream consumer disabled, no topic or broker configured")
+		return
+	}
+
+	consumer := mkafka.NewConsumerGroup(
+		kafkaCfg.GetBrokers(),
+		kafkaCfg.GroupID,
+		log.WithField("consumer", "downstream"),
+	)
+	worker := mkafka.NewRetryWorker(NewProcessor().Handle, mkafka.NewRetryOptions())
+	consumer.ConsumeTopic(ctx, topics, kafkaCfg.PoolSize, worker)
+}
+
+// Handle delivers a single command message, malformed messages are not retried
+func (p *Processor) Handle(ctx context.Context, m kafka.Message) error {
+	// the delivery continues the trace of the message headers
+	ctx = tracing.Extract(ctx, (*tracing.KafkaHeaders)(&m.Headers))
+	ctx, span := tracing.Start(ctx, "kafka downstream", tracing.TypeMessaging)
+	defer span.End()
+	span.SetAttribute("kafka.topic", m.Topic)
+
+	cmd, err := ParseCommand(m)
+	if err != nil {
+		span.RecordError(err)
+		return retry.Permanent(err)
+	}
+	tracing.Inject(ctx, (*tracing.UserProperties)(&cmd.Properties))
+	if err := p.Deliver(cmd); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// Deliver publishes the command to the embedded broker and the websocket server
+func (p *Processor) Deliver(cmd Command) error {
+	server := mqtt.GetServer()
+	if server == nil {
+		return errors.New("mqtt server is not started")
+	}
+	// like server.Publish, with the user properties of the command
+	cl := server.NewClient(nil, "local", "inline", true)
+	if err := server.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    cmd.Qos,
+			Retain: cmd.Retain,
+		},
+		TopicName:  cmd.Topic,
+		Payload:    cmd.Payload,
+		Properties: packets.Properties{User: cmd.Properties},
+		PacketID:   uint16(cmd.Qos),
+	}); err != nil {
+		return fmt.Errorf("mqtt publish: %w", err)
+	}
+
+	// websocket clients subscribe to the topic without the acl suffix
+	websocket.GetServerConn().Publish(hook.WebsocketTopic(cmd.Topic), cmd.Payload)
+
+	return nil
+}
+
+// ParseCommand reads the target from the message headers,
+// falling back to a json envelope when no target header is set.
+func ParseCommand(m kafka.Message) (cmd Command, err error) {
+	headers := make(map[string]string, len(m.Headers))
+	for _, header := range m.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+
+	if topic := headers[HeaderTargetTopic]; len(topic) > 0 {
+		cmd = Command{Topic: topic, Payload: m.Value}
+		if qos, err := strconv.Atoi(headers[HeaderQos]); err == nil && qos >= 0 && qos <= 2 {
+			cmd.Qos = byte(qos)
+		}
+		cmd.Retain, _ = strconv.ParseBool(headers[HeaderRetain])
+		return cmd, nil
+	}
+
+	var envelope Envelope
+	if err = json.Unmarshal(m.Value, &envelope); err != nil {
+		return cmd, fmt.Errorf("invalid envelope: %w", err)
+	}
+	return envelope.Command()
+}
+
+// Command validates the envelope and returns its command
+func (e Envelope) Command() (cmd Command, err error) {
+	if len(e.Topic) == 0 {
+		return cmd, errMissingTopic
+	}
+	if e.Qos > 2 {
+		return cmd, fmt.Errorf("invalid qos: %d", e.Qos)
+	}
+
+	cmd = Command{
+		Topic:   e.Topic,
+		Payload: e.Message,
+		Qos:     e.Qos,
+		Retain:  e.Retain,
+	}
+	// deliver string messages without the json quotes
+	var text string
+	if err := json.Unmarshal(e.Message, &text); err == nil {
+		cmd.Payload = []byte(text)
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,125 @@
+package downstream
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []kafka.Header
+		value   string
+		cmd     Command
+		err     bool
+	}{
+		{
+			name: "target headers",
+			headers: []kafka.Header{
+				{Key: HeaderTargetTopic, Value: []byte("device1/private")},
+				{Key: HeaderQos, Value: []byte("1")},
+				{Key: HeaderRetain, Value: []byte("true")},
+			},
+			value: `{"topic":"ignored","message":"reboot"}`,
+			cmd:   Command{Topic: "device1/private", Payload: []byte(`{"topic":"ignored","message":"reboot"}`), Qos: 1, Retain: true},
+		},
+		{
+			name: "bad qos header ignored",
+			headers: []kafka.Header{
+				{Key: HeaderTargetTopic, Value: []byte("device1")},
+				{Key: HeaderQos, Value: []byte("high")},
+				{Key: HeaderRetain, Value: []byte("maybe")},
+			},
+			value: "reboot",
+			cmd:   Command{Topic: "device1", Payload: []byte("reboot")},
+		},
+		{
+			name: "qos header above 2 ignored",
+			headers: []kafka.Header{
+				{Key: HeaderTargetTopic, Value: []byte("device1")},
+				{Key: HeaderQos, Value: []byte("3")},
+			},
+			value: "reboot",
+			cmd:   Command{Topic: "device1", Payload: []byte("reboot")},
+		},
+		{
+			name:    "envelope without target header",
+			headers: []kafka.Header{{Key: HeaderTargetTopic, Value: []byte("")}},
+			value:   `{"topic":"device1","message":{"cmd":"reboot"},"qos":2,"retain":true}`,
+			cmd:     Command{Topic: "device1", Payload: []byte(`{"cmd":"reboot"}`), Qos: 2, Retain: true},
+		},
+		{
+			name:  "envelope string message unquoted",
+			value: `{"topic":"device1","message":"reboot \"now\""}`,
+			cmd:   Command{Topic: "device1", Payload: []byte(`reboot "now"`)},
+		},
+		{
+			name:  "invalid envelope",
+			value: "reboot",
+			err:   true,
+		},
+		{
+			name:  "envelope qos above 2",
+			value: `{"topic":"device1","message":"reboot","qos":3}`,
+			err:   true,
+		},
+		{
+			name:  "envelope without topic",
+			value: `{"message":"reboot"}`,
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := ParseCommand(kafka.Message{Headers: tt.headers, Value: []byte(tt.value)})
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.cmd, cmd)
+		})
+	}
+}
+
+func TestEnvelopeCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope Envelope
+		payload  string
+		err      error
+	}{
+		{name: "json message", envelope: Envelope{Topic: "device1", Message: json.RawMessage(`{"cmd":"reboot"}`)}, payload: `{"cmd":"reboot"}`},
+		{name: "string message", envelope: Envelope{Topic: "device1", Message: json.RawMessage(`"reboot"`)}, payload: "reboot"},
+		{name: "number message", envelope: Envelope{Topic: "device1", Message: json.RawMessage(`42`)}, payload: "42"},
+		{name: "empty message", envelope: Envelope{Topic: "device1"}, payload: ""},
+		{name: "missing topic", envelope: Envelope{Message: json.RawMessage(`"reboot"`)}, err: errMissingTopic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, err := tt.envelope.Command()
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.envelope.Topic, cmd.Topic)
+			assert.Equal(t, tt.payload, string(cmd.Payload))
+		})
+	}
+
+	for _, qos := range []byte{0, 1, 2} {
+		cmd, err := Envelope{Topic: "device1", Qos: qos, Retain: true}.Command()
+		require.NoError(t, err)
+		assert.Equal(t, qos, cmd.Qos)
+		assert.True(t, cmd.Retain)
+	}
+	_, err := Envelope{Topic: "device1", Qos: 3}.Command()
+	assert.EqualError(t, err, "invalid qos: 3")
+}
@@ -0,0 +1,32 @@
+package downstream
+
+import (
+	"encoding/json"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+// headers naming the delivery target of a kafka command message
+const (
+	HeaderTargetTopic = "target_topic"
+	HeaderQos         = "qos"
+	HeaderRetain      = "retain"
+)
+
+// Envelope is the json body of a command message without target headers
+type Envelope struct {
+	Topic   string          `json:"topic"`
+	Message json.RawMessage `json:"message"`
+	Qos     byte            `json:"qos"`
+	Retain  bool            `json:"retain"`
+}
+
+// Command is a message ready to be delivered to devices
+type Command struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+	// Properties are the user properties delivered to MQTTv5 subscribers, such as the trace context
+	Properties []packets.UserProperty
+}
@@ -0,0 +1,242 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"message-core/pkg/config"
+	"message-core/pkg/retry"
+	"message-core/pkg/xtopic"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// headers attached to every message forwarded from the mqtt broker
+const (
+	HeaderMQTTTopic    = "mqtt_topic"
+	HeaderMQTTQos      = "mqtt_qos"
+	HeaderMQTTRetain   = "mqtt_retain"
+	HeaderMQTTClientID = "mqtt_client_id"
+	HeaderMQTTUsername = "mqtt_username"
+)
+
+// TopicMapping maps an mqtt topic filter to a kafka topic
+type TopicMapping struct {
+	Filter string
+	Topic  string
+}
+
+// BridgeMessage is an accepted mqtt publish waiting to be forwarded to kafka
+type BridgeMessage struct {
+	Topic    string
+	Payload  []byte
+	Qos      byte
+	Retain   bool
+	ClientID string
+	Username string
+	// Headers are added to the mqtt headers, such as the trace context
+	Headers []kafka.Header
+}
+
+// Bridge forwards mqtt publishes to kafka topics according to its mappings
+type Bridge struct {
+	mappings []TopicMapping
+	queue    chan kafka.Message
+	done     chan struct{}
+	publish  func(ctx context.Context, msgs ...kafka.Message) error
+	// retry is the policy of a batch kafka rejects before it is dropped
+	retry retry.Policy
+	// mu guards closed and started, the queue is closed once
+	mu      sync.RWMutex
+	closed  bool
+	started bool
+}
+
+var bridgeSingleton *Bridge
+
+// ParseTopicMapping parses mappings in the form "filter=topic,filter=topic".
+// Mappings are matched in the given order, the first matching filter wins.
+func ParseTopicMapping(raw string) (mappings []TopicMapping, err error) {
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("Invalid topic mapping: %s", item)
+		}
+		mappings = append(mappings, TopicMapping{
+			Filter: strings.TrimSpace(parts[0]),
+			Topic:  strings.TrimSpace(parts[1]),
+		})
+	}
+	return
+}
+
+// NewBridge create new bridge with given mappings and queue size
+func NewBridge(mappings []TopicMapping, queueSize int) *Bridge {
+	return &Bridge{
+		mappings: mappings,
+		queue:    make(chan kafka.Message, queueSize),
+		done:     make(chan struct{}),
+		publish:  PublishMessage,
+		retry: retry.Policy{
+			Attempts:  bridgeRetryAttempts,
+			BaseDelay: bridgeRetryBaseDelay,
+			MaxDelay:  bridgeRetryMaxDelay,
+		},
+	}
+}
+
+// InitBridge create the bridge from config and start forwarding,
+// the bridge stays disabled when no mapping is configured.
+func InitBridge() {
+	kafkaCfg := config.KafkaConfig()
+	mappings, err := ParseTopicMapping(kafkaCfg.BridgeTopicMapping)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to parse kafka bridge topic mapping.")
+	}
+	if len(mappings) == 0 {
+		log.Info("Kafka bridge disabled, no topic mapping configured")
+		return
+	}
+
+	bridgeSingleton = NewBridge(mappings, kafkaCfg.BridgeQueueSize)
+	bridgeSingleton.Start(context.Background())
+	log.WithField("KAFKA BRIDGE TOPIC MAPPING: ", mappings).Info("Kafka bridge started")
+}
+
+// GetBridge returns nil when the bridge is disabled
+func GetBridge() *Bridge {
+	return bridgeSingleton
+}
+
+// KafkaTopic returns the kafka topic mapped to the mqtt topic
+func (b *Bridge) KafkaTopic(mqttTopic string) (string, bool) {
+	for _, mapping := range b.mappings {
+		if xtopic.Match(mapping.Filter, mqttTopic) {
+			return mapping.Topic, true
+		}
+	}
+	return "", false
+}
+
+// Forward queues the message for kafka without blocking the broker,
+// it returns false when the topic is not mapped, the queue is full or the bridge is closed.
+func (b *Bridge) Forward(msg BridgeMessage) bool {
+	topic, ok := b.KafkaTopic(msg.Topic)
+	if !ok {
+		return false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return false
+	}
+
+	key := msg.Username
+	if len(key) == 0 {
+		key = msg.ClientID
+	}
+
+	select {
+	case b.queue <- kafka.Message{
+		Topic: topic,
+		Key:   []byte(key),
+		Value: msg.Payload,
+		Headers: append([]kafka.Header{
+			{Key: HeaderMQTTTopic, Value: []byte(msg.Topic)},
+			{Key: HeaderMQTTQos, Value: []byte(strconv.Itoa(int(msg.Qos)))},
+			{Key: HeaderMQTTRetain, Value: []byte(strconv.FormatBool(msg.Retain))},
+			{Key: HeaderMQTTClientID, Value: []byte(msg.ClientID)},
+			{Key: HeaderMQTTUsername, Value: []byte(msg.Username)},
+		}, msg.Headers...),
+	}:
+		return true
+	default:
+		log.WithField("KAFKA_BRIDGE_QUEUE_FULL", msg.Topic).Warn("Drop message forwarded to kafka")
+		return false
+	}
+}
+
+// Start runs the bridge in the background, a Close following Start waits for the flush
+func (b *Bridge) Start(ctx context.Context) {
+	b.setStarted()
+	go b.Run(ctx)
+}
+
+// Run writes queued messages to kafka in batches until the bridge is closed or ctx is done
+func (b *Bridge) Run(ctx context.Context) {
+	b.setStarted()
+	defer close(b.done)
+
+	for {
+		select {
+		case msg, ok := <-b.queue:
+			if !ok {
+				return
+			}
+			b.write(ctx, b.collect(msg))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *Bridge) setStarted() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.started = true
+}
+
+// Close stops accepting messages and waits until the queue is flushed,
+// it does not wait when Run was never started.
+func (b *Bridge) Close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	started := b.started
+	b.mu.Unlock()
+
+	if started {
+		<-b.done
+	}
+}
+
+// collect drains the messages already queued behind first into one batch
+func (b *Bridge) collect(first kafka.Message) []kafka.Message {
+	batch := []kafka.Message{first}
+	for len(batch) < bridgeBatchSize {
+		select {
+		case msg, ok := <-b.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, msg)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// write publishes the batch, retried with backoff before it is dropped
+func (b *Bridge) write(ctx context.Context, batch []kafka.Message) {
+	attempts, err := retry.Do(ctx, b.retry, func(ctx context.Context) error {
+		return b.publish(ctx, batch...)
+	})
+	if err != nil {
+		log.WithField("KAFKA_BRIDGE_PUBLISH_ERROR", err).
+			WithField("Messages", len(batch)).
+			WithField("Attempts", attempts).
+			WithError(err).Error("Drop messages forwarded to kafka")
+	}
+}
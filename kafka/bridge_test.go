@@ -0,0 +1,206 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTopicMapping(t *testing.T) {
+	tests := []struct {
+		raw      string
+		mappings []TopicMapping
+		err      bool
+	}{
+		{raw: ""},
+		{raw: " , "},
+		{
+			raw: "sensors/#=telemetry, +/private = private-events,",
+			mappings: []TopicMapping{
+				{Filter: "sensors/#", Topic: "telemetry"},
+				{Filter: "+/private", Topic: "private-events"},
+			},
+		},
+		{raw: "sensors/#=a=b", mappings: []TopicMapping{{Filter: "sensors/#", Topic: "a=b"}}},
+		{raw: "sensors/#", err: true},
+		{raw: "=telemetry", err: true},
+		{raw: "sensors/#=", err: true},
+	}
+
+	for _, tt := range tests {
+		mappings, err := ParseTopicMapping(tt.raw)
+		if tt.err {
+			assert.Error(t, err, tt.raw)
+			continue
+		}
+		require.NoError(t, err, tt.raw)
+		assert.Equal(t, tt.mappings, mappings, tt.raw)
+	}
+}
+
+func TestBridgeKafkaTopic(t *testing.T) {
+	b := NewBridge([]TopicMapping{
+		{Filter: "sensors/+/alerts", Topic: "alerts"},
+		{Filter: "sensors/#", Topic: "telemetry"},
+	}, 1)
+
+	topic, ok := b.KafkaTopic("sensors/device1/alerts")
+	assert.True(t, ok)
+	assert.Equal(t, "alerts", topic, "the first matching filter wins")
+
+	topic, ok = b.KafkaTopic("sensors/device1/temperature")
+	assert.True(t, ok)
+	assert.Equal(t, "telemetry", topic)
+
+	_, ok = b.KafkaTopic("device1/private")
+	assert.False(t, ok)
+}
+
+func TestBridgeForward(t *testing.T) {
+	b := NewBridge([]TopicMapping{{Filter: "sensors/#", Topic: "telemetry"}}, 2)
+
+	assert.False(t, b.Forward(BridgeMessage{Topic: "device1/private"}), "topic not mapped")
+	assert.True(t, b.Forward(BridgeMessage{
+		Topic:    "sensors/temperature",
+		Payload:  []byte("21.5"),
+		Qos:      1,
+		Retain:   true,
+		ClientID: "client-1",
+		Username: "device1",
+		Headers:  []kafka.Header{{Key: "traceparent", Value: []byte("00-1-2-01")}},
+	}))
+	assert.True(t, b.Forward(BridgeMessage{Topic: "sensors/humidity", ClientID: "client-2"}))
+	assert.False(t, b.Forward(BridgeMessage{Topic: "sensors/pressure"}), "the queue is full")
+
+	msg := <-b.queue
+	assert.Equal(t, "telemetry", msg.Topic)
+	assert.Equal(t, []byte("device1"), msg.Key, "keyed by username")
+	assert.Equal(t, []byte("21.5"), msg.Value)
+	assert.Equal(t, []kafka.Header{
+		{Key: HeaderMQTTTopic, Value: []byte("sensors/temperature")},
+		{Key: HeaderMQTTQos, Value: []byte("1")},
+		{Key: HeaderMQTTRetain, Value: []byte("true")},
+		{Key: HeaderMQTTClientID, Value: []byte("client-1")},
+		{Key: HeaderMQTTUsername, Value: []byte("device1")},
+		{Key: "traceparent", Value: []byte("00-1-2-01")},
+	}, msg.Headers)
+
+	msg = <-b.queue
+	assert.Equal(t, []byte("client-2"), msg.Key, "keyed by client id without username")
+}
+
+func TestBridgeForwardAfterClose(t *testing.T) {
+	b := NewBridge([]TopicMapping{{Filter: "#", Topic: "telemetry"}}, 10)
+	var mu sync.Mutex
+	written := 0
+	b.publish = func(ctx context.Context, msgs ...kafka.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written += len(msgs)
+		return nil
+	}
+	b.Start(context.Background())
+
+	var wg sync.WaitGroup
+	forwarded := make([]int, 4)
+	for i := range forwarded {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if b.Forward(BridgeMessage{Topic: "sensors/temperature"}) {
+					forwarded[i]++
+				}
+			}
+		}(i)
+	}
+	b.Close()
+	wg.Wait()
+
+	assert.False(t, b.Forward(BridgeMessage{Topic: "sensors/temperature"}))
+	b.Close()
+
+	total := 0
+	for _, n := range forwarded {
+		total += n
+	}
+	assert.Equal(t, total, written, "the accepted messages are flushed")
+}
+
+func TestBridgeCloseAfterContextDone(t *testing.T) {
+	b := NewBridge([]TopicMapping{{Filter: "#", Topic: "telemetry"}}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		b.Run(ctx)
+	}()
+	cancel()
+	<-stopped
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		b.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocks once Run has returned")
+	}
+	assert.False(t, b.Forward(BridgeMessage{Topic: "sensors/temperature"}))
+}
+
+func TestBridgeRetriesFailedBatches(t *testing.T) {
+	b := NewBridge([]TopicMapping{{Filter: "#", Topic: "telemetry"}}, 10)
+	b.retry.BaseDelay = time.Millisecond
+	calls := 0
+	b.publish = func(ctx context.Context, msgs ...kafka.Message) error {
+		calls++
+		if calls < 3 {
+			return errors.New("leader not available")
+		}
+		return nil
+	}
+	b.Start(context.Background())
+
+	require.True(t, b.Forward(BridgeMessage{Topic: "sensors/temperature"}))
+	b.Close()
+	assert.Equal(t, 3, calls, "published on the third attempt")
+
+	// a batch still failing once the attempts are exhausted is dropped
+	b = NewBridge([]TopicMapping{{Filter: "#", Topic: "telemetry"}}, 10)
+	b.retry.BaseDelay = time.Millisecond
+	calls = 0
+	b.publish = func(ctx context.Context, msgs ...kafka.Message) error {
+		calls++
+		return errors.New("leader not available")
+	}
+	b.Start(context.Background())
+
+	require.True(t, b.Forward(BridgeMessage{Topic: "sensors/temperature"}))
+	b.Close()
+	assert.Equal(t, bridgeRetryAttempts, calls)
+}
+
+func TestBridgeCloseWithoutRun(t *testing.T) {
+	b := NewBridge([]TopicMapping{{Filter: "#", Topic: "telemetry"}}, 1)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		b.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocks when Run was never started")
+	}
+	assert.False(t, b.Forward(BridgeMessage{Topic: "sensors/temperature"}))
+}
@@ -17,4 +17,10 @@ const (
 	writerWriteTimeout = 10 * time.Second
 	writerRequiredAcks = -1
 	writerMaxAttempts  = 3
+	writerBatchTimeout = 10 * time.Millisecond
+
+	bridgeBatchSize      = 100
+	bridgeRetryAttempts  = 5
+	bridgeRetryBaseDelay = 200 * time.Millisecond
+	bridgeRetryMaxDelay  = 5 * time.Second
 )
@@ -3,10 +3,7 @@ package kafka
 import (
 	"context"
 	"fmt"
-	"os"
-	"os/signal"
 	"sync"
-	"syscall"
 
 	"github.com/segmentio/kafka-go"
 	"github.com/segmentio/kafka-go/compress"
@@ -22,7 +19,7 @@ type MessageProcessor interface {
 type Worker func(ctx context.Context, r *kafka.Reader, wg *sync.WaitGroup, workerID int)
 
 type ConsumerGroup interface {
-	ConsumeTopic(ctx context.Context, cancel context.CancelFunc, groupID, topic string, poolSize int, worker Worker)
+	ConsumeTopic(ctx context.Context, groupTopics []string, poolSize int, worker Worker)
 	GetNewKafkaReader(kafkaURL []string, topic, groupID string) *kafka.Reader
 	GetNewKafkaWriter(topic string) *kafka.Writer
 }
@@ -73,16 +70,9 @@ func (c *consumerGroup) GetNewKafkaWriter() *kafka.Writer {
 	return w
 }
 
-// ConsumeTopic start consumer group with given worker and pool size
-func (c *consumerGroup) ConsumeTopic(groupTopics []string, poolSize int, worker Worker) {
-	ctx, cancel := signal.NotifyContext(
-		context.Background(),
-		os.Interrupt,
-		syscall.SIGTERM,
-		syscall.SIGINT,
-	)
-	defer cancel()
-
+// ConsumeTopic start consumer group with given worker and pool size,
+// it blocks until ctx is done and the workers have returned.
+func (c *consumerGroup) ConsumeTopic(ctx context.Context, groupTopics []string, poolSize int, worker Worker) {
 	r := c.GetNewKafkaReader(c.Brokers, groupTopics, c.GroupID)
 
 	defer func() {
@@ -104,6 +94,4 @@ func (c *consumerGroup) ConsumeTopic(groupTopics []string, poolSize int, worker
 		go worker(ctx, r, wg, i)
 	}
 	wg.Wait()
-
-	<-ctx.Done()
 }
@@ -0,0 +1,271 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"message-core/pkg/config"
+	"message-core/pkg/retry"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// headers attached to every message pushed to the dead letter queue
+const (
+	HeaderDLQError             = "dlq_error"
+	HeaderDLQAttempts          = "dlq_attempts"
+	HeaderDLQOriginalTopic     = "dlq_original_topic"
+	HeaderDLQOriginalPartition = "dlq_original_partition"
+	HeaderDLQOriginalOffset    = "dlq_original_offset"
+	HeaderDLQOriginalKey       = "dlq_original_key"
+
+	dlqHeaderPrefix = "dlq_"
+)
+
+// delays between the writes of a message the dlq rejected
+const (
+	dlqRetryBaseDelay = 100 * time.Millisecond
+	dlqRetryMaxDelay  = 30 * time.Second
+)
+
+// publishDLQ writes the dead lettered messages, replaced in tests
+var publishDLQ = PublishMessage
+
+// messageReader is the part of kafka.Reader used by the retry worker
+type messageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Handler processes a single kafka message
+type Handler func(ctx context.Context, m kafka.Message) error
+
+// RetryOptions configure how failed messages are retried and dead lettered
+type RetryOptions struct {
+	Attempts      uint
+	Delay         time.Duration
+	PushToDLQ     bool
+	TopicDLQ      string
+	DLQMessageKey string
+}
+
+// NewRetryOptions returns retry options read from the kafka config
+func NewRetryOptions() RetryOptions {
+	kafkaCfg := config.KafkaConfig()
+	return RetryOptions{
+		Attempts:      kafkaCfg.KafkaRetryAttempts,
+		Delay:         time.Duration(kafkaCfg.KafkaRetryDelay) * time.Millisecond,
+		PushToDLQ:     kafkaCfg.PushFailedMessageToDLQ,
+		TopicDLQ:      kafkaCfg.TopicDLQ,
+		DLQMessageKey: kafkaCfg.DLQMessageKey,
+	}
+}
+
+// NewRetryWorker wraps handler into a Worker which retries failed messages
+// and pushes them to the dlq once the attempts are exhausted.
+func NewRetryWorker(handler Handler, opts RetryOptions) Worker {
+	return func(ctx context.Context, r *kafka.Reader, wg *sync.WaitGroup, workerID int) {
+		defer wg.Done()
+		runRetryWorker(ctx, r, handler, opts, workerID)
+	}
+}
+
+// runRetryWorker commits a message once it is processed or dead lettered. A message
+// the dlq rejects is written again until ctx is done, and then left uncommitted
+// so it is fetched again instead of being lost.
+func runRetryWorker(ctx context.Context, r messageReader, handler Handler, opts RetryOptions, workerID int) {
+	for {
+		m, err := r.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.WithField("FETCH_MESSAGE_ERROR", err).WithError(err).Error()
+			}
+			return
+		}
+		LogProcessMessage(ctx, m, workerID)
+
+		attempts, err := ProcessWithRetry(ctx, handler, m, opts)
+		if err != nil {
+			log.WithField("PROCESS_MESSAGE_ERROR", err).
+				WithField("Topic", m.Topic).
+				WithField("Offset", m.Offset).
+				WithField("Attempts", attempts).
+				WithError(err).Error()
+			if ctx.Err() != nil {
+				return
+			}
+			if err := pushToDLQUntilDone(ctx, m, err, attempts, opts); err != nil {
+				return
+			}
+		}
+
+		if err := r.CommitMessages(ctx, m); err != nil {
+			log.WithField("COMMIT_MESSAGE_ERROR", err).WithError(err).Error()
+		}
+	}
+}
+
+// pushToDLQUntilDone writes the message to the dlq until it succeeds or ctx is done
+func pushToDLQUntilDone(ctx context.Context, m kafka.Message, reason error, attempts uint, opts RetryOptions) error {
+	policy := retry.Policy{BaseDelay: opts.Delay, MaxDelay: dlqRetryMaxDelay}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = dlqRetryBaseDelay
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := PushToDLQ(ctx, m, reason, attempts, opts)
+		if err == nil {
+			return nil
+		}
+		log.WithField("PUSH_DLQ_ERROR", err).
+			WithField("Topic", m.Topic).
+			WithField("Offset", m.Offset).
+			WithField("Attempt", attempt).
+			WithError(err).Error()
+		if err := retry.Sleep(ctx, policy.Delay(attempt)); err != nil {
+			return err
+		}
+	}
+}
+
+// ProcessWithRetry calls handler until it succeeds, returns a permanent error
+// or runs out of attempts, and reports how many attempts were made.
+func ProcessWithRetry(ctx context.Context, handler Handler, m kafka.Message, opts RetryOptions) (attempts uint, err error) {
+	maxAttempts := opts.Attempts
+	if maxAttempts == 0 {
+		maxAttempts = 1
+	}
+
+	for attempts = 1; ; attempts++ {
+		err = handler(ctx, m)
+		if err == nil {
+			return
+		}
+
+		if retry.IsPermanent(err) || attempts >= maxAttempts {
+			return
+		}
+
+		if err := retry.Sleep(ctx, opts.Delay); err != nil {
+			return attempts, err
+		}
+	}
+}
+
+// PushToDLQ publishes the original message to the dlq topic with the failure details
+func PushToDLQ(ctx context.Context, m kafka.Message, reason error, attempts uint, opts RetryOptions) error {
+	if !opts.PushToDLQ {
+		return nil
+	}
+	if len(opts.TopicDLQ) == 0 {
+		return errors.New("dlq topic is not configured")
+	}
+
+	key := m.Key
+	headers := withoutDLQHeaders(m.Headers)
+	if len(opts.DLQMessageKey) > 0 {
+		key = []byte(opts.DLQMessageKey)
+		headers = append(headers, kafka.Header{Key: HeaderDLQOriginalKey, Value: m.Key})
+	}
+
+	headers = append(headers,
+		kafka.Header{Key: HeaderDLQError, Value: []byte(reason.Error())},
+		kafka.Header{Key: HeaderDLQAttempts, Value: []byte(strconv.FormatUint(uint64(attempts), 10))},
+		kafka.Header{Key: HeaderDLQOriginalTopic, Value: []byte(m.Topic)},
+		kafka.Header{Key: HeaderDLQOriginalPartition, Value: []byte(strconv.Itoa(m.Partition))},
+		kafka.Header{Key: HeaderDLQOriginalOffset, Value: []byte(strconv.FormatInt(m.Offset, 10))},
+	)
+
+	return publishDLQ(ctx, kafka.Message{
+		Topic:   opts.TopicDLQ,
+		Key:     key,
+		Value:   m.Value,
+		Headers: headers,
+	})
+}
+
+// ReplayDLQ moves dead lettered messages back to their original topic.
+// It stops after max messages (0 means no limit) or once the dlq stays idle for idleTimeout.
+func ReplayDLQ(ctx context.Context, max int, idleTimeout time.Duration) (replayed int, err error) {
+	kafkaCfg := config.KafkaConfig()
+	if len(kafkaCfg.TopicDLQ) == 0 {
+		return 0, errors.New("dlq topic is not configured")
+	}
+
+	r := NewKafkaReader(
+		kafkaCfg.GetBrokers(),
+		kafkaCfg.TopicDLQ,
+		kafkaCfg.GroupID+"-dlq-replay",
+		kafka.LoggerFunc(log.Errorf),
+	)
+	defer func() {
+		if err := r.Close(); err != nil {
+			log.WithField("ReplayDLQ.r.Close: ", err).Warn()
+		}
+	}()
+
+	for max == 0 || replayed < max {
+		fetchCtx, cancel := context.WithTimeout(ctx, idleTimeout)
+		m, err := r.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+				return replayed, nil
+			}
+			return replayed, err
+		}
+
+		msg, err := ReplayMessage(m)
+		if err != nil {
+			return replayed, err
+		}
+		if err := PublishMessage(ctx, msg); err != nil {
+			return replayed, err
+		}
+		if err := r.CommitMessages(ctx, m); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// ReplayMessage rebuilds the original message from a dlq message
+func ReplayMessage(m kafka.Message) (kafka.Message, error) {
+	var topic string
+	key := m.Key
+	for _, header := range m.Headers {
+		switch header.Key {
+		case HeaderDLQOriginalTopic:
+			topic = string(header.Value)
+		case HeaderDLQOriginalKey:
+			key = header.Value
+		}
+	}
+	if len(topic) == 0 {
+		return kafka.Message{}, fmt.Errorf("dlq message at offset %d has no original topic", m.Offset)
+	}
+
+	return kafka.Message{
+		Topic:   topic,
+		Key:     key,
+		Value:   m.Value,
+		Headers: withoutDLQHeaders(m.Headers),
+	}, nil
+}
+
+func withoutDLQHeaders(headers []kafka.Header) []kafka.Header {
+	result := make([]kafka.Header, 0, len(headers))
+	for _, header := range headers {
+		if !strings.HasPrefix(header.Key, dlqHeaderPrefix) {
+			result = append(result, header)
+		}
+	}
+	return result
+}
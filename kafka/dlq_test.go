@@ -0,0 +1,189 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"message-core/pkg/retry"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testReader returns its messages then blocks until ctx is done
+type testReader struct {
+	mu        sync.Mutex
+	messages  []kafka.Message
+	committed []kafka.Message
+}
+
+func (r *testReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	r.mu.Lock()
+	if len(r.messages) > 0 {
+		m := r.messages[0]
+		r.messages = r.messages[1:]
+		r.mu.Unlock()
+		return m, nil
+	}
+	r.mu.Unlock()
+	<-ctx.Done()
+	return kafka.Message{}, ctx.Err()
+}
+
+func (r *testReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func (r *testReader) Committed() []kafka.Message {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]kafka.Message(nil), r.committed...)
+}
+
+// useDLQ replaces the dlq writer for the test
+func useDLQ(t *testing.T, publish func(ctx context.Context, msgs ...kafka.Message) error) {
+	previous := publishDLQ
+	publishDLQ = publish
+	t.Cleanup(func() { publishDLQ = previous })
+}
+
+func TestProcessWithRetry(t *testing.T) {
+	calls := 0
+	failing := func(ctx context.Context, m kafka.Message) error {
+		calls++
+		return errors.New("failed")
+	}
+
+	attempts, err := ProcessWithRetry(context.Background(), failing, kafka.Message{}, RetryOptions{Attempts: 3})
+	assert.Error(t, err)
+	assert.Equal(t, uint(3), attempts)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	permanent := func(ctx context.Context, m kafka.Message) error {
+		calls++
+		return retry.Permanent(errors.New("malformed"))
+	}
+	attempts, err = ProcessWithRetry(context.Background(), permanent, kafka.Message{}, RetryOptions{Attempts: 3})
+	assert.EqualError(t, err, "malformed")
+	assert.Equal(t, uint(1), attempts)
+	assert.Equal(t, 1, calls)
+}
+
+func TestProcessWithRetryStopsWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	failing := func(ctx context.Context, m kafka.Message) error {
+		cancel()
+		return errors.New("failed")
+	}
+
+	start := time.Now()
+	attempts, err := ProcessWithRetry(ctx, failing, kafka.Message{}, RetryOptions{Attempts: 3, Delay: time.Hour})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, uint(1), attempts)
+	assert.Less(t, time.Since(start), time.Minute, "the delay is interrupted")
+}
+
+func TestReplayMessage(t *testing.T) {
+	m := kafka.Message{
+		Topic: "dlq",
+		Key:   []byte("dlq-key"),
+		Value: []byte("payload"),
+		Headers: []kafka.Header{
+			{Key: "trace", Value: []byte("1")},
+			{Key: HeaderDLQError, Value: []byte("failed")},
+			{Key: HeaderDLQOriginalTopic, Value: []byte("commands")},
+			{Key: HeaderDLQOriginalKey, Value: []byte("device-1")},
+		},
+	}
+
+	msg, err := ReplayMessage(m)
+	assert.NoError(t, err)
+	assert.Equal(t, "commands", msg.Topic)
+	assert.Equal(t, []byte("device-1"), msg.Key)
+	assert.Equal(t, []kafka.Header{{Key: "trace", Value: []byte("1")}}, msg.Headers)
+
+	_, err = ReplayMessage(kafka.Message{})
+	assert.Error(t, err)
+}
+
+func TestRetryWorkerKeepsMessageWhenDLQFails(t *testing.T) {
+	var mu sync.Mutex
+	writes := 0
+	useDLQ(t, func(ctx context.Context, msgs ...kafka.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		writes++
+		return errors.New("dlq unavailable")
+	})
+
+	failing := func(ctx context.Context, m kafka.Message) error {
+		return errors.New("failed")
+	}
+	r := &testReader{messages: []kafka.Message{{Topic: "commands", Offset: 1}, {Topic: "commands", Offset: 2}}}
+	opts := RetryOptions{Attempts: 1, Delay: time.Millisecond, PushToDLQ: true, TopicDLQ: "dlq"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runRetryWorker(ctx, r, failing, opts, 0)
+	}()
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return writes >= 3
+	}, 5*time.Second, time.Millisecond, "the dlq write is retried")
+	cancel()
+	<-done
+
+	assert.Empty(t, r.Committed(), "the offset is not committed")
+	assert.Len(t, r.messages, 1, "the next messages are not processed")
+}
+
+func TestRetryWorkerCommitsDeadLetteredMessage(t *testing.T) {
+	writes := 0
+	var dead []kafka.Message
+	useDLQ(t, func(ctx context.Context, msgs ...kafka.Message) error {
+		if writes++; writes == 1 {
+			return errors.New("leader not available")
+		}
+		dead = append(dead, msgs...)
+		return nil
+	})
+
+	handler := func(ctx context.Context, m kafka.Message) error {
+		if string(m.Value) == "bad" {
+			return retry.Permanent(errors.New("malformed"))
+		}
+		return nil
+	}
+	r := &testReader{messages: []kafka.Message{
+		{Topic: "commands", Offset: 1, Value: []byte("bad")},
+		{Topic: "commands", Offset: 2, Value: []byte("good")},
+	}}
+	opts := RetryOptions{Attempts: 3, Delay: time.Millisecond, PushToDLQ: true, TopicDLQ: "dlq"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runRetryWorker(ctx, r, handler, opts, 0)
+	}()
+
+	assert.Eventually(t, func() bool { return len(r.Committed()) == 2 }, 5*time.Second, time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, 2, writes, "the failed dlq write is retried")
+	require.Len(t, dead, 1)
+	assert.Equal(t, "dlq", dead[0].Topic)
+	assert.Equal(t, []int64{1, 2}, []int64{r.Committed()[0].Offset, r.Committed()[1].Offset})
+}
@@ -31,6 +31,10 @@ func PublishMessage(ctx context.Context, msgs ...kafka.Message) error {
 	return kafkaWriterSigleton.KafkaWriter.WriteMessages(ctx, msgs...)
 }
 
+// Close flushes the pending messages and closes the writer
 func Close() error {
+	if kafkaWriterSigleton == nil {
+		return nil
+	}
 	return kafkaWriterSigleton.KafkaWriter.Close()
 }
@@ -33,6 +33,19 @@ func ConnectKafkaBrokers(ctx context.Context, cfg config.KafkaCfg) (conn *kafka.
 	return
 }
 
+// PingBrokers connects to the configured brokers and closes the connection
+func PingBrokers(ctx context.Context) error {
+	kafkaCfg := config.KafkaConfig()
+	if len(kafkaCfg.GetBrokers()) == 0 {
+		return errors.New("no kafka broker configured")
+	}
+	conn, err := ConnectKafkaBrokers(ctx, kafkaCfg)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
 func InitKafkaTopics(ctx context.Context, kafkaConn *kafka.Conn, topics ...kafka.TopicConfig) {
 
 	controller, err := kafkaConn.Controller()
@@ -16,6 +16,7 @@ func NewWriter(brokers []string, errLogger kafka.Logger) *kafka.Writer {
 		Compression:  compress.Snappy,
 		ReadTimeout:  writerReadTimeout,
 		WriteTimeout: writerWriteTimeout,
+		BatchTimeout: writerBatchTimeout,
 		Async:        false,
 	}
 	return w
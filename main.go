@@ -1,18 +1,22 @@
 package main
 
 import (
-	"log"
+	"context"
 	"message-core/kafka"
-	"message-core/mqtt"
 	"message-core/pkg/config"
-	"message-core/pkg/xservice/platform"
-	"message-core/redis"
-	"message-core/websocket"
-	"net/http"
+	"message-core/pkg/lifecycle"
+	"message-core/pkg/metrics"
+	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	cmdReplayDLQ         = "replay-dlq"
+	replayDLQIdleTimeout = 10 * time.Second
+)
+
 func main() {
 	// init configuration
 	config.InitConfig()
@@ -20,25 +24,32 @@ func main() {
 	// set configuration variables
 	config.SetConfig()
 
-	// init redis client
-	redis.InitRedisClient()
-
-	go InstanceWSserver()
-	// create new connection to services
-	platform.NewClien()
+	// replay dead lettered messages to their original topics and exit
+	if len(os.Args) > 1 && os.Args[1] == cmdReplayDLQ {
+		kafka.InitKafkaProducer()
+		ReplayDLQ()
+		return
+	}
 
-	// try to init config and kafka producer after making somethings noise
-	kafka.InitKafkaProducer()
+	// label the broker metrics with the configured topic prefixes
+	metricsCfg := config.MetricsConfig()
+	metrics.SetTopicPrefixes(metricsCfg.TopicPrefixDepth, metricsCfg.GetTopicPrefixes())
 
-	// register
-	mqtt.InstanceMQTTBroker()
+	// start the components in dependency order, stop them in reverse order on SIGINT/SIGTERM
+	manager := lifecycle.New(time.Duration(config.ServiceConfig().ShutdownTimeout) * time.Second)
+	manager.Add(Components()...)
+	if err := manager.Run(context.Background()); err != nil {
+		logrus.WithField("Error when running components", err).WithError(err).Error()
+		os.Exit(1)
+	}
 }
 
-func InstanceWSserver() {
-	http.HandleFunc("/socket", websocket.HandleWS)
+func ReplayDLQ() {
+	defer kafka.Close()
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		logrus.WithField("Error when listening websocket server", err).WithError(err).Error()
-		log.Fatal("Can't start server because websocket is not listening.")
+	replayed, err := kafka.ReplayDLQ(context.Background(), 0, replayDLQIdleTimeout)
+	if err != nil {
+		logrus.WithField("Error when replaying dlq", err).WithError(err).Error()
 	}
+	logrus.WithField("Replayed dlq messages", replayed).Info()
 }
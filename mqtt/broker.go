@@ -1,52 +1,154 @@
 package mqtt
 
 import (
-	"log"
+	"context"
+	"errors"
+	"message-core/cluster"
 	hook "message-core/custom-hook"
-	"os"
-	"os/signal"
-	"syscall"
+	"message-core/pkg/config"
+	"message-core/pkg/ratelimit"
+	"message-core/redis"
+	"message-core/websocket"
+	"sync/atomic"
+	"time"
 
 	"github.com/mochi-co/mqtt/v2"
-	"github.com/mochi-co/mqtt/v2/listeners"
 )
 
-func InstanceMQTTBroker() {
-	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sigs
-		done <- true
-	}()
+var (
+	serverSingleton *mqtt.Server
+	hookSingleton   *hook.CustomHook
+	// serving is set while the listeners accept connections
+	serving atomic.Bool
+)
+
+// GetServer returns the embedded broker, nil until InstanceMQTTBroker is called
+func GetServer() *mqtt.Server {
+	return serverSingleton
+}
 
+// InstanceMQTTBroker creates the broker and starts serving its listeners
+func InstanceMQTTBroker() error {
 	server := mqtt.New(nil)
+	serverSingleton = server
 	server.Options.Capabilities.Compatibilities.ObscureNotAuthorized = true
 	server.Options.Capabilities.Compatibilities.PassiveClientDisconnect = true
 
 	// _ = server.AddHook(new(auth.AllowHook), nil)
 
-	err := server.AddHook(new(hook.CustomHook), map[string]any{})
-	if err != nil {
-		log.Fatal(err)
+	// limit the clients before the custom hook fans their messages out
+	if rateLimitCfg := config.RateLimitConfig(); rateLimitCfg.Enabled() {
+		rateLimitHook := new(hook.RateLimitHook)
+		err := server.AddHook(rateLimitHook, newRateLimitOptions(server, rateLimitCfg))
+		if err != nil {
+			return err
+		}
+		// websocket clients connect through the same limit
+		websocket.GetServerConn().SetConnectLimiter(rateLimitHook)
 	}
 
-	ws := listeners.NewWebsocket("t1", "localhost:1883", nil)
-	err = server.AddListener(ws)
+	customHook := new(hook.CustomHook)
+	hookSingleton = customHook
+	kafkaCfg := config.KafkaConfig()
+	err := server.AddHook(customHook, &hook.Options{
+		Server:         server,
+		AlertQueueSize: kafkaCfg.AlertQueueSize,
+		AlertWorkers:   kafkaCfg.AlertWorkers,
+	})
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	// restore and persist the broker state, must be added before Serve
+	if redisCfg := config.RedisConfig(); redisCfg.MQTTStorage {
+		err = server.AddHook(new(hook.StorageHook), &hook.StorageOptions{
+			Client: redis.GetRedisClient(),
+			Prefix: redisCfg.MQTTStoragePrefix,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// route the publishes to the subscribers connected to the other instances
+	if clusterCfg := config.ClusterConfig(); clusterCfg.Enabled {
+		err = server.AddHook(new(cluster.Router), &cluster.RouterOptions{
+			Server:       server,
+			Client:       redis.GetRedisClient(),
+			NodeID:       clusterCfg.GetNodeID(),
+			Prefix:       clusterCfg.MQTTPrefix,
+			SyncInterval: time.Duration(clusterCfg.SyncInterval) * time.Second,
+			QueueSize:    clusterCfg.QueueSize,
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	// Start the server
-	go func() {
-		err := server.Serve()
+	// let websocket clients publish through the broker
+	websocket.GetServerConn().SetPublisher(newWSPublisher(server, customHook))
+
+	brokerListeners, err := NewListeners(config.MQTTConfig())
+	if err != nil {
+		return err
+	}
+	for _, l := range brokerListeners {
+		err = server.AddListener(l)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
-	}()
+	}
+
+	// restores the persisted state and starts the listeners without blocking
+	if err := server.Serve(); err != nil {
+		return err
+	}
+	serving.Store(true)
+	return nil
+}
+
+func newRateLimitOptions(server *mqtt.Server, cfg config.RateLimitCfg) *hook.RateLimitOptions {
+	return &hook.RateLimitOptions{
+		Server:  server,
+		Limiter: ratelimit.NewLimiter(redis.GetRedisClient(), cfg.Prefix),
+		Action:  cfg.Action,
+		Client: hook.RateLimits{
+			Connects: ratelimit.Limit{Rate: cfg.ClientConnectRate, Burst: cfg.ClientConnectBurst},
+			Messages: ratelimit.Limit{Rate: cfg.ClientMessageRate, Burst: cfg.ClientMessageBurst},
+			Bytes:    ratelimit.Limit{Rate: cfg.ClientByteRate, Burst: cfg.ClientByteBurst},
+		},
+		User: hook.RateLimits{
+			Connects: ratelimit.Limit{Rate: cfg.UserConnectRate, Burst: cfg.UserConnectBurst},
+			Messages: ratelimit.Limit{Rate: cfg.UserMessageRate, Burst: cfg.UserMessageBurst},
+			Bytes:    ratelimit.Limit{Rate: cfg.UserByteRate, Burst: cfg.UserByteBurst},
+		},
+	}
+}
 
-	<-done
-	server.Log.Warn().Msg("caught signal, stopping...")
-	server.Close()
-	server.Log.Info().Msg("main.go finished")
+// ConnectedAt returns when the client established its current session
+func ConnectedAt(clientID string) (time.Time, bool) {
+	if hookSingleton == nil {
+		return time.Time{}, false
+	}
+	return hookSingleton.ConnectedAt(clientID)
+}
+
+// Ready checks the broker is serving its listeners
+func Ready(ctx context.Context) error {
+	if serverSingleton == nil || !serving.Load() {
+		return errors.New("mqtt broker is not serving")
+	}
+	if serverSingleton.Listeners.Len() == 0 {
+		return errors.New("mqtt broker has no listener")
+	}
+	return nil
+}
+
+// CloseMQTTBroker stops the listeners and disconnects the clients
+func CloseMQTTBroker() error {
+	if serverSingleton == nil {
+		return nil
+	}
+	serving.Store(false)
+	return serverSingleton.Close()
 }
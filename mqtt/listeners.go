@@ -0,0 +1,83 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"message-core/pkg/config"
+	"os"
+
+	"github.com/mochi-co/mqtt/v2/listeners"
+)
+
+// ids of the broker listeners, reported as the listener of each client
+const (
+	ListenerTCP = "tcp"
+	ListenerTLS = "tls"
+	ListenerWS  = "ws"
+	ListenerWSS = "wss"
+)
+
+// NewListeners returns the listeners enabled in cfg
+func NewListeners(cfg config.MQTTCfg) (result []listeners.Listener, err error) {
+	if len(cfg.TCPAddress) > 0 {
+		result = append(result, listeners.NewTCP(ListenerTCP, cfg.TCPAddress, nil))
+	}
+	if len(cfg.WSAddress) > 0 {
+		result = append(result, listeners.NewWebsocket(ListenerWS, cfg.WSAddress, nil))
+	}
+	if len(cfg.TLSAddress) == 0 && len(cfg.WSSAddress) == 0 {
+		return result, nil
+	}
+
+	tlsConfig, err := NewTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.TLSAddress) > 0 {
+		result = append(result, listeners.NewTCP(ListenerTLS, cfg.TLSAddress, &listeners.Config{TLSConfig: tlsConfig}))
+	}
+	if len(cfg.WSSAddress) > 0 {
+		result = append(result, listeners.NewWebsocket(ListenerWSS, cfg.WSSAddress, &listeners.Config{TLSConfig: tlsConfig}))
+	}
+	return result, nil
+}
+
+// NewTLSConfig loads the broker certificate and, when configured, the CA verifying client certificates
+func NewTLSConfig(cfg config.MQTTCfg) (*tls.Config, error) {
+	if len(cfg.TLSCertFile) == 0 || len(cfg.TLSKeyFile) == 0 {
+		return nil, errors.New("tls listener requires MQTT_TLS_CERT_FILE and MQTT_TLS_KEY_FILE")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if len(cfg.TLSCAFile) > 0 {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.TLSCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if cfg.TLSClientAuth {
+		if tlsConfig.ClientCAs == nil {
+			return nil, errors.New("tls client auth requires MQTT_TLS_CA_FILE")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
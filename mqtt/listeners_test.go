@@ -0,0 +1,104 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"message-core/pkg/config"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSigned writes a self signed certificate usable as both broker certificate and CA
+func writeSelfSigned(t *testing.T) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return
+}
+
+func listenerIDs(t *testing.T, cfg config.MQTTCfg) []string {
+	result, err := NewListeners(cfg)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, l := range result {
+		ids = append(ids, l.ID())
+	}
+	return ids
+}
+
+func TestNewListeners(t *testing.T) {
+	certFile, keyFile := writeSelfSigned(t)
+
+	assert.Empty(t, listenerIDs(t, config.MQTTCfg{}))
+	assert.Equal(t, []string{ListenerTCP, ListenerWS}, listenerIDs(t, config.MQTTCfg{
+		TCPAddress: ":1883",
+		WSAddress:  ":1882",
+	}))
+	assert.Equal(t, []string{ListenerTCP, ListenerTLS, ListenerWSS}, listenerIDs(t, config.MQTTCfg{
+		TCPAddress:  ":1883",
+		TLSAddress:  ":8883",
+		WSSAddress:  ":8884",
+		TLSCertFile: certFile,
+		TLSKeyFile:  keyFile,
+	}))
+
+	_, err := NewListeners(config.MQTTCfg{TLSAddress: ":8883"})
+	assert.Error(t, err)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := writeSelfSigned(t)
+
+	tlsConfig, err := NewTLSConfig(config.MQTTCfg{TLSCertFile: certFile, TLSKeyFile: keyFile})
+	require.NoError(t, err)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+
+	tlsConfig, err = NewTLSConfig(config.MQTTCfg{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCAFile: certFile})
+	require.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, tlsConfig.ClientAuth)
+
+	tlsConfig, err = NewTLSConfig(config.MQTTCfg{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCAFile: certFile, TLSClientAuth: true})
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	_, err = NewTLSConfig(config.MQTTCfg{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientAuth: true})
+	assert.Error(t, err, "client auth without ca")
+
+	_, err = NewTLSConfig(config.MQTTCfg{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSCAFile: keyFile})
+	assert.Error(t, err, "ca without certificate")
+
+	_, err = NewTLSConfig(config.MQTTCfg{TLSCertFile: "missing.pem", TLSKeyFile: keyFile})
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"errors"
+	hook "message-core/custom-hook"
+
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+)
+
+var (
+	errInvalidTopic         = errors.New("invalid topic")
+	errPublishNotAuthorized = errors.New("not authorized to publish to topic")
+)
+
+// wsPublisher publishes websocket messages into the broker as a regular client,
+// so they go through the same acl checks and rules as mqtt publishes.
+type wsPublisher struct {
+	server *mqtt.Server
+	hook   *hook.CustomHook
+}
+
+func newWSPublisher(server *mqtt.Server, hook *hook.CustomHook) *wsPublisher {
+	return &wsPublisher{server: server, hook: hook}
+}
+
+func (p *wsPublisher) Publish(clientID, username, topic string, payload []byte) error {
+	if !mqtt.IsValidFilter(topic, true) {
+		return errInvalidTopic
+	}
+
+	// an inline client has no connection and an unlimited receive quota,
+	// resetting the flag makes the broker apply acl checks like any device.
+	cl := p.server.NewClient(nil, hook.WebsocketListener, clientID, true)
+	cl.Net.Inline = false
+	cl.Properties.Username = []byte(username)
+
+	if !p.hook.OnACLCheck(cl, topic, true) {
+		return errPublishNotAuthorized
+	}
+
+	return p.server.InjectPacket(cl, packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type: packets.Publish,
+		},
+		TopicName: topic,
+		Payload:   payload,
+	})
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"io"
+	hook "message-core/custom-hook"
+	"message-core/pkg/config"
+	"message-core/redis"
+	"net"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	"github.com/mochi-co/mqtt/v2"
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sentHook records the publishes written to the clients
+type sentHook struct {
+	mqtt.HookBase
+	sent chan packets.Packet
+}
+
+func (h *sentHook) ID() string {
+	return "sent"
+}
+
+func (h *sentHook) Provides(b byte) bool {
+	return b == mqtt.OnPacketSent
+}
+
+func (h *sentHook) OnPacketSent(cl *mqtt.Client, pk packets.Packet, b []byte) {
+	if pk.FixedHeader.Type == packets.Publish {
+		h.sent <- pk
+	}
+}
+
+// newTestBroker returns a broker with the custom hook, the rules of the
+// publishes are read from an empty cache.
+func newTestBroker(t *testing.T) (*mqtt.Server, *hook.CustomHook, *sentHook) {
+	mr := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", mr.Addr())
+	config.SetConfig()
+	redis.InitRedisClient()
+	t.Cleanup(func() { redis.Close() })
+
+	server := mqtt.New(nil)
+	*server.Log = zerolog.Nop()
+	customHook := new(hook.CustomHook)
+	require.NoError(t, server.AddHook(customHook, &hook.Options{Server: server}))
+	sent := &sentHook{sent: make(chan packets.Packet, 10)}
+	require.NoError(t, server.AddHook(sent, nil))
+	return server, customHook, sent
+}
+
+// subscribe connects a client subscribed to the filter with the qos
+func subscribe(t *testing.T, server *mqtt.Server, id, filter string, qos byte) {
+	conn, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() { remote.Close() })
+
+	cl := server.NewClient(conn, "tcp", id, false)
+	cl.Properties.ProtocolVersion = 4
+	server.Clients.Add(cl)
+	server.Topics.Subscribe(cl.ID, packets.Subscription{Filter: filter, Qos: qos})
+}
+
+func TestWSPublisherPublishesAtQos0(t *testing.T) {
+	server, customHook, sent := newTestBroker(t)
+	subscribe(t, server, "subscriber", "device1", 2)
+	p := newWSPublisher(server, customHook)
+
+	require.NoError(t, p.Publish("ws-client", "device1", "device1", []byte(`{"temp": 21}`)))
+	select {
+	case pk := <-sent.sent:
+		assert.Equal(t, "device1", pk.TopicName)
+		assert.Equal(t, `{"temp": 21}`, string(pk.Payload))
+		assert.Equal(t, byte(0), pk.FixedHeader.Qos, "websocket messages are published at qos 0")
+		assert.Equal(t, "ws-client", pk.Origin)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the subscriber did not receive the message")
+	}
+}
+
+func TestWSPublisherDenied(t *testing.T) {
+	server, customHook, sent := newTestBroker(t)
+	subscribe(t, server, "subscriber", "#", 0)
+	p := newWSPublisher(server, customHook)
+
+	tests := []struct {
+		topic string
+		err   error
+	}{
+		{topic: "device2", err: errPublishNotAuthorized},
+		{topic: "device1/private/extra", err: errPublishNotAuthorized},
+		{topic: "device1/#", err: errInvalidTopic},
+		{topic: "", err: errPublishNotAuthorized},
+	}
+	for _, tt := range tests {
+		assert.ErrorIs(t, p.Publish("ws-client", "device1", tt.topic, []byte("1")), tt.err, tt.topic)
+	}
+
+	select {
+	case pk := <-sent.sent:
+		t.Fatalf("denied message delivered on %s", pk.TopicName)
+	default:
+	}
+}
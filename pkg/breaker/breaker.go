@@ -0,0 +1,145 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned while the breaker rejects calls
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State of a breaker
+type State int
+
+const (
+	// Closed lets every call through
+	Closed State = iota
+	// Open rejects every call until the open timeout elapses
+	Open
+	// HalfOpen lets a single probe call through, its result closes or opens the breaker again
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// Config of a breaker, a zero threshold disables the breaker
+type Config struct {
+	// Threshold is the number of consecutive failures opening the breaker
+	Threshold int
+	// OpenTimeout is how long the breaker stays open before probing
+	OpenTimeout time.Duration
+}
+
+// Breaker stops calling a failing dependency after Threshold consecutive failures
+type Breaker struct {
+	cfg      Config
+	onChange func(from, to State)
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// New create new closed breaker
+func New(cfg Config) *Breaker {
+	return &Breaker{cfg: cfg, now: time.Now}
+}
+
+// OnStateChange sets the function called on each state change, it must not call the breaker
+func (b *Breaker) OnStateChange(fn func(from, to State)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.onChange = fn
+}
+
+// State returns the current state
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow returns ErrOpen when the call must not be made,
+// a call allowed by Allow must report its result with Success or Failure.
+func (b *Breaker) Allow() error {
+	if b.cfg.Threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+			return ErrOpen
+		}
+		b.setState(HalfOpen)
+		b.probing = true
+		return nil
+	case HalfOpen:
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// Success reports a successful call, it closes the breaker
+func (b *Breaker) Success() {
+	if b.cfg.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.setState(Closed)
+}
+
+// Failure reports a failed call, it opens the breaker after Threshold consecutive
+// failures or when the probe fails.
+func (b *Breaker) Failure() {
+	if b.cfg.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == HalfOpen || b.failures >= b.cfg.Threshold {
+		b.openedAt = b.now()
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
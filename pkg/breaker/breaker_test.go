@@ -0,0 +1,60 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := New(Config{Threshold: 2, OpenTimeout: time.Minute})
+	b.now = func() time.Time { return now }
+
+	var changes []string
+	b.OnStateChange(func(from, to State) {
+		changes = append(changes, from.String()+">"+to.String())
+	})
+
+	assert.NoError(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, Closed, b.State())
+	b.Success()
+	b.Failure()
+	assert.Equal(t, Closed, b.State(), "a success resets the failures")
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	// a single probe is let through after the timeout
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, HalfOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+	b.Failure()
+	assert.Equal(t, Open, b.State(), "a failed probe opens the breaker again")
+
+	now = now.Add(time.Minute)
+	assert.NoError(t, b.Allow())
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+	assert.NoError(t, b.Allow())
+
+	assert.Equal(t, []string{
+		"closed>open",
+		"open>half_open",
+		"half_open>open",
+		"open>half_open",
+		"half_open>closed",
+	}, changes)
+}
+
+func TestDisabledBreaker(t *testing.T) {
+	b := New(Config{})
+	for i := 0; i < 10; i++ {
+		b.Failure()
+	}
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, Closed, b.State())
+}
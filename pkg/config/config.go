@@ -2,14 +2,23 @@ package config
 
 import (
 	"log"
+	"os"
 	"strings"
 
 	"github.com/kelseyhightower/envconfig"
 )
 
 var (
-	kafkaConfig KafkaCfg
-	redisClient RedisClientCfg
+	kafkaConfig     KafkaCfg
+	redisClient     RedisClientCfg
+	websocketConfig WebsocketCfg
+	mqttConfig      MQTTCfg
+	serviceConfig   ServiceCfg
+	metricsConfig   MetricsCfg
+	clusterConfig   ClusterCfg
+	rateLimitConfig RateLimitCfg
+	platformConfig  PlatformCfg
+	tracingConfig   TracingCfg
 )
 
 type KafkaCfg struct {
@@ -22,16 +31,152 @@ type KafkaCfg struct {
 	// kafkaTopics...
 	TopicDLQ           string `envconfig:"KAFKA_TOPIC_DLQ"`
 	TopicBudgetProfile string `envconfig:"KAFKA_TOPIC_BUDGET_PROFILE"`
+	TopicDownstream    string `envconfig:"KAFKA_TOPIC_DOWNSTREAM"`
+	TopicAlert         string `envconfig:"KAFKA_TOPIC_ALERT"`
+	// platform cache invalidation events, disabled when empty
+	TopicPlatformInvalidation string `envconfig:"KAFKA_TOPIC_PLATFORM_INVALIDATION"`
 	// kafka retry opts...
 	KafkaRetryAttempts     uint   `envconfig:"KAFKA_RETRY_ATTEMPTS"`
 	KafkaRetryDelay        int    `envconfig:"KAFKA_RETRY_DELAYS"`
 	PushFailedMessageToDLQ bool   `envconfig:"KAFKA_PUSH_FAILED_TO_DLQ"`
 	DLQMessageKey          string `envconfig:"KAFKA_DLQ_MESSAGE_KEY"`
+	// kafka bridge opts...
+	BridgeTopicMapping string `envconfig:"KAFKA_BRIDGE_TOPIC_MAPPING"`
+	BridgeQueueSize    int    `envconfig:"KAFKA_BRIDGE_QUEUE_SIZE" default:"1000"`
+	// rule alerts waiting for the alert workers before new ones are dropped
+	AlertQueueSize int `envconfig:"KAFKA_ALERT_QUEUE_SIZE" default:"1000"`
+	AlertWorkers   int `envconfig:"KAFKA_ALERT_WORKERS" default:"4"`
 }
 
 type RedisClientCfg struct {
 	RedisURL       string `envconfig:"REDIS_URL"`
 	RedisSigleMode bool   `envconfig:"REDIS_SIGLE_MODE"`
+	// persist the mqtt broker state (clients, subscriptions, retained and inflight messages)
+	MQTTStorage       bool   `envconfig:"REDIS_MQTT_STORAGE" default:"true"`
+	MQTTStoragePrefix string `envconfig:"REDIS_MQTT_STORAGE_PREFIX" default:"mqtt-"`
+}
+
+type WebsocketCfg struct {
+	Address        string `envconfig:"WS_ADDRESS" default:":8080"`
+	AllowedOrigins string `envconfig:"WS_ALLOWED_ORIGINS"`
+	// accept the upgrade requests without origin, sent by non browser clients
+	AllowNoOrigin bool `envconfig:"WS_ALLOW_NO_ORIGIN" default:"true"`
+	AuthTimeout   int  `envconfig:"WS_AUTH_TIMEOUT" default:"10"`
+	// per client outbound queue, see websocket.SlowConsumerPolicy
+	OutboundQueueSize  int    `envconfig:"WS_OUTBOUND_QUEUE_SIZE" default:"256"`
+	SlowConsumerPolicy string `envconfig:"WS_SLOW_CONSUMER_POLICY" default:"drop_oldest"`
+}
+
+type ServiceCfg struct {
+	// admin server exposing /metrics, /healthz and /readyz
+	AdminAddress string `envconfig:"ADMIN_ADDRESS" default:":9090"`
+	// token required by the admin api, the api rejects every request when empty
+	AdminToken string `envconfig:"ADMIN_TOKEN"`
+	// seconds allowed to run the readiness checks
+	ReadinessTimeout int `envconfig:"READINESS_TIMEOUT" default:"5"`
+	// seconds allowed to drain every component on shutdown
+	ShutdownTimeout int `envconfig:"SHUTDOWN_TIMEOUT" default:"30"`
+}
+
+// PlatformCfg configures the platform client validating devices
+type PlatformCfg struct {
+	BaseURL string `envconfig:"PLATFORM_BASE_URL"`
+	// secret keying the hash of the cached credentials, shared by the instances
+	CacheKey string `envconfig:"PLATFORM_CACHE_KEY"`
+	// seconds the validated credentials and rules are cached
+	CacheTTL int `envconfig:"PLATFORM_CACHE_TTL" default:"300"`
+	// seconds the rejected credentials are cached
+	NegativeCacheTTL int `envconfig:"PLATFORM_NEGATIVE_CACHE_TTL" default:"30"`
+	// redis pub/sub channel of the cache invalidation events, disabled when empty
+	InvalidationChannel string `envconfig:"PLATFORM_INVALIDATION_CHANNEL" default:"platform-cache-invalidation"`
+	// seconds allowed to each call
+	Timeout int `envconfig:"PLATFORM_TIMEOUT" default:"5"`
+	// calls of a validation, delays in milliseconds before the first retry and between the last ones
+	RetryAttempts int `envconfig:"PLATFORM_RETRY_ATTEMPTS" default:"3"`
+	RetryDelay    int `envconfig:"PLATFORM_RETRY_DELAY" default:"200"`
+	RetryMaxDelay int `envconfig:"PLATFORM_RETRY_MAX_DELAY" default:"2000"`
+	// failed validations opening the circuit breaker, seconds before it lets a call through
+	BreakerThreshold int `envconfig:"PLATFORM_BREAKER_THRESHOLD" default:"5"`
+	BreakerTimeout   int `envconfig:"PLATFORM_BREAKER_TIMEOUT" default:"30"`
+	// fail_closed rejects the connections while the platform is unavailable,
+	// fail_open accepts the users validated within the degraded cache ttl (seconds)
+	DegradedMode     string `envconfig:"PLATFORM_DEGRADED_MODE" default:"fail_closed"`
+	DegradedCacheTTL int    `envconfig:"PLATFORM_DEGRADED_CACHE_TTL" default:"86400"`
+	// token of the instance fetching the rules of the connected users
+	ServiceToken string `envconfig:"PLATFORM_SERVICE_TOKEN"`
+}
+
+// ClusterCfg configures how the instances of a cluster share their messages
+type ClusterCfg struct {
+	Enabled bool `envconfig:"CLUSTER_ENABLED"`
+	// unique id of the instance, the hostname when empty
+	NodeID string `envconfig:"CLUSTER_NODE_ID"`
+	// redis pub/sub channel relaying websocket messages
+	WSChannel string `envconfig:"CLUSTER_WS_CHANNEL" default:"message-core-ws"`
+	// messages waiting to be relayed before new ones are dropped
+	QueueSize int `envconfig:"CLUSTER_QUEUE_SIZE" default:"1000"`
+	// prefix of the redis keys and channels routing mqtt messages between the instances
+	MQTTPrefix string `envconfig:"CLUSTER_MQTT_PREFIX" default:"message-core-mqtt"`
+	// seconds between two refreshes of the subscriptions of the instances
+	SyncInterval int `envconfig:"CLUSTER_SYNC_INTERVAL" default:"10"`
+}
+
+// RateLimitCfg configures the rate limits shared by the instances through redis,
+// rates are per second and a limit is disabled when its rate or burst is zero.
+type RateLimitCfg struct {
+	// action on a publish exceeding a limit: drop, disconnect or quota
+	Action string `envconfig:"RATE_LIMIT_ACTION" default:"drop"`
+	// prefix of the redis keys holding the token buckets
+	Prefix string `envconfig:"RATE_LIMIT_PREFIX" default:"ratelimit:"`
+	// limits of each client id
+	ClientConnectRate  float64 `envconfig:"RATE_LIMIT_CLIENT_CONNECT_RATE"`
+	ClientConnectBurst int     `envconfig:"RATE_LIMIT_CLIENT_CONNECT_BURST"`
+	ClientMessageRate  float64 `envconfig:"RATE_LIMIT_CLIENT_MESSAGE_RATE"`
+	ClientMessageBurst int     `envconfig:"RATE_LIMIT_CLIENT_MESSAGE_BURST"`
+	ClientByteRate     float64 `envconfig:"RATE_LIMIT_CLIENT_BYTE_RATE"`
+	ClientByteBurst    int     `envconfig:"RATE_LIMIT_CLIENT_BYTE_BURST"`
+	// limits of each username, shared by its clients
+	UserConnectRate  float64 `envconfig:"RATE_LIMIT_USER_CONNECT_RATE"`
+	UserConnectBurst int     `envconfig:"RATE_LIMIT_USER_CONNECT_BURST"`
+	UserMessageRate  float64 `envconfig:"RATE_LIMIT_USER_MESSAGE_RATE"`
+	UserMessageBurst int     `envconfig:"RATE_LIMIT_USER_MESSAGE_BURST"`
+	UserByteRate     float64 `envconfig:"RATE_LIMIT_USER_BYTE_RATE"`
+	UserByteBurst    int     `envconfig:"RATE_LIMIT_USER_BYTE_BURST"`
+}
+
+// Enabled reports whether any limit is set
+func (c *RateLimitCfg) Enabled() bool {
+	return c.ClientConnectRate > 0 || c.ClientMessageRate > 0 || c.ClientByteRate > 0 ||
+		c.UserConnectRate > 0 || c.UserMessageRate > 0 || c.UserByteRate > 0
+}
+
+// MetricsCfg configures the topic prefix label of the broker metrics
+type MetricsCfg struct {
+	// number of topic levels in the prefix label
+	TopicPrefixDepth int `envconfig:"METRICS_TOPIC_PREFIX_DEPTH" default:"1"`
+	// comma separated prefixes, the others are labeled "other", empty keeps every prefix
+	TopicPrefixes string `envconfig:"METRICS_TOPIC_PREFIXES"`
+}
+
+// TracingCfg selects the tracer of the publishes, the apm tracer reads the ELASTIC_APM_* variables
+type TracingCfg struct {
+	// "apm" traces with Elastic APM, empty disables tracing
+	Provider string `envconfig:"TRACING_PROVIDER"`
+}
+
+// MQTTCfg configures the broker listeners, a listener is disabled when its address is empty.
+// The TLS and WSS listeners share the same certificate.
+type MQTTCfg struct {
+	TCPAddress string `envconfig:"MQTT_TCP_ADDRESS" default:":1883"`
+	WSAddress  string `envconfig:"MQTT_WS_ADDRESS" default:":1882"`
+	TLSAddress string `envconfig:"MQTT_TLS_ADDRESS"`
+	WSSAddress string `envconfig:"MQTT_WSS_ADDRESS"`
+	// certificate of the broker, CA used to verify client certificates
+	TLSCertFile string `envconfig:"MQTT_TLS_CERT_FILE"`
+	TLSKeyFile  string `envconfig:"MQTT_TLS_KEY_FILE"`
+	TLSCAFile   string `envconfig:"MQTT_TLS_CA_FILE"`
+	// require a client certificate signed by the CA (mTLS)
+	TLSClientAuth bool `envconfig:"MQTT_TLS_CLIENT_AUTH"`
 }
 
 func (k *KafkaCfg) GetBrokers() []string {
@@ -41,16 +186,63 @@ func (k *KafkaCfg) GetBrokers() []string {
 	return strings.Split(kafkaConfig.Brokers, ",")
 }
 
+// GetTopicsConsume returns the comma separated downstream topics
 func (k *KafkaCfg) GetTopicsConsume() []string {
-	return []string{
-		k.TopicBudgetProfile,
+	topics := []string{}
+	for _, topic := range strings.Split(k.TopicDownstream, ",") {
+		if topic = strings.TrimSpace(topic); len(topic) > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// GetAllowedOrigins returns the comma separated origins, empty allows the same origin only
+func (w *WebsocketCfg) GetAllowedOrigins() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(w.AllowedOrigins, ",") {
+		if origin = strings.TrimSpace(origin); len(origin) > 0 {
+			origins = append(origins, origin)
+		}
 	}
+	return origins
+}
+
+// GetTopicPrefixes returns the comma separated topic prefixes
+func (m *MetricsCfg) GetTopicPrefixes() []string {
+	prefixes := []string{}
+	for _, prefix := range strings.Split(m.TopicPrefixes, ",") {
+		if prefix = strings.TrimSpace(prefix); len(prefix) > 0 {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// GetNodeID returns the configured node id, falling back to the hostname
+func (c *ClusterCfg) GetNodeID() string {
+	if len(c.NodeID) > 0 {
+		return c.NodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Fatalf("unable to get the hostname as cluster node id: %v", err)
+	}
+	return hostname
 }
 
 func SetConfig() {
 	configs := []interface{}{
 		&kafkaConfig,
 		&redisClient,
+		&websocketConfig,
+		&mqttConfig,
+		&serviceConfig,
+		&metricsConfig,
+		&clusterConfig,
+		&rateLimitConfig,
+		&platformConfig,
+		&tracingConfig,
 	}
 	for _, instance := range configs {
 		err := envconfig.Process("", instance)
@@ -67,3 +259,35 @@ func KafkaConfig() KafkaCfg {
 func RedisConfig() RedisClientCfg {
 	return redisClient
 }
+
+func WebsocketConfig() WebsocketCfg {
+	return websocketConfig
+}
+
+func MQTTConfig() MQTTCfg {
+	return mqttConfig
+}
+
+func ServiceConfig() ServiceCfg {
+	return serviceConfig
+}
+
+func MetricsConfig() MetricsCfg {
+	return metricsConfig
+}
+
+func ClusterConfig() ClusterCfg {
+	return clusterConfig
+}
+
+func RateLimitConfig() RateLimitCfg {
+	return rateLimitConfig
+}
+
+func PlatformConfig() PlatformCfg {
+	return platformConfig
+}
+
+func TracingConfig() TracingCfg {
+	return tracingConfig
+}
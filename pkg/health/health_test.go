@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ready(t *testing.T, c *Checker) (int, Report) {
+	rec := httptest.NewRecorder()
+	c.ReadyHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report Report
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return rec.Code, report
+}
+
+func TestReadyHandler(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Add("redis", func(ctx context.Context) error { return nil })
+
+	code, report := ready(t, c)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, Report{Status: StatusOK, Checks: map[string]string{"redis": StatusOK}}, report)
+
+	c.Add("kafka", func(ctx context.Context) error { return errors.New("no broker") })
+	code, report = ready(t, c)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusFail, report.Status)
+	assert.Equal(t, "no broker", report.Checks["kafka"])
+	assert.Equal(t, StatusOK, report.Checks["redis"])
+}
+
+func TestCheckTimeout(t *testing.T) {
+	c := NewChecker(20 * time.Millisecond)
+	c.Add("platform", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	report := c.Check(context.Background())
+	assert.Equal(t, StatusFail, report.Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Checks["platform"])
+}
+
+func TestLiveHandler(t *testing.T) {
+	c := NewChecker(time.Second)
+	c.Add("kafka", func(ctx context.Context) error { return errors.New("no broker") })
+
+	rec := httptest.NewRecorder()
+	c.LiveHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
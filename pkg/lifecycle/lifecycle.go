@@ -0,0 +1,107 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Component is a part of the service started and stopped by the Manager.
+// Start must not block, Stop must return once the component is drained or ctx is done.
+type Component struct {
+	Name  string
+	Start func(ctx context.Context) error
+	Stop  func(ctx context.Context) error
+}
+
+// Manager starts components in the order they were added and stops them in reverse order
+type Manager struct {
+	components      []Component
+	started         []Component
+	shutdownTimeout time.Duration
+}
+
+// New create new manager draining the components within shutdownTimeout
+func New(shutdownTimeout time.Duration) *Manager {
+	return &Manager{shutdownTimeout: shutdownTimeout}
+}
+
+// Add appends components started after the ones already added
+func (m *Manager) Add(components ...Component) {
+	m.components = append(m.components, components...)
+}
+
+// Start starts every component in order, the components already started
+// are stopped when one of them fails.
+func (m *Manager) Start(ctx context.Context) error {
+	for _, component := range m.components {
+		if component.Start != nil {
+			if err := component.Start(ctx); err != nil {
+				err = fmt.Errorf("start %s: %w", component.Name, err)
+				stopCtx, cancel := context.WithTimeout(context.Background(), m.shutdownTimeout)
+				defer cancel()
+				return errors.Join(err, m.Stop(stopCtx))
+			}
+		}
+		m.started = append(m.started, component)
+		log.WithField("component", component.Name).Info("Component started")
+	}
+	return nil
+}
+
+// Stop stops the started components in reverse order, a component still
+// draining when ctx is done is abandoned and the next ones are stopped.
+func (m *Manager) Stop(ctx context.Context) error {
+	var errs []error
+	for i := len(m.started) - 1; i >= 0; i-- {
+		component := m.started[i]
+		if component.Stop == nil {
+			continue
+		}
+		if err := stop(ctx, component); err != nil {
+			log.WithField("component", component.Name).WithError(err).Error("Component stop failed")
+			errs = append(errs, fmt.Errorf("stop %s: %w", component.Name, err))
+			continue
+		}
+		log.WithField("component", component.Name).Info("Component stopped")
+	}
+	m.started = nil
+	return errors.Join(errs...)
+}
+
+// Run starts the components and stops them once a SIGINT or SIGTERM is received or ctx is done
+func (m *Manager) Run(ctx context.Context) error {
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if err := m.Start(ctx); err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	log.Warn("Caught signal, stopping...")
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), m.shutdownTimeout)
+	defer stopCancel()
+	return m.Stop(stopCtx)
+}
+
+func stop(ctx context.Context, component Component) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- component.Stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,95 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func recorder(events *[]string, name string, startErr error) Component {
+	return Component{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			*events = append(*events, "start "+name)
+			return startErr
+		},
+		Stop: func(ctx context.Context) error {
+			*events = append(*events, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestManagerStartsInOrderAndStopsInReverse(t *testing.T) {
+	var events []string
+	m := New(time.Second)
+	m.Add(recorder(&events, "redis", nil), recorder(&events, "kafka", nil))
+	m.Add(recorder(&events, "mqtt", nil))
+
+	require.NoError(t, m.Start(context.Background()))
+	require.NoError(t, m.Stop(context.Background()))
+
+	assert.Equal(t, []string{
+		"start redis", "start kafka", "start mqtt",
+		"stop mqtt", "stop kafka", "stop redis",
+	}, events)
+}
+
+func TestManagerStopsStartedComponentsWhenStartFails(t *testing.T) {
+	var events []string
+	m := New(time.Second)
+	m.Add(
+		recorder(&events, "redis", nil),
+		recorder(&events, "kafka", errors.New("no broker")),
+		recorder(&events, "mqtt", nil),
+	)
+
+	err := m.Start(context.Background())
+	assert.ErrorContains(t, err, "start kafka: no broker")
+	assert.Equal(t, []string{"start redis", "start kafka", "stop redis"}, events)
+}
+
+func TestManagerStopDeadline(t *testing.T) {
+	stopped := make(chan struct{})
+	m := New(time.Second)
+	m.Add(Component{
+		Name: "redis",
+		Stop: func(ctx context.Context) error {
+			close(stopped)
+			return nil
+		},
+	}, Component{
+		Name: "stuck",
+		Stop: func(ctx context.Context) error {
+			select {}
+		},
+	})
+	require.NoError(t, m.Start(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := m.Stop(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// components after the stuck one are still stopped
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("redis was not stopped")
+	}
+}
+
+func TestManagerRunStopsWhenContextDone(t *testing.T) {
+	var events []string
+	m := New(time.Second)
+	m.Add(recorder(&events, "redis", nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, m.Run(ctx))
+	assert.Equal(t, []string{"start redis", "stop redis"}, events)
+}
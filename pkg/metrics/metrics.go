@@ -0,0 +1,243 @@
+package metrics
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "message_core"
+
+// protocols of the clients
+const (
+	ProtocolMQTT = "mqtt"
+	ProtocolWS   = "ws"
+)
+
+// reasons a message is not delivered
+const (
+	ReasonRule         = "rule"
+	ReasonSlowConsumer = "slow_consumer"
+	ReasonRateLimited  = "rate_limited"
+)
+
+// actions denied by the topic acl
+const (
+	ActionPublish   = "publish"
+	ActionSubscribe = "subscribe"
+)
+
+// prefix reported for topics outside the configured prefixes
+const OtherPrefix = "other"
+
+var (
+	connectedClients = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "connected_clients",
+			Help:      "Number of connected clients.",
+		},
+		[]string{"protocol"},
+	)
+	messagesPublished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_published_total",
+			Help:      "Messages published by clients.",
+		},
+		[]string{"protocol", "prefix"},
+	)
+	messagesDelivered = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_delivered_total",
+			Help:      "Messages delivered to subscribers.",
+		},
+		[]string{"protocol", "prefix"},
+	)
+	messagesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_dropped_total",
+			Help:      "Messages dropped before reaching a subscriber.",
+		},
+		[]string{"protocol", "prefix", "reason"},
+	)
+	ruleDrops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rule_drops_total",
+			Help:      "Messages dropped by the rule engine.",
+		},
+		[]string{"rule"},
+	)
+	aclDenials = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "acl_denials_total",
+			Help:      "Publishes and subscribes denied by the topic acl.",
+		},
+		[]string{"protocol", "action"},
+	)
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_failures_total",
+			Help:      "Connections rejected by the authentication.",
+		},
+		[]string{"protocol"},
+	)
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limited_total",
+			Help:      "Connects and publishes exceeding a rate limit.",
+		},
+		[]string{"scope", "limit", "action"},
+	)
+	fanoutDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "ws_fanout_duration_seconds",
+			Help:      "Time to fan a published message out to the websocket subscribers.",
+			Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+		},
+		[]string{"prefix"},
+	)
+	alertsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "alerts_dropped_total",
+			Help:      "Rule alerts dropped because the alert queue is full.",
+		},
+		[]string{"rule"},
+	)
+	payloadSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "message_payload_bytes",
+			Help:      "Payload size of the published messages.",
+			Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"protocol"},
+	)
+)
+
+var prefixes = struct {
+	sync.RWMutex
+	depth   int
+	allowed map[string]struct{}
+}{depth: 1}
+
+func init() {
+	prometheus.MustRegister(
+		connectedClients,
+		messagesPublished,
+		messagesDelivered,
+		messagesDropped,
+		ruleDrops,
+		aclDenials,
+		authFailures,
+		rateLimited,
+		fanoutDuration,
+		payloadSize,
+		alertsDropped,
+	)
+}
+
+// SetTopicPrefixes sets how topics are labeled: the first depth levels of the topic,
+// reported as OtherPrefix when allowed is not empty and does not contain them.
+func SetTopicPrefixes(depth int, allowed []string) {
+	prefixes.Lock()
+	defer prefixes.Unlock()
+
+	if depth <= 0 {
+		depth = 1
+	}
+	prefixes.depth = depth
+	prefixes.allowed = nil
+	if len(allowed) > 0 {
+		prefixes.allowed = make(map[string]struct{}, len(allowed))
+		for _, prefix := range allowed {
+			prefixes.allowed[prefix] = struct{}{}
+		}
+	}
+}
+
+// TopicPrefix returns the label of the topic
+func TopicPrefix(topic string) string {
+	prefixes.RLock()
+	defer prefixes.RUnlock()
+
+	levels := strings.SplitN(topic, "/", prefixes.depth+1)
+	if len(levels) > prefixes.depth {
+		levels = levels[:prefixes.depth]
+	}
+	prefix := strings.Join(levels, "/")
+
+	if prefixes.allowed != nil {
+		if _, ok := prefixes.allowed[prefix]; !ok {
+			return OtherPrefix
+		}
+	}
+	return prefix
+}
+
+// ClientConnected counts a connected client
+func ClientConnected(protocol string) {
+	connectedClients.WithLabelValues(protocol).Inc()
+}
+
+// ClientDisconnected uncounts a disconnected client
+func ClientDisconnected(protocol string) {
+	connectedClients.WithLabelValues(protocol).Dec()
+}
+
+// Published counts a message published by a client and observes its payload size
+func Published(protocol, topic string, size int) {
+	messagesPublished.WithLabelValues(protocol, TopicPrefix(topic)).Inc()
+	payloadSize.WithLabelValues(protocol).Observe(float64(size))
+}
+
+// Delivered counts a message delivered to a subscriber
+func Delivered(protocol, topic string) {
+	messagesDelivered.WithLabelValues(protocol, TopicPrefix(topic)).Inc()
+}
+
+// Dropped counts a message dropped for reason
+func Dropped(protocol, topic, reason string) {
+	messagesDropped.WithLabelValues(protocol, TopicPrefix(topic), reason).Inc()
+}
+
+// RuleDropped counts a message dropped by the rule ruleID
+func RuleDropped(protocol, topic, ruleID string) {
+	Dropped(protocol, topic, ReasonRule)
+	ruleDrops.WithLabelValues(ruleID).Inc()
+}
+
+// ACLDenied counts an action denied by the topic acl
+func ACLDenied(protocol, action string) {
+	aclDenials.WithLabelValues(protocol, action).Inc()
+}
+
+// AuthFailed counts a rejected connection
+func AuthFailed(protocol string) {
+	authFailures.WithLabelValues(protocol).Inc()
+}
+
+// RateLimited counts a connect or publish exceeding the limit of the client or user scope
+func RateLimited(scope, limit, action string) {
+	rateLimited.WithLabelValues(scope, limit, action).Inc()
+}
+
+// AlertDropped counts an alert of the rule ruleID dropped because the alert queue is full
+func AlertDropped(ruleID string) {
+	alertsDropped.WithLabelValues(ruleID).Inc()
+}
+
+// ObserveFanout observes the time since start to fan the message out to websocket subscribers
+func ObserveFanout(topic string, start time.Time) {
+	fanoutDuration.WithLabelValues(TopicPrefix(topic)).Observe(time.Since(start).Seconds())
+}
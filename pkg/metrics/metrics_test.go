@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicPrefix(t *testing.T) {
+	defer SetTopicPrefixes(1, nil)
+
+	SetTopicPrefixes(0, nil)
+	assert.Equal(t, "device1", TopicPrefix("device1/private"))
+	assert.Equal(t, "device1", TopicPrefix("device1"))
+
+	SetTopicPrefixes(2, nil)
+	assert.Equal(t, "sensors/room1", TopicPrefix("sensors/room1/temp"))
+	assert.Equal(t, "sensors", TopicPrefix("sensors"))
+
+	SetTopicPrefixes(1, []string{"sensors"})
+	assert.Equal(t, "sensors", TopicPrefix("sensors/room1"))
+	assert.Equal(t, OtherPrefix, TopicPrefix("device1/private"))
+}
+
+func TestCounters(t *testing.T) {
+	Published(ProtocolMQTT, "sensors/a", 100)
+	Published(ProtocolMQTT, "sensors/b", 100)
+	assert.Equal(t, 2.0, testutil.ToFloat64(messagesPublished.WithLabelValues(ProtocolMQTT, "sensors")))
+
+	RuleDropped(ProtocolMQTT, "sensors/a", "r1")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ruleDrops.WithLabelValues("r1")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(messagesDropped.WithLabelValues(ProtocolMQTT, "sensors", ReasonRule)))
+
+	AlertDropped("r1")
+	assert.Equal(t, 1.0, testutil.ToFloat64(alertsDropped.WithLabelValues("r1")))
+
+	ClientConnected(ProtocolWS)
+	ClientConnected(ProtocolWS)
+	ClientDisconnected(ProtocolWS)
+	assert.Equal(t, 1.0, testutil.ToFloat64(connectedClients.WithLabelValues(ProtocolWS)))
+}
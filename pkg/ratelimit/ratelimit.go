@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second up to Burst tokens
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether the limit is set, a zero rate disables the limit
+func (l Limit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// ttl is the time to refill an empty bucket, a full bucket does not need to be stored
+func (l Limit) ttl() time.Duration {
+	return time.Duration(math.Ceil(float64(l.Burst)/l.Rate*1000))*time.Millisecond + time.Second
+}
+
+// tokenBucket takes cost tokens from the bucket at KEYS[1] when it holds enough of them.
+// ARGV: rate per second, burst, cost, ttl in milliseconds. The time is read from redis,
+// the instances sharing a bucket do not depend on their clocks.
+var tokenBucket = goredis.NewScript(`
+redis.replicate_commands()
+
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+local elapsed = math.max(0, now - ts)
+tokens = math.min(burst, tokens + elapsed * rate / 1000)
+
+local allowed = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return allowed
+`)
+
+// Limiter shares token buckets between the instances through redis
+type Limiter struct {
+	db     *goredis.Client
+	prefix string
+}
+
+// NewLimiter create new limiter storing its buckets under the key prefix
+func NewLimiter(db *goredis.Client, prefix string) *Limiter {
+	return &Limiter{db: db, prefix: prefix}
+}
+
+// Allow takes cost tokens from the bucket of key and reports whether it held enough of them.
+// A cost above the burst is capped to the burst, so it passes when the bucket is full.
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit, cost int) (bool, error) {
+	if !limit.Enabled() {
+		return true, nil
+	}
+	if cost > limit.Burst {
+		cost = limit.Burst
+	}
+
+	allowed, err := tokenBucket.Run(ctx, l.db, []string{l.prefix + key},
+		limit.Rate,
+		limit.Burst,
+		cost,
+		limit.ttl().Milliseconds(),
+	).Int()
+	if err != nil {
+		return false, err
+	}
+	return allowed == 1, nil
+}
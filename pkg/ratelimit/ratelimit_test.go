@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLimiters returns two limiters sharing a redis whose time is frozen at now
+func newTestLimiters(t *testing.T, now time.Time) (*Limiter, *Limiter, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(now)
+
+	newLimiter := func() *Limiter {
+		db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { db.Close() })
+		return NewLimiter(db, "test:")
+	}
+	return newLimiter(), newLimiter(), mr
+}
+
+var testNow = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func TestAllowRefillsTokens(t *testing.T) {
+	limiter, _, mr := newTestLimiters(t, testNow)
+	ctx := context.Background()
+	limit := Limit{Rate: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		allowed, err := limiter.Allow(ctx, "client-1", limit, 1)
+		require.NoError(t, err)
+		assert.True(t, allowed, "burst %d", i)
+	}
+	allowed, err := limiter.Allow(ctx, "client-1", limit, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed, "empty bucket")
+
+	// other keys have their own bucket
+	allowed, err = limiter.Allow(ctx, "client-2", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	// the tokens are refilled by the time of redis
+	mr.SetTime(testNow.Add(500 * time.Millisecond))
+	allowed, err = limiter.Allow(ctx, "client-1", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed, "one token refilled")
+	allowed, err = limiter.Allow(ctx, "client-1", limit, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestAllowSharesBucketsBetweenInstances(t *testing.T) {
+	a, b, _ := newTestLimiters(t, testNow)
+	ctx := context.Background()
+	limit := Limit{Rate: 1, Burst: 2}
+
+	allowed, err := a.Allow(ctx, "user-1", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = b.Allow(ctx, "user-1", limit, 1)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = a.Allow(ctx, "user-1", limit, 1)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+}
+
+func TestAllowCost(t *testing.T) {
+	limiter, _, _ := newTestLimiters(t, testNow)
+	ctx := context.Background()
+	limit := Limit{Rate: 100, Burst: 1000}
+
+	allowed, err := limiter.Allow(ctx, "bytes", limit, 600)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+	allowed, err = limiter.Allow(ctx, "bytes", limit, 600)
+	require.NoError(t, err)
+	assert.False(t, allowed)
+
+	// a cost above the burst passes on a full bucket
+	allowed, err = limiter.Allow(ctx, "large", limit, 5000)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+
+	allowed, err = limiter.Allow(ctx, "disabled", Limit{}, 5000)
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
@@ -0,0 +1,105 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Policy retries a call with an exponential backoff and jitter
+type Policy struct {
+	// Attempts is the total number of calls, 1 or less calls once
+	Attempts int
+	// BaseDelay is the delay before the first retry, doubled for each next retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay, no cap when zero
+	MaxDelay time.Duration
+}
+
+// Delay returns the delay before the retry following the attempt (from 1),
+// a random delay between half and all of the exponential delay.
+func (p Policy) Delay(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error that must not be retried
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether the error must not be retried
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+// Do calls fn until it succeeds, returns a permanent error, the attempts are exhausted
+// or ctx is done. It returns the number of calls and the last error, unwrapped
+// when it is permanent.
+func Do(ctx context.Context, p Policy, fn func(ctx context.Context) error) (attempts int, err error) {
+	for {
+		attempts++
+		err = fn(ctx)
+		if err == nil {
+			return attempts, nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return attempts, permanent.err
+		}
+		if attempts >= p.Attempts {
+			return attempts, err
+		}
+		if sleepErr := Sleep(ctx, p.Delay(attempts)); sleepErr != nil {
+			return attempts, err
+		}
+	}
+}
+
+// Sleep waits for d or until ctx is done
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, expected := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		3:  400 * time.Millisecond,
+		5:  time.Second,
+		50: time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			delay := p.Delay(attempt)
+			assert.GreaterOrEqual(t, delay, expected/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, delay, expected, "attempt %d", attempt)
+		}
+	}
+	assert.Zero(t, Policy{}.Delay(3))
+}
+
+func TestDo(t *testing.T) {
+	p := Policy{Attempts: 3, BaseDelay: time.Millisecond}
+	failure := errors.New("unavailable")
+
+	calls := 0
+	attempts, err := Do(context.Background(), p, func(ctx context.Context) error {
+		calls++
+		if calls < 2 {
+			return failure
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	attempts, err = Do(context.Background(), p, func(ctx context.Context) error {
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 3, attempts)
+
+	attempts, err = Do(context.Background(), p, func(ctx context.Context) error {
+		return Permanent(failure)
+	})
+	assert.Equal(t, failure, err, "permanent errors are unwrapped")
+	assert.Equal(t, 1, attempts)
+	assert.True(t, IsPermanent(Permanent(failure)))
+	assert.False(t, IsPermanent(failure))
+}
+
+func TestDoStopsWhenContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := Policy{Attempts: 10, BaseDelay: time.Hour}
+	failure := errors.New("unavailable")
+
+	attempts, err := Do(ctx, p, func(ctx context.Context) error {
+		cancel()
+		return failure
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 1, attempts)
+}
@@ -0,0 +1,121 @@
+package ruleengine
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// now is replaced by tests
+var now = time.Now
+
+func applyAction(rule Rule, action Action, msg *Message, result *Result) error {
+	switch action.Type {
+	case ActionDrop:
+		result.Dropped = true
+		result.DroppedBy = rule.ID
+	case ActionRename:
+		value, found := Lookup(msg.Payload, action.Path)
+		if !found {
+			return nil
+		}
+		Delete(msg.Payload, action.Path)
+		if err := Set(msg.Payload, action.To, value); err != nil {
+			return err
+		}
+		result.Modified = true
+	case ActionRemove:
+		if Delete(msg.Payload, action.Path) {
+			result.Modified = true
+		}
+	case ActionSet:
+		value, err := actionValue(action, msg)
+		if err != nil {
+			return err
+		}
+		if err := Set(msg.Payload, action.Path, value); err != nil {
+			return err
+		}
+		result.Modified = true
+	case ActionRewriteTopic:
+		if len(action.Topic) == 0 {
+			return fmt.Errorf("%s without topic", action.Type)
+		}
+		msg.Topic = action.Topic
+	case ActionCopy:
+		if len(action.Topic) == 0 {
+			return fmt.Errorf("%s without topic", action.Type)
+		}
+		result.Copies = append(result.Copies, action.Topic)
+	case ActionAlert:
+		result.Alerts = append(result.Alerts, Alert{
+			RuleID:  rule.ID,
+			Topic:   action.Topic,
+			Message: action.Message,
+		})
+	default:
+		return fmt.Errorf("unknown action %s", action.Type)
+	}
+	return nil
+}
+
+// actionValue returns the static value of a set action or computes it from its source
+func actionValue(action Action, msg *Message) (interface{}, error) {
+	switch action.Source {
+	case "":
+		return action.Value, nil
+	case SourceTimestamp:
+		return now().Unix(), nil
+	case SourceUsername:
+		return msg.Username, nil
+	case SourceClientID:
+		return msg.ClientID, nil
+	case SourceTopic:
+		return msg.Topic, nil
+	}
+	return nil, fmt.Errorf("unknown source %s", action.Source)
+}
+
+// Set stores value at a dotted path, creating the missing objects on the way
+func Set(payload map[string]interface{}, path string, value interface{}) error {
+	if len(path) == 0 {
+		return fmt.Errorf("empty path")
+	}
+
+	keys := strings.Split(path, pathSeparator)
+	node := payload
+	for _, key := range keys[:len(keys)-1] {
+		child, exist := node[key]
+		if !exist {
+			child = make(map[string]interface{})
+			node[key] = child
+		}
+		next, ok := child.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("can not set %s, %s is not an object", path, key)
+		}
+		node = next
+	}
+	node[keys[len(keys)-1]] = value
+	return nil
+}
+
+// Delete removes the attribute at a dotted path and reports whether it existed
+func Delete(payload map[string]interface{}, path string) bool {
+	keys := strings.Split(path, pathSeparator)
+	node := payload
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := node[key].(map[string]interface{})
+		if !ok {
+			return false
+		}
+		node = next
+	}
+
+	last := keys[len(keys)-1]
+	if _, exist := node[last]; !exist {
+		return false
+	}
+	delete(node, last)
+	return true
+}
@@ -0,0 +1,136 @@
+package ruleengine
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const pathSeparator = "."
+
+// Apply runs the actions of the rules matching the message by descending priority.
+// Actions change the message in place, so later rules see the changes,
+// and it stops at the first rule dropping the message. A condition failing to evaluate,
+// such as a mistyped value, does not match and its error is reported in the result.
+func Apply(rules []Rule, msg *Message) (result Result, err error) {
+	for _, rule := range SortByPriority(rules) {
+		matched, err := EvaluateGroup(rule.Match, msg.Payload)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Errorf("rule %s: %w", rule.ID, err))
+		}
+		if !matched {
+			continue
+		}
+
+		for _, action := range rule.Actions {
+			if err := applyAction(rule, action, msg, &result); err != nil {
+				return result, fmt.Errorf("rule %s: %w", rule.ID, err)
+			}
+			if result.Dropped {
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// SortByPriority returns a copy of rules ordered by descending priority,
+// rules with the same priority keep their order.
+func SortByPriority(rules []Rule) []Rule {
+	sorted := make([]Rule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+// EvaluateGroup evaluates the group against the payload, an empty group always holds.
+// The conditions failing to evaluate do not match, their errors are returned with the
+// result of the group. A group with an unknown logic does not match.
+func EvaluateGroup(group Group, payload map[string]interface{}) (bool, error) {
+	or := strings.EqualFold(group.Logic, LogicOr)
+	if !or && len(group.Logic) > 0 && !strings.EqualFold(group.Logic, LogicAnd) {
+		return false, fmt.Errorf("unknown logic %s", group.Logic)
+	}
+	matched, err := evaluateGroup(group, or, payload)
+	return matched != group.Not, err
+}
+
+func evaluateGroup(group Group, or bool, payload map[string]interface{}) (bool, error) {
+	if len(group.Conditions) == 0 && len(group.Groups) == 0 {
+		return true, nil
+	}
+
+	var errs []error
+	for _, condition := range group.Conditions {
+		matched, err := EvaluateCondition(condition, payload)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", condition.Path, err))
+			matched = false
+		}
+		if matched == or {
+			// short circuit: first true for OR, first false for AND
+			return or, errors.Join(errs...)
+		}
+	}
+	for _, sub := range group.Groups {
+		matched, err := EvaluateGroup(sub, payload)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if matched == or {
+			return or, errors.Join(errs...)
+		}
+	}
+	return !or, errors.Join(errs...)
+}
+
+// EvaluateCondition looks up the condition path and applies its operator
+func EvaluateCondition(condition Condition, payload map[string]interface{}) (bool, error) {
+	op, ok := GetOperator(condition.Operator)
+	if !ok {
+		return false, fmt.Errorf("unknown operator %s", condition.Operator)
+	}
+
+	var (
+		value interface{}
+		found bool
+	)
+	if condition.Literal {
+		value, found = payload[condition.Path]
+	} else {
+		value, found = Lookup(payload, condition.Path)
+	}
+	if !found {
+		return condition.IgnoreMissing, nil
+	}
+
+	return op.Evaluate(value, condition.Value)
+}
+
+// Lookup resolves a dotted path in a json payload, list elements are addressed by index
+func Lookup(payload map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = payload
+	for _, key := range strings.Split(path, pathSeparator) {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, exist := node[key]
+			if !exist {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
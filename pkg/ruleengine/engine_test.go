@@ -0,0 +1,163 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func payload(t *testing.T, raw string) map[string]interface{} {
+	data := make(map[string]interface{})
+	require.NoError(t, json.Unmarshal([]byte(raw), &data))
+	return data
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	data := payload(t, `{
+		"name": "sensor-12",
+		"online": true,
+		"sensor": {"temp": 21.5, "tags": ["indoor", "floor1"]},
+		"values": [1, 2, 3]
+	}`)
+
+	cases := []struct {
+		condition Condition
+		matched   bool
+	}{
+		{Condition{Path: "name", Operator: OperatorEqual, Value: "sensor-12"}, true},
+		{Condition{Path: "online", Operator: OperatorEqual, Value: true}, true},
+		{Condition{Path: "online", Operator: OperatorNotEqual, Value: false}, true},
+		{Condition{Path: "sensor.temp", Operator: OperatorGreaterThan, Value: 20.0}, true},
+		{Condition{Path: "sensor.temp", Operator: OperatorLessOrEqual, Value: 21.5}, true},
+		{Condition{Path: "sensor.temp", Operator: OperatorRange, Value: []interface{}{18.0, 20.0}}, false},
+		{Condition{Path: "values.1", Operator: OperatorIn, Value: []interface{}{2.0, 4.0}}, true},
+		{Condition{Path: "name", Operator: OperatorNotIn, Value: []interface{}{"a", "b"}}, true},
+		{Condition{Path: "sensor.tags", Operator: OperatorContains, Value: "indoor"}, true},
+		{Condition{Path: "name", Operator: OperatorContains, Value: "sensor"}, true},
+		{Condition{Path: "name", Operator: OperatorRegex, Value: `^sensor-\d+$`}, true},
+		{Condition{Path: "sensor.humidity", Operator: OperatorExists}, false},
+		{Condition{Path: "sensor.humidity", Operator: OperatorEqual, IgnoreMissing: true}, true},
+		{Condition{Path: "sensor.temp", Operator: OperatorEqual, Value: 21.5, Literal: true}, false},
+	}
+	for _, c := range cases {
+		matched, err := EvaluateCondition(c.condition, data)
+		assert.NoError(t, err, c.condition)
+		assert.Equal(t, c.matched, matched, c.condition)
+	}
+
+	_, err := EvaluateCondition(Condition{Path: "name", Operator: "unknown"}, data)
+	assert.Error(t, err)
+}
+
+func TestApplyGroupsAndPriority(t *testing.T) {
+	data := payload(t, `{"temp": 40, "mode": "auto"}`)
+	hot := Group{
+		Logic: LogicOr,
+		Conditions: []Condition{
+			{Path: "temp", Operator: OperatorGreaterThan, Value: 35.0},
+			{Path: "mode", Operator: OperatorEqual, Value: "off"},
+		},
+	}
+	rules := []Rule{
+		{ID: "low", Priority: 1, Match: hot, Actions: []Action{{Type: ActionDrop}}},
+		{ID: "high", Priority: 10, Match: Group{
+			Logic:      LogicAnd,
+			Conditions: []Condition{{Path: "mode", Operator: OperatorEqual, Value: "auto"}},
+			Groups:     []Group{hot},
+		}, Actions: []Action{{Type: ActionDrop}}},
+	}
+
+	result, err := Apply(rules, &Message{Payload: data})
+	assert.NoError(t, err)
+	assert.Equal(t, Result{Dropped: true, DroppedBy: "high"}, result)
+
+	result, err = Apply(rules, &Message{Payload: payload(t, `{"temp": 20, "mode": "auto"}`)})
+	assert.NoError(t, err)
+	assert.False(t, result.Dropped)
+}
+
+func TestApplyMistypedValue(t *testing.T) {
+	rules := []Rule{
+		{ID: "hot", Priority: 10, Match: Group{Conditions: []Condition{
+			{Path: "temp", Operator: OperatorGreaterThan, Value: 35.0},
+		}}, Actions: []Action{{Type: ActionSet, Path: "hot", Value: true}}},
+		{ID: "not-cold", Priority: 5, Match: Group{Not: true, Conditions: []Condition{
+			{Path: "temp", Operator: OperatorLessThan, Value: 0.0},
+		}}, Actions: []Action{{Type: ActionSet, Path: "checked", Value: true}}},
+		{ID: "offline", Priority: 1, Match: Group{Logic: LogicOr, Conditions: []Condition{
+			{Path: "temp", Operator: OperatorRange, Value: []interface{}{0.0, 10.0}},
+			{Path: "status", Operator: OperatorEqual, Value: "offline"},
+		}}, Actions: []Action{{Type: ActionDrop}}},
+	}
+
+	// a string temp neither matches the typed conditions nor skips the drop rule
+	msg := &Message{Payload: payload(t, `{"temp": "hot", "status": "offline"}`)}
+	result, err := Apply(rules, msg)
+	require.NoError(t, err)
+	assert.True(t, result.Dropped)
+	assert.Equal(t, "offline", result.DroppedBy)
+	assert.NotContains(t, msg.Payload, "hot", "the mistyped condition does not match")
+	assert.Equal(t, true, msg.Payload["checked"], "the negated group of a mistyped condition matches")
+	require.Len(t, result.Errors, 3)
+	assert.Contains(t, result.Errors[0].Error(), "rule hot: temp:")
+
+	matched, err := EvaluateGroup(Group{Logic: "xor"}, msg.Payload)
+	assert.Error(t, err)
+	assert.False(t, matched, "unknown logic does not match")
+}
+
+func TestRegisterOperator(t *testing.T) {
+	RegisterOperator(NewOperator("even", func(v, r interface{}) (bool, error) {
+		n, ok := v.(float64)
+		return ok && int(n)%2 == 0, nil
+	}))
+
+	matched, err := EvaluateCondition(Condition{Path: "n", Operator: "even"}, payload(t, `{"n": 4}`))
+	assert.NoError(t, err)
+	assert.True(t, matched)
+}
+
+func TestApplyActions(t *testing.T) {
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+	defer func() { now = time.Now }()
+
+	rules := []Rule{
+		{ID: "transform", Priority: 2, Actions: []Action{
+			{Type: ActionRename, Path: "t", To: "sensor.temp"},
+			{Type: ActionRemove, Path: "debug"},
+			{Type: ActionSet, Path: "meta.received_at", Source: SourceTimestamp},
+			{Type: ActionSet, Path: "meta.client", Source: SourceClientID},
+			{Type: ActionSet, Path: "site", Value: "hanoi"},
+		}},
+		{ID: "hot", Priority: 1, Match: Group{
+			Conditions: []Condition{{Path: "sensor.temp", Operator: OperatorGreaterThan, Value: 80.0}},
+		}, Actions: []Action{
+			{Type: ActionRewriteTopic, Topic: "device1/alerts"},
+			{Type: ActionCopy, Topic: "dashboard/hot"},
+			{Type: ActionAlert, Message: "overheat"},
+		}},
+	}
+
+	msg := &Message{
+		Topic:    "device1/private",
+		ClientID: "client-1",
+		Payload:  payload(t, `{"t": 90, "debug": true}`),
+	}
+	result, err := Apply(rules, msg)
+	assert.NoError(t, err)
+	assert.True(t, result.Modified)
+	assert.Equal(t, []string{"dashboard/hot"}, result.Copies)
+	assert.Equal(t, []Alert{{RuleID: "hot", Message: "overheat"}}, result.Alerts)
+	assert.Equal(t, "device1/alerts", msg.Topic)
+	assert.Equal(t, map[string]interface{}{
+		"sensor": map[string]interface{}{"temp": 90.0},
+		"meta":   map[string]interface{}{"received_at": int64(1700000000), "client": "client-1"},
+		"site":   "hanoi",
+	}, msg.Payload)
+
+	_, err = Apply([]Rule{{ID: "bad", Actions: []Action{{Type: "explode"}}}}, msg)
+	assert.Error(t, err)
+}
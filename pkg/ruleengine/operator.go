@@ -0,0 +1,250 @@
+package ruleengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cast"
+)
+
+// legacy operators of platform.RulesDevices, values are compared as float32
+const (
+	OperatorLegacyEqual       = "EQUAL"
+	OperatorLegacyNotEqual    = "NOT EQUAL"
+	OperatorLegacyGreaterThan = "GREATER THAN"
+	OperatorLegacyLessThan    = "LESS THAN"
+)
+
+// typed operators, values keep their json type
+const (
+	OperatorEqual          = "eq"
+	OperatorNotEqual       = "ne"
+	OperatorGreaterThan    = "gt"
+	OperatorGreaterOrEqual = "gte"
+	OperatorLessThan       = "lt"
+	OperatorLessOrEqual    = "lte"
+	OperatorIn             = "in"
+	OperatorNotIn          = "not_in"
+	OperatorContains       = "contains"
+	OperatorRegex          = "regex"
+	OperatorRange          = "range"
+	OperatorExists         = "exists"
+)
+
+// Operator compares the value found at a condition path with the rule value
+type Operator interface {
+	Name() string
+	Evaluate(value, ruleValue interface{}) (bool, error)
+}
+
+// OperatorFunc adapts a function to the Operator interface
+type OperatorFunc struct {
+	name string
+	fn   func(value, ruleValue interface{}) (bool, error)
+}
+
+// NewOperator create new operator from a compare function
+func NewOperator(name string, fn func(value, ruleValue interface{}) (bool, error)) Operator {
+	return &OperatorFunc{name: name, fn: fn}
+}
+
+func (o *OperatorFunc) Name() string {
+	return o.name
+}
+
+func (o *OperatorFunc) Evaluate(value, ruleValue interface{}) (bool, error) {
+	return o.fn(value, ruleValue)
+}
+
+var (
+	operatorsMu sync.RWMutex
+	operators   = make(map[string]Operator)
+)
+
+// RegisterOperator adds or replaces an operator usable by rule conditions
+func RegisterOperator(op Operator) {
+	operatorsMu.Lock()
+	defer operatorsMu.Unlock()
+
+	operators[op.Name()] = op
+}
+
+// GetOperator returns the operator registered with name
+func GetOperator(name string) (Operator, bool) {
+	operatorsMu.RLock()
+	defer operatorsMu.RUnlock()
+
+	op, ok := operators[name]
+	return op, ok
+}
+
+func init() {
+	for _, op := range []Operator{
+		NewOperator(OperatorLegacyEqual, func(v, r interface{}) (bool, error) {
+			return cast.ToFloat32(v) == cast.ToFloat32(r), nil
+		}),
+		NewOperator(OperatorLegacyNotEqual, func(v, r interface{}) (bool, error) {
+			return cast.ToFloat32(v) != cast.ToFloat32(r), nil
+		}),
+		// legacy greater and less than also accept equal values
+		NewOperator(OperatorLegacyGreaterThan, func(v, r interface{}) (bool, error) {
+			return cast.ToFloat32(v) >= cast.ToFloat32(r), nil
+		}),
+		NewOperator(OperatorLegacyLessThan, func(v, r interface{}) (bool, error) {
+			return cast.ToFloat32(v) <= cast.ToFloat32(r), nil
+		}),
+		NewOperator(OperatorEqual, func(v, r interface{}) (bool, error) {
+			return equal(v, r), nil
+		}),
+		NewOperator(OperatorNotEqual, func(v, r interface{}) (bool, error) {
+			return !equal(v, r), nil
+		}),
+		NewOperator(OperatorGreaterThan, func(v, r interface{}) (bool, error) {
+			c, err := compare(v, r)
+			return c > 0, err
+		}),
+		NewOperator(OperatorGreaterOrEqual, func(v, r interface{}) (bool, error) {
+			c, err := compare(v, r)
+			return c >= 0, err
+		}),
+		NewOperator(OperatorLessThan, func(v, r interface{}) (bool, error) {
+			c, err := compare(v, r)
+			return c < 0, err
+		}),
+		NewOperator(OperatorLessOrEqual, func(v, r interface{}) (bool, error) {
+			c, err := compare(v, r)
+			return c <= 0, err
+		}),
+		NewOperator(OperatorIn, in),
+		NewOperator(OperatorNotIn, func(v, r interface{}) (bool, error) {
+			ok, err := in(v, r)
+			return !ok, err
+		}),
+		NewOperator(OperatorContains, contains),
+		NewOperator(OperatorRegex, matchRegex),
+		NewOperator(OperatorRange, inRange),
+		// a missing value never reaches the operator, see Condition.IgnoreMissing
+		NewOperator(OperatorExists, func(v, r interface{}) (bool, error) {
+			return true, nil
+		}),
+	} {
+		RegisterOperator(op)
+	}
+}
+
+// equal compares numbers by value and other types strictly
+func equal(v, r interface{}) bool {
+	if isNumber(v) && isNumber(r) {
+		return cast.ToFloat64(v) == cast.ToFloat64(r)
+	}
+	return reflect.DeepEqual(v, r)
+}
+
+// compare orders two numbers or two strings
+func compare(v, r interface{}) (int, error) {
+	if isNumber(v) && isNumber(r) {
+		a, b := cast.ToFloat64(v), cast.ToFloat64(r)
+		switch {
+		case a < b:
+			return -1, nil
+		case a > b:
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	a, aok := v.(string)
+	b, bok := r.(string)
+	if aok && bok {
+		return strings.Compare(a, b), nil
+	}
+	return 0, fmt.Errorf("can not compare %T with %T", v, r)
+}
+
+func in(v, r interface{}) (bool, error) {
+	values, ok := r.([]interface{})
+	if !ok {
+		return false, fmt.Errorf("in expects a list, got %T", r)
+	}
+	for _, value := range values {
+		if equal(v, value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// contains matches a substring of a string value or an element of a list value
+func contains(v, r interface{}) (bool, error) {
+	switch value := v.(type) {
+	case string:
+		sub, ok := r.(string)
+		if !ok {
+			return false, fmt.Errorf("contains expects a string, got %T", r)
+		}
+		return strings.Contains(value, sub), nil
+	case []interface{}:
+		return in(r, value)
+	}
+	return false, nil
+}
+
+var (
+	regexpsMu sync.RWMutex
+	regexps   = make(map[string]*regexp.Regexp)
+)
+
+func matchRegex(v, r interface{}) (bool, error) {
+	value, ok := v.(string)
+	if !ok {
+		return false, nil
+	}
+	pattern, ok := r.(string)
+	if !ok {
+		return false, fmt.Errorf("regex expects a string pattern, got %T", r)
+	}
+
+	regexpsMu.RLock()
+	re, exist := regexps[pattern]
+	regexpsMu.RUnlock()
+	if !exist {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return false, err
+		}
+		regexpsMu.Lock()
+		regexps[pattern] = re
+		regexpsMu.Unlock()
+	}
+
+	return re.MatchString(value), nil
+}
+
+// inRange checks min <= value <= max for a [min, max] rule value
+func inRange(v, r interface{}) (bool, error) {
+	bounds, ok := r.([]interface{})
+	if !ok || len(bounds) != 2 {
+		return false, fmt.Errorf("range expects [min, max], got %v", r)
+	}
+	low, err := compare(v, bounds[0])
+	if err != nil {
+		return false, err
+	}
+	high, err := compare(v, bounds[1])
+	if err != nil {
+		return false, err
+	}
+	return low >= 0 && high <= 0, nil
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package ruleengine
+
+// logic joining the conditions of a group
+const (
+	LogicAnd = "AND"
+	LogicOr  = "OR"
+)
+
+// action types
+const (
+	ActionDrop         = "drop"
+	ActionRename       = "rename"
+	ActionRemove       = "remove"
+	ActionSet          = "set"
+	ActionRewriteTopic = "rewrite_topic"
+	ActionCopy         = "copy"
+	ActionAlert        = "alert"
+)
+
+// computed values of set actions
+const (
+	SourceTimestamp = "timestamp"
+	SourceUsername  = "username"
+	SourceClientID  = "client_id"
+	SourceTopic     = "topic"
+)
+
+// Condition compares the value found at Path with Value using Operator
+type Condition struct {
+	// Path is a dotted path into the json payload, e.g. "sensor.values.0"
+	Path     string      `json:"path"`
+	Operator string      `json:"operator"`
+	Value    interface{} `json:"value"`
+	// Literal looks up Path as a single top level attribute
+	Literal bool `json:"literal,omitempty"`
+	// IgnoreMissing makes the condition hold when Path is not in the payload
+	IgnoreMissing bool `json:"ignore_missing,omitempty"`
+}
+
+// Group joins conditions and nested groups with AND or OR logic
+type Group struct {
+	Logic      string      `json:"logic"`
+	Not        bool        `json:"not,omitempty"`
+	Conditions []Condition `json:"conditions"`
+	Groups     []Group     `json:"groups,omitempty"`
+}
+
+// Action is taken on a message matching the rule
+type Action struct {
+	Type string `json:"type"`
+	// Path is the attribute renamed, removed or set
+	Path string `json:"path,omitempty"`
+	// To is the new attribute path of a rename
+	To string `json:"to,omitempty"`
+	// Value is the static value of a set, Source a computed one
+	Value  interface{} `json:"value,omitempty"`
+	Source string      `json:"source,omitempty"`
+	// Topic is the new topic of a rewrite, the target of a copy or the kafka topic of an alert
+	Topic string `json:"topic,omitempty"`
+	// Message describes an alert
+	Message string `json:"message,omitempty"`
+}
+
+// Rule runs its actions on messages matching its group,
+// rules with a higher priority run first.
+type Rule struct {
+	ID       string   `json:"id"`
+	Priority int      `json:"priority"`
+	Match    Group    `json:"match"`
+	Actions  []Action `json:"actions"`
+}
+
+// Message is the packet the rules are applied to
+type Message struct {
+	Topic    string
+	ClientID string
+	Username string
+	Payload  map[string]interface{}
+}
+
+// Alert is raised by an alert action
+type Alert struct {
+	RuleID  string
+	Topic   string
+	Message string
+}
+
+// Result reports what the rules did to the message
+type Result struct {
+	Dropped   bool
+	DroppedBy string
+	// Modified is set once an action changed the payload
+	Modified bool
+	// Copies are the topics the message is copied to
+	Copies []string
+	Alerts []Alert
+	// Errors are the conditions that failed to evaluate, they did not match
+	Errors []error
+}
@@ -0,0 +1,105 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+type remoteKey struct{}
+
+// apmTracer starts a transaction for the spans without parent in the process,
+// and an APM span for the others.
+type apmTracer struct {
+	tracer *apm.Tracer
+}
+
+// NewAPMTracer traces with the Elastic APM tracer, configured by the ELASTIC_APM_* variables
+func NewAPMTracer(tracer *apm.Tracer) Tracer {
+	return &apmTracer{tracer: tracer}
+}
+
+func (t *apmTracer) Start(ctx context.Context, name, spanType string) (context.Context, Span) {
+	if apm.TransactionFromContext(ctx) != nil {
+		span, ctx := apm.StartSpan(ctx, name, spanType)
+		return ctx, &apmSpan{ctx: ctx, span: span}
+	}
+
+	var opts apm.TransactionOptions
+	if remote, ok := ctx.Value(remoteKey{}).(apm.TraceContext); ok {
+		opts.TraceContext = remote
+	}
+	tx := t.tracer.StartTransactionOptions(name, spanType, opts)
+	ctx = apm.ContextWithTransaction(ctx, tx)
+	return ctx, &apmSpan{ctx: ctx, tx: tx}
+}
+
+func (t *apmTracer) Inject(ctx context.Context, carrier Carrier) {
+	var traceContext apm.TraceContext
+	if span := apm.SpanFromContext(ctx); span != nil {
+		traceContext = span.TraceContext()
+	} else if tx := apm.TransactionFromContext(ctx); tx != nil {
+		traceContext = tx.TraceContext()
+	} else {
+		return
+	}
+
+	carrier.Set(TraceparentKey, apmhttp.FormatTraceparentHeader(traceContext))
+	if state := traceContext.State.String(); state != "" {
+		carrier.Set(TracestateKey, state)
+	}
+}
+
+func (t *apmTracer) Extract(ctx context.Context, carrier Carrier) context.Context {
+	traceContext, err := apmhttp.ParseTraceparentHeader(carrier.Get(TraceparentKey))
+	if err != nil {
+		return ctx
+	}
+	if state := carrier.Get(TracestateKey); state != "" {
+		if traceState, err := apmhttp.ParseTracestateHeader(strings.Split(state, ",")...); err == nil {
+			traceContext.State = traceState
+		}
+	}
+	return context.WithValue(ctx, remoteKey{}, traceContext)
+}
+
+// apmSpan is a transaction or a span
+type apmSpan struct {
+	ctx  context.Context
+	tx   *apm.Transaction
+	span *apm.Span
+}
+
+func (s *apmSpan) End() {
+	if s.span != nil {
+		s.span.End()
+		return
+	}
+	s.tx.End()
+}
+
+func (s *apmSpan) SetAttribute(key, value string) {
+	if s.span != nil {
+		s.span.Context.SetLabel(key, value)
+		return
+	}
+	s.tx.Context.SetLabel(key, value)
+}
+
+func (s *apmSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	if e := apm.CaptureError(s.ctx, err); e != nil {
+		e.Send()
+	}
+}
+
+func (s *apmSpan) TraceID() string {
+	if s.span != nil {
+		return s.span.TraceContext().Trace.String()
+	}
+	return s.tx.TraceContext().Trace.String()
+}
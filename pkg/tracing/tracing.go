@@ -0,0 +1,173 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/segmentio/kafka-go"
+)
+
+// keys of the W3C trace context carried by http headers, mqtt user properties and kafka headers
+const (
+	TraceparentKey = "traceparent"
+	TracestateKey  = "tracestate"
+)
+
+// types of the spans
+const (
+	TypeMessaging = "messaging"
+	TypeInternal  = "app"
+)
+
+// Carrier reads and writes the propagated trace context, http.Header is a Carrier
+type Carrier interface {
+	Get(key string) string
+	Set(key, value string)
+}
+
+// Span is a traced operation
+type Span interface {
+	End()
+	SetAttribute(key, value string)
+	RecordError(err error)
+	// TraceID returns the hex id of the trace, empty when the span is not recorded
+	TraceID() string
+}
+
+// Tracer starts spans and propagates their context. NewAPMTracer traces with Elastic APM,
+// an OpenTelemetry tracer can implement it as well.
+type Tracer interface {
+	// Start starts a span, child of the span of ctx or of the remote parent extracted into ctx
+	Start(ctx context.Context, name, spanType string) (context.Context, Span)
+	// Inject writes the trace context of ctx into the carrier
+	Inject(ctx context.Context, carrier Carrier)
+	// Extract returns ctx with the remote trace context read from the carrier
+	Extract(ctx context.Context, carrier Carrier) context.Context
+}
+
+type spanKey struct{}
+
+var (
+	tracerMu sync.RWMutex
+	tracer   Tracer = noopTracer{}
+)
+
+// SetTracer sets the tracer of the service, nil disables tracing
+func SetTracer(t Tracer) {
+	if t == nil {
+		t = noopTracer{}
+	}
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	tracer = t
+}
+
+// GetTracer returns the tracer of the service
+func GetTracer() Tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return tracer
+}
+
+// Start starts a span with the tracer of the service, the span is kept in the returned context
+func Start(ctx context.Context, name, spanType string) (context.Context, Span) {
+	ctx, span := GetTracer().Start(ctx, name, spanType)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanFromContext returns the span started by Start, nil when there is none
+func SpanFromContext(ctx context.Context) Span {
+	span, _ := ctx.Value(spanKey{}).(Span)
+	return span
+}
+
+// TraceID returns the trace id of the span of ctx, empty when there is none
+func TraceID(ctx context.Context) string {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.TraceID()
+	}
+	return ""
+}
+
+// Inject writes the trace context of ctx into the carrier
+func Inject(ctx context.Context, carrier Carrier) {
+	GetTracer().Inject(ctx, carrier)
+}
+
+// Extract returns ctx with the remote trace context read from the carrier
+func Extract(ctx context.Context, carrier Carrier) context.Context {
+	return GetTracer().Extract(ctx, carrier)
+}
+
+// Copy copies the trace context from one carrier to another
+func Copy(from, to Carrier) {
+	for _, key := range []string{TraceparentKey, TracestateKey} {
+		if value := from.Get(key); value != "" {
+			to.Set(key, value)
+		}
+	}
+}
+
+// UserProperties carries the trace context in the user properties of an MQTTv5 packet
+type UserProperties []packets.UserProperty
+
+func (p *UserProperties) Get(key string) string {
+	for _, property := range *p {
+		if property.Key == key {
+			return property.Val
+		}
+	}
+	return ""
+}
+
+func (p *UserProperties) Set(key, value string) {
+	for i, property := range *p {
+		if property.Key == key {
+			(*p)[i].Val = value
+			return
+		}
+	}
+	*p = append(*p, packets.UserProperty{Key: key, Val: value})
+}
+
+// KafkaHeaders carries the trace context in the headers of a kafka message
+type KafkaHeaders []kafka.Header
+
+func (h *KafkaHeaders) Get(key string) string {
+	for _, header := range *h {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (h *KafkaHeaders) Set(key, value string) {
+	for i, header := range *h {
+		if header.Key == key {
+			(*h)[i].Value = []byte(value)
+			return
+		}
+	}
+	*h = append(*h, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, _, _ string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(context.Context, Carrier) {}
+
+func (noopTracer) Extract(ctx context.Context, _ Carrier) context.Context {
+	return ctx
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End()                     {}
+func (noopSpan) SetAttribute(_, _ string) {}
+func (noopSpan) RecordError(_ error)      {}
+func (noopSpan) TraceID() string          { return "" }
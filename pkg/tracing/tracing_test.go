@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mochi-co/mqtt/v2/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/apmtest"
+)
+
+func useAPM(t *testing.T) *apmtest.RecordingTracer {
+	recorder := apmtest.NewRecordingTracer()
+	t.Cleanup(recorder.Close)
+	SetTracer(NewAPMTracer(recorder.Tracer))
+	t.Cleanup(func() { SetTracer(nil) })
+	return recorder
+}
+
+func TestPropagation(t *testing.T) {
+	recorder := useAPM(t)
+
+	// mqtt publish -> kafka -> downstream delivery
+	ctx, publish := Start(context.Background(), "mqtt publish", TypeMessaging)
+	_, rules := Start(ctx, "apply rules", TypeInternal)
+	rules.End()
+	properties := UserProperties{{Key: "device", Val: "1"}}
+	Inject(ctx, &properties)
+	publish.End()
+
+	var headers KafkaHeaders
+	Copy(&properties, &headers)
+	assert.Equal(t, properties.Get(TraceparentKey), headers.Get(TraceparentKey))
+	assert.Equal(t, "1", properties.Get("device"))
+
+	ctx, consume := Start(Extract(context.Background(), &headers), "kafka downstream", TypeMessaging)
+	assert.Equal(t, publish.TraceID(), consume.TraceID())
+	assert.Equal(t, publish.TraceID(), TraceID(ctx))
+	consume.End()
+
+	recorder.Flush(nil)
+	payloads := recorder.Payloads()
+	require.Len(t, payloads.Transactions, 2)
+	require.Len(t, payloads.Spans, 1)
+	assert.Equal(t, "apply rules", payloads.Spans[0].Name)
+	assert.Equal(t, payloads.Transactions[0].TraceID, payloads.Transactions[1].TraceID)
+	assert.Equal(t, payloads.Transactions[0].ID, payloads.Transactions[1].ParentID,
+		"the consumer is a child of the publish")
+}
+
+func TestExtractWithoutTraceContext(t *testing.T) {
+	useAPM(t)
+
+	ctx := Extract(context.Background(), &UserProperties{})
+	ctx, span := Start(ctx, "mqtt publish", TypeMessaging)
+	defer span.End()
+	assert.NotEmpty(t, TraceID(ctx), "a new trace is started")
+}
+
+func TestNoopTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "mqtt publish", TypeMessaging)
+	defer span.End()
+	assert.Empty(t, TraceID(ctx))
+
+	var properties UserProperties
+	Inject(ctx, &properties)
+	assert.Empty(t, properties)
+	assert.Empty(t, TraceID(context.Background()))
+}
+
+func TestCarriersReplaceKeys(t *testing.T) {
+	properties := UserProperties([]packets.UserProperty{{Key: TraceparentKey, Val: "old"}})
+	properties.Set(TraceparentKey, "new")
+	assert.Equal(t, UserProperties{{Key: TraceparentKey, Val: "new"}}, properties)
+
+	var headers KafkaHeaders
+	headers.Set(TraceparentKey, "old")
+	headers.Set(TraceparentKey, "new")
+	assert.Len(t, headers, 1)
+	assert.Equal(t, "new", headers.Get(TraceparentKey))
+}
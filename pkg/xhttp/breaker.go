@@ -0,0 +1,65 @@
+package xhttp
+
+import (
+	"fmt"
+	"message-core/pkg/breaker"
+	"net/http"
+	"sync"
+)
+
+// ErrCircuitOpen is returned while the circuit breaker of the host rejects the requests
+var ErrCircuitOpen = breaker.ErrOpen
+
+// breakerTransport keeps a circuit breaker per host, network errors and 5xx
+// responses are failures.
+type breakerTransport struct {
+	cfg     breaker.Config
+	next    http.RoundTripper
+	metrics *outgoingMetrics
+
+	mu       sync.Mutex
+	breakers map[string]*breaker.Breaker
+}
+
+func newBreakerTransport(cfg breaker.Config, next http.RoundTripper, metrics *outgoingMetrics) *breakerTransport {
+	return &breakerTransport{
+		cfg:      cfg,
+		next:     next,
+		metrics:  metrics,
+		breakers: make(map[string]*breaker.Breaker),
+	}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.breaker(req.URL.Host)
+	if err := b.Allow(); err != nil {
+		return nil, fmt.Errorf("%s: %w", req.URL.Host, err)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode >= http.StatusInternalServerError {
+		b.Failure()
+	} else {
+		b.Success()
+	}
+	return resp, err
+}
+
+func (t *breakerTransport) breaker(host string) *breaker.Breaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if b, ok := t.breakers[host]; ok {
+		return b
+	}
+	b := breaker.New(t.cfg)
+	if t.metrics != nil {
+		state := t.metrics.breakerState.WithLabelValues(host)
+		state.Set(float64(breaker.Closed))
+		b.OnStateChange(func(_, to breaker.State) {
+			state.Set(float64(to))
+		})
+	}
+	t.breakers[host] = b
+	return b
+}
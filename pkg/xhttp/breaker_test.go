@@ -0,0 +1,56 @@
+package xhttp
+
+import (
+	"context"
+	"errors"
+	"message-core/pkg/breaker"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreakerPerHost(t *testing.T) {
+	var failing, healthy int32
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failing, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+	healthyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthy, 1)
+	}))
+	defer healthyServer.Close()
+
+	promCfg := NewBasePromConfig("breaker_test", "test")
+	promCfg.Register = prometheus.NewRegistry()
+	c := NewClient(WithSkipLog(true), WithPromConfig(promCfg),
+		WithCircuitBreaker(breaker.Config{Threshold: 2, OpenTimeout: time.Hour}))
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		status, _ := c.Get(ctx, failingServer.URL, nil)
+		assert.Equal(t, http.StatusInternalServerError, status)
+	}
+	_, err := c.Get(ctx, failingServer.URL, nil)
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&failing), "the open breaker does not call the host")
+
+	status, err := c.Get(ctx, healthyServer.URL, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status, "the breakers are per host")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&healthy))
+
+	transport := c.(*client).client.Transport.(*Transport).transport.(*breakerTransport)
+	failingHost, _ := url.Parse(failingServer.URL)
+	healthyHost, _ := url.Parse(healthyServer.URL)
+	assert.Equal(t, float64(breaker.Open), testutil.ToFloat64(transport.metrics.breakerState.WithLabelValues(failingHost.Host)))
+	assert.Equal(t, float64(breaker.Closed), testutil.ToFloat64(transport.metrics.breakerState.WithLabelValues(healthyHost.Host)))
+}
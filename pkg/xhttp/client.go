@@ -4,10 +4,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"message-core/pkg/tracing"
 	"net/http"
 	"net/url"
 	"time"
@@ -25,6 +24,11 @@ const (
 	defaultSubsystem     = "yams"
 )
 
+// Client sends HTTP requests and decodes the responses by their Content-Type. Every method returns the
+// response status, zero when there is no response, and an *Error when the request fails,
+// the status is not 2xx or the body cannot be decoded. The body of a response that
+// is not 2xx is never decoded into the target, see IsTimeout, IsClientError and IsServerError.
+//
 // nolint: lll
 // Không cần check long line linter cho interface
 type Client interface {
@@ -189,34 +193,56 @@ func (c *client) GetWithoutEncodedQuery(ctx context.Context,
 	return c.Do(ctx, req, target)
 }
 
+// Do sends the request and decodes the body of a 2xx response into target with the codec
+// of its Content-Type, JSON when there is none or decodeNumber is set.
+// It returns the response status, zero without response, and an *Error when the request
+// fails, the status is not 2xx or the body cannot be decoded.
 func (c *client) Do(ctx context.Context, request *http.Request, target interface{}, decodeNumber ...bool) (int, error) {
-	if requestID := request.Header.Get(RequestIDHeader); requestID == "" {
-		request.Header.Set(RequestIDHeader, getContextIDFromCtx(ctx))
-	}
+	setTraceHeaders(ctx, request)
 	rsp, err := c.client.Do(request)
 	if err != nil {
-		return 0, err
+		return 0, newError(request, 0, nil, err)
 	}
+	return handleResponse(request, rsp, target, len(decodeNumber) > 0 && decodeNumber[0])
+}
+
+// handleResponse closes the response body, the body of a response that is not 2xx is
+// not decoded and returned in the *Error.
+func handleResponse(req *http.Request, rsp *http.Response, target interface{}, decodeNumber bool) (int, error) {
 	defer func() {
 		_ = rsp.Body.Close()
 	}()
 
 	bodyBytes, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		return 0, err
+		return rsp.StatusCode, newError(req, rsp.StatusCode, nil, err)
 	}
-
-	if len(bodyBytes) == 0 {
+	if rsp.StatusCode < http.StatusOK || rsp.StatusCode >= http.StatusMultipleChoices {
+		return rsp.StatusCode, newError(req, rsp.StatusCode, bodyBytes, nil)
+	}
+	if target == nil || len(bodyBytes) == 0 {
 		return rsp.StatusCode, nil
 	}
 
-	if len(decodeNumber) > 0 && decodeNumber[0] == true {
-		d := json.NewDecoder(bytes.NewBuffer(bodyBytes))
+	if decodeNumber {
+		d := json.NewDecoder(bytes.NewReader(bodyBytes))
 		d.UseNumber()
-		return rsp.StatusCode, d.Decode(target)
+		err = d.Decode(target)
+	} else {
+		err = decodeBody(bodyBytes, rsp.Header.Get(contentTypeField), target)
 	}
+	if err != nil {
+		return rsp.StatusCode, newError(req, rsp.StatusCode, bodyBytes, fmt.Errorf("could not parse response body: %w", err))
+	}
+	return rsp.StatusCode, nil
+}
 
-	return rsp.StatusCode, json.Unmarshal(bodyBytes, target)
+// setTraceHeaders sets the request id and propagates the trace of ctx
+func setTraceHeaders(ctx context.Context, req *http.Request) {
+	if requestID := req.Header.Get(RequestIDHeader); requestID == "" {
+		req.Header.Set(RequestIDHeader, getContextIDFromCtx(ctx))
+	}
+	tracing.Inject(ctx, req.Header)
 }
 
 func (c *client) getRequestHeader(reqOpts ...RequestOption) map[string]string {
@@ -234,7 +260,11 @@ func (c *client) getRequestHeader(reqOpts ...RequestOption) map[string]string {
 	return header
 }
 
+// getContextIDFromCtx returns the trace id of the span of ctx, or the legacy "context_id" value
 func getContextIDFromCtx(ctx context.Context) string {
+	if traceID := tracing.TraceID(ctx); traceID != "" {
+		return traceID
+	}
 	if result, ok := ctx.Value("context_id").(string); ok {
 		return result
 	}
@@ -263,12 +293,11 @@ func (c *client) GetWithQueryCustomHeader(ctx context.Context,
 		req.URL.RawQuery = nonEncodedValue
 		// req.URL.RawQuery = v.Encode()
 	}
-	fmt.Println("111111111111111111111111111122221", data)
-	fmt.Println("11111111111111111111111111111", req.URL)
 	req.Header = customHeader
 	return c.Do(ctx, req, target)
 }
 
+// SendHTTPRequest follows the contract of Do, the body of a 2xx response is decoded into outPut
 func (c *client) SendHTTPRequest(
 	ctx context.Context,
 	method string,
@@ -279,15 +308,10 @@ func (c *client) SendHTTPRequest(
 ) (status int, err error) {
 	req, err := c.newRequest(ctx, method, path, payload, reqOptions)
 	if err != nil {
-		return -1, fmt.Errorf("failed to create %s request: %w", method, err)
+		return 0, fmt.Errorf("failed to create %s request: %w", method, err)
 	}
 
-	status, err = c.doRequest(ctx, req, outPut)
-	if err != nil {
-		return
-	}
-
-	return
+	return c.doRequest(ctx, req, outPut)
 }
 
 /*Internal implementation*/
@@ -309,7 +333,7 @@ func (c *client) newRequest(
 	if err != nil {
 		return
 	}
-	if reqOpts[0].HeaderCustom != nil {
+	if len(reqOpts) > 0 && reqOpts[0].HeaderCustom != nil {
 		req.Header = reqOpts[0].HeaderCustom
 	}
 
@@ -321,73 +345,25 @@ func (h *client) doRequest(
 	r *http.Request,
 	outPut interface{},
 ) (status int, err error) {
-	if requestID := r.Header.Get(RequestIDHeader); requestID == "" {
-		r.Header.Set(RequestIDHeader, getContextIDFromCtx(ctx))
-	}
+	setTraceHeaders(ctx, r)
 
 	apmClient := apmhttp.WrapClient(h.client)
 	resp, err := ctxhttp.Do(ctx, apmClient, r)
 	if err != nil {
-		logrus.WithField("MAKE-REQUEST-ERROR", err).WithField("Status-Code", resp.StatusCode).
-			WithFields(
-				logrus.Fields{
-					"URL":    r.URL.String(),
-					"Method": r.Method,
-				}).
-			WithError(err).
-			Error()
-		return -1, fmt.Errorf("failed to make request: %w", err)
-	}
-
-	if resp == nil {
-		return
-	}
-
-	// return first if not need output return
-	if outPut == nil {
-		return
+		err = newError(r, 0, nil, err)
+	} else {
+		status, err = handleResponse(r, resp, outPut, false)
 	}
-
-	var buf bytes.Buffer
-	dec := json.NewDecoder(io.TeeReader(resp.Body, &buf))
-	if err := dec.Decode(outPut); err != nil {
-
-		logrus.WithField("PARSE_RESPONSE_BODY_ERROR", err).
+	if err != nil && !h.opts.skipLog {
+		logrus.WithField("DO_HTTP_REQUEST_ERROR", err).
 			WithFields(
 				logrus.Fields{
-					"URL":    r.URL.String(),
+					"URL":    r.URL.Redacted(),
 					"Method": r.Method,
-					"Output": buf.String(),
 				}).
-			WithField("Status-Code", resp.StatusCode).
+			WithField("Status-Code", status).
 			WithError(err).
 			Error()
-		return -1, fmt.Errorf("could not parse response body: %w", err)
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		logrus.WithField("DO_HTTP_REQUEST_ERROR", err).
-			WithFields(
-				logrus.Fields{"Status": resp.Status,
-					"PostForm": r.PostForm,
-					"Form":     r.Form,
-					"Header":   r.Header,
-					"URL":      r.URL.String(),
-					"Method":   r.Method,
-					"Output":   outPut,
-				}).WithField("Status-Code", resp.StatusCode).
-			WithError(err).
-			Error()
-
-		switch resp.StatusCode {
-		case http.StatusInternalServerError:
-			return
-		default:
-			return status, errors.New(resp.Status)
-		}
-	}
-
-	defer resp.Body.Close() // nolint: errcheck
-
-	return http.StatusOK, nil
+	return status, err
 }
@@ -0,0 +1,40 @@
+package xhttp
+
+import (
+	"context"
+	"message-core/pkg/tracing"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/apmtest"
+)
+
+func TestRequestIDFromTrace(t *testing.T) {
+	recorder := apmtest.NewRecordingTracer()
+	defer recorder.Close()
+	tracing.SetTracer(tracing.NewAPMTracer(recorder.Tracer))
+	defer tracing.SetTracer(nil)
+
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	ctx, span := tracing.Start(context.Background(), "mqtt connect", tracing.TypeMessaging)
+	defer span.End()
+
+	c := NewClient(WithSkipLog(true))
+	_, err := c.Get(ctx, server.URL, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, span.TraceID())
+	assert.Equal(t, span.TraceID(), header.Get(RequestIDHeader))
+	assert.Contains(t, header.Get(tracing.TraceparentKey), span.TraceID())
+
+	_, err = c.Get(context.Background(), server.URL, nil)
+	require.NoError(t, err)
+	assert.Empty(t, header.Get(RequestIDHeader), "no trace, no request id")
+}
@@ -0,0 +1,374 @@
+package xhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/google/go-querystring/query"
+	"github.com/ugorji/go/codec"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Codec encodes the request bodies and decodes the response bodies of a content type
+type Codec interface {
+	// Encode returns the body and its Content-Type header
+	Encode(data interface{}) (body []byte, contentType string, err error)
+	// Decode decodes a body whose Content-Type header is contentType into target
+	Decode(body []byte, contentType string, target interface{}) error
+}
+
+var codecs = struct {
+	sync.RWMutex
+	byType map[string]Codec
+}{byType: map[string]Codec{}}
+
+func init() {
+	RegisterCodec(MIMEJSON, jsonCodec{})
+	RegisterCodec(MIMEXML, xmlCodec{contentType: MIMEXML})
+	RegisterCodec(MIMEXML2, xmlCodec{contentType: MIMEXML2})
+	RegisterCodec(MIMEPlain, textCodec{contentType: MIMEPlain})
+	RegisterCodec(MIMEHTML, textCodec{contentType: MIMEHTML})
+	RegisterCodec(MIMEPOSTForm, formCodec{})
+	RegisterCodec(MIMEMultipartPOSTForm, multipartCodec{})
+	RegisterCodec(MIMEPROTOBUF, protobufCodec{})
+	RegisterCodec(MIMEMSGPACK, msgpackCodec{contentType: MIMEMSGPACK})
+	RegisterCodec(MIMEMSGPACK2, msgpackCodec{contentType: MIMEMSGPACK2})
+	RegisterCodec(MIMEYAML, yamlCodec{})
+}
+
+// RegisterCodec sets the codec of a content type, replacing the registered one
+func RegisterCodec(contentType string, c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.byType[mediaType(contentType)] = c
+}
+
+// CodecFor returns the codec of a Content-Type header, its parameters are ignored
+func CodecFor(contentType string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.byType[mediaType(contentType)]
+	return c, ok
+}
+
+func mediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// encodeBody encodes data with the codec of contentType, JSON when it is empty.
+// Unregistered types, such as vendor JSON types, are encoded as JSON and keep their type.
+func encodeBody(contentType string, data interface{}) ([]byte, string, error) {
+	if contentType == "" {
+		contentType = MIMEJSON
+	}
+	c, ok := CodecFor(contentType)
+	if !ok {
+		body, _, err := jsonCodec{}.Encode(data)
+		return body, contentType, err
+	}
+	return c.Encode(data)
+}
+
+// requestContentType returns the Content-Type header of a request whose body is encoded with
+// the encoded type. The type set by the caller is kept with its parameters, such as the charset,
+// unless the encoded type has parameters it lacks, such as the multipart boundary.
+func requestContentType(set, encoded string) string {
+	if set == "" {
+		return encoded
+	}
+	_, setParams, _ := mime.ParseMediaType(set)
+	_, encodedParams, _ := mime.ParseMediaType(encoded)
+	if len(setParams) == 0 && len(encodedParams) > 0 {
+		return encoded
+	}
+	return set
+}
+
+// decodeBody decodes body with the codec of contentType, JSON when there is none
+func decodeBody(body []byte, contentType string, target interface{}) error {
+	c, ok := CodecFor(contentType)
+	if !ok {
+		c = jsonCodec{}
+	}
+	return c.Decode(body, contentType, target)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(data interface{}) ([]byte, string, error) {
+	body, err := json.Marshal(data)
+	return body, MIMEJSON, err
+}
+
+func (jsonCodec) Decode(body []byte, _ string, target interface{}) error {
+	return json.Unmarshal(body, target)
+}
+
+type xmlCodec struct {
+	contentType string
+}
+
+func (c xmlCodec) Encode(data interface{}) ([]byte, string, error) {
+	body, err := xml.Marshal(data)
+	return body, c.contentType, err
+}
+
+func (xmlCodec) Decode(body []byte, _ string, target interface{}) error {
+	return xml.Unmarshal(body, target)
+}
+
+// textCodec sends strings and bytes as they are. The bodies decoded into other
+// targets are JSON, many servers do not set the Content-Type of their JSON responses.
+type textCodec struct {
+	contentType string
+}
+
+func (c textCodec) Encode(data interface{}) ([]byte, string, error) {
+	switch v := data.(type) {
+	case string:
+		return []byte(v), c.contentType, nil
+	case []byte:
+		return v, c.contentType, nil
+	case nil:
+		return nil, c.contentType, nil
+	default:
+		return []byte(fmt.Sprint(v)), c.contentType, nil
+	}
+}
+
+func (textCodec) Decode(body []byte, contentType string, target interface{}) error {
+	switch v := target.(type) {
+	case *string:
+		*v = string(body)
+		return nil
+	case *[]byte:
+		*v = append((*v)[:0], body...)
+		return nil
+	default:
+		return jsonCodec{}.Decode(body, contentType, target)
+	}
+}
+
+// formCodec encodes url.Values, string maps and structs with `url` tags, it decodes
+// into *url.Values, string maps and structs with `url` tags.
+type formCodec struct{}
+
+func (formCodec) Encode(data interface{}) ([]byte, string, error) {
+	values, err := formValues(data)
+	if err != nil {
+		return nil, "", err
+	}
+	return []byte(values.Encode()), MIMEPOSTForm, nil
+}
+
+func (formCodec) Decode(body []byte, _ string, target interface{}) error {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	return setFormValues(target, values)
+}
+
+func formValues(data interface{}) (url.Values, error) {
+	switch v := data.(type) {
+	case nil:
+		return url.Values{}, nil
+	case url.Values:
+		return v, nil
+	case map[string][]string:
+		return v, nil
+	case map[string]string:
+		values := url.Values{}
+		for key, value := range v {
+			values.Set(key, value)
+		}
+		return values, nil
+	default:
+		return query.Values(data)
+	}
+}
+
+func setFormValues(target interface{}, values url.Values) error {
+	switch v := target.(type) {
+	case *url.Values:
+		*v = values
+	case *map[string][]string:
+		*v = values
+	case *map[string]string:
+		*v = make(map[string]string, len(values))
+		for key := range values {
+			(*v)[key] = values.Get(key)
+		}
+	default:
+		return binding.MapFormWithTag(target, values, "url")
+	}
+	return nil
+}
+
+// MultipartForm is the body of a multipart/form-data request or response
+type MultipartForm struct {
+	Fields url.Values
+	Files  []FormFile
+}
+
+// FormFile is a file uploaded in a multipart form
+type FormFile struct {
+	Field    string
+	FileName string
+	// ContentType is application/octet-stream when empty
+	ContentType string
+	Content     io.Reader
+}
+
+// multipartCodec encodes a MultipartForm, or the fields of the data accepted by formCodec.
+// It decodes into *MultipartForm, the file contents are read in memory.
+type multipartCodec struct{}
+
+func (multipartCodec) Encode(data interface{}) ([]byte, string, error) {
+	var form MultipartForm
+	switch v := data.(type) {
+	case MultipartForm:
+		form = v
+	case *MultipartForm:
+		form = *v
+	default:
+		values, err := formValues(data)
+		if err != nil {
+			return nil, "", err
+		}
+		form.Fields = values
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for field, values := range form.Fields {
+		for _, value := range values {
+			if err := w.WriteField(field, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	for _, file := range form.Files {
+		contentType := file.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     file.Field,
+			"filename": file.FileName,
+		}))
+		header.Set(contentTypeField, contentType)
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if file.Content != nil {
+			if _, err := io.Copy(part, file.Content); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+func (multipartCodec) Decode(body []byte, contentType string, target interface{}) error {
+	form, ok := target.(*MultipartForm)
+	if !ok {
+		return fmt.Errorf("multipart bodies decode into *MultipartForm, not %T", target)
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	form.Fields = url.Values{}
+	form.Files = nil
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return err
+		}
+		if part.FileName() == "" {
+			form.Fields.Add(part.FormName(), string(content))
+			continue
+		}
+		form.Files = append(form.Files, FormFile{
+			Field:       part.FormName(),
+			FileName:    part.FileName(),
+			ContentType: part.Header.Get(contentTypeField),
+			Content:     bytes.NewReader(content),
+		})
+	}
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) Encode(data interface{}) ([]byte, string, error) {
+	msg, ok := data.(proto.Message)
+	if !ok {
+		return nil, "", fmt.Errorf("protobuf bodies encode a proto.Message, not %T", data)
+	}
+	body, err := proto.Marshal(msg)
+	return body, MIMEPROTOBUF, err
+}
+
+func (protobufCodec) Decode(body []byte, _ string, target interface{}) error {
+	msg, ok := target.(proto.Message)
+	if !ok {
+		return fmt.Errorf("protobuf bodies decode into a proto.Message, not %T", target)
+	}
+	return proto.Unmarshal(body, msg)
+}
+
+type msgpackCodec struct {
+	contentType string
+}
+
+var msgpackHandle = &codec.MsgpackHandle{}
+
+func (c msgpackCodec) Encode(data interface{}) ([]byte, string, error) {
+	var body []byte
+	err := codec.NewEncoderBytes(&body, msgpackHandle).Encode(data)
+	return body, c.contentType, err
+}
+
+func (msgpackCodec) Decode(body []byte, _ string, target interface{}) error {
+	return codec.NewDecoderBytes(body, msgpackHandle).Decode(target)
+}
+
+type yamlCodec struct{}
+
+func (yamlCodec) Encode(data interface{}) ([]byte, string, error) {
+	body, err := yaml.Marshal(data)
+	return body, MIMEYAML, err
+}
+
+func (yamlCodec) Decode(body []byte, _ string, target interface{}) error {
+	return yaml.Unmarshal(body, target)
+}
@@ -0,0 +1,165 @@
+package xhttp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecPayload struct {
+	Name  string `json:"name" xml:"name" yaml:"name" codec:"name" url:"name"`
+	Count int    `json:"count" xml:"count" yaml:"count" codec:"count" url:"count"`
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	in := codecPayload{Name: "device 1", Count: 3}
+	for _, contentType := range []string{MIMEJSON, MIMEXML, MIMEXML2, MIMEPOSTForm, MIMEMSGPACK, MIMEMSGPACK2, MIMEYAML} {
+		body, encodedType, err := encodeBody(contentType, in)
+		require.NoError(t, err, contentType)
+		assert.Equal(t, contentType, encodedType)
+
+		var out codecPayload
+		require.NoError(t, decodeBody(body, contentType+"; charset=utf-8", &out), contentType)
+		assert.Equal(t, in, out, contentType)
+	}
+
+	body, _, err := encodeBody(MIMEPROTOBUF, wrapperspb.String("device 1"))
+	require.NoError(t, err)
+	out := &wrapperspb.StringValue{}
+	require.NoError(t, decodeBody(body, MIMEPROTOBUF, out))
+	assert.True(t, proto.Equal(wrapperspb.String("device 1"), out))
+
+	_, _, err = encodeBody(MIMEPROTOBUF, in)
+	assert.Error(t, err, "protobuf bodies are proto messages")
+}
+
+func TestEncodeUnregisteredType(t *testing.T) {
+	for _, contentType := range []string{"application/vnd.x+json", "application/unknown"} {
+		body, encodedType, err := encodeBody(contentType, codecPayload{Name: "device 1", Count: 3})
+		require.NoError(t, err, contentType)
+		assert.Equal(t, contentType, encodedType)
+		assert.JSONEq(t, `{"name":"device 1","count":3}`, string(body), contentType)
+	}
+}
+
+func TestRequestContentType(t *testing.T) {
+	tests := []struct {
+		set      string
+		encoded  string
+		expected string
+	}{
+		{set: "", encoded: MIMEJSON, expected: MIMEJSON},
+		{set: "application/json; charset=utf-8", encoded: MIMEJSON, expected: "application/json; charset=utf-8"},
+		{set: "application/vnd.x+json", encoded: "application/vnd.x+json", expected: "application/vnd.x+json"},
+		{set: MIMEMultipartPOSTForm, encoded: MIMEMultipartPOSTForm + "; boundary=abc", expected: MIMEMultipartPOSTForm + "; boundary=abc"},
+		{set: MIMEMultipartPOSTForm + "; boundary=xyz", encoded: MIMEMultipartPOSTForm + "; boundary=abc", expected: MIMEMultipartPOSTForm + "; boundary=xyz"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, requestContentType(tt.set, tt.encoded), tt.set)
+	}
+
+	req, err := NewRequestBuilder().
+		WithMethod(http.MethodPost).
+		WithURL("http://localhost").
+		WithBody(MIMEJSON, codecPayload{Name: "device 1"}).
+		WithHeaders(map[string]string{contentTypeField: "application/json; charset=utf-8"}).
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, "application/json; charset=utf-8", req.Header.Get(contentTypeField), "the caller content type is kept")
+
+	req, err = NewRequestBuilder().
+		WithMethod(http.MethodPost).
+		WithURL("http://localhost").
+		WithBody(MIMEPOSTForm, codecPayload{Name: "device 1"}).
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, MIMEPOSTForm, req.Header.Get(contentTypeField))
+}
+
+func TestPostForm(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, MIMEPOSTForm, r.Header.Get(contentTypeField))
+		require.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Header().Set(contentTypeField, MIMEXML)
+		_, _ = w.Write([]byte(`<codecPayload><name>ok</name><count>1</count></codecPayload>`))
+	}))
+	defer server.Close()
+
+	var out codecPayload
+	c := NewClient(WithSkipLog(true))
+	_, err := c.PostForm(context.Background(), server.URL, codecPayload{Name: "device 1", Count: 3}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{"name": {"device 1"}, "count": {"3"}}, form)
+	assert.Equal(t, codecPayload{Name: "ok", Count: 1}, out, "the response is decoded by its content type")
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseMultipartForm(1<<20))
+		assert.Equal(t, "firmware", r.FormValue("kind"))
+		file, header, err := r.FormFile("file")
+		require.NoError(t, err)
+		content, _ := ioutil.ReadAll(file)
+		assert.Equal(t, "fw.bin", header.Filename)
+		assert.Equal(t, "binary", string(content))
+		w.Header().Set(contentTypeField, MIMEPlain)
+		_, _ = w.Write([]byte("uploaded"))
+	}))
+	defer server.Close()
+
+	form := MultipartForm{
+		Fields: url.Values{"kind": {"firmware"}},
+		Files:  []FormFile{{Field: "file", FileName: "fw.bin", Content: strings.NewReader("binary")}},
+	}
+	var out string
+	c := NewClient(WithSkipLog(true))
+	_, err := c.SendHTTPRequest(context.Background(), http.MethodPost, server.URL, form, &out,
+		RequestOption{Header: map[string]string{contentTypeField: MIMEMultipartPOSTForm}})
+	require.NoError(t, err)
+	assert.Equal(t, "uploaded", out)
+
+	// the file content was read by the request
+	form.Files[0].Content = strings.NewReader("binary")
+	body, contentType, err := encodeBody(MIMEMultipartPOSTForm, form)
+	require.NoError(t, err)
+	var decoded MultipartForm
+	require.NoError(t, decodeBody(body, contentType, &decoded))
+	assert.Equal(t, form.Fields, decoded.Fields)
+	require.Len(t, decoded.Files, 1)
+	content, _ := ioutil.ReadAll(decoded.Files[0].Content)
+	assert.Equal(t, "binary", string(content))
+	assert.Equal(t, "application/octet-stream", decoded.Files[0].ContentType)
+}
+
+type upperCodec struct{}
+
+func (upperCodec) Encode(data interface{}) ([]byte, string, error) {
+	return []byte(strings.ToUpper(data.(string))), "text/upper", nil
+}
+
+func (upperCodec) Decode(body []byte, _ string, target interface{}) error {
+	*target.(*string) = strings.ToLower(string(body))
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("text/upper", upperCodec{})
+	body, contentType, err := encodeBody("Text/Upper", "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "ABC", string(body))
+
+	var out string
+	require.NoError(t, decodeBody(body, contentType, &out))
+	assert.Equal(t, "abc", out)
+}
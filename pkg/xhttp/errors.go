@@ -0,0 +1,112 @@
+package xhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const maxErrorBodyLen = 512
+
+// Sentinels matched with errors.Is against the errors returned by the client
+var (
+	// ErrTimeout matches requests that timed out
+	ErrTimeout = errors.New("request timed out")
+	// ErrClientStatus matches responses with a 4xx status
+	ErrClientStatus = errors.New("client error status")
+	// ErrServerStatus matches responses with a 5xx status
+	ErrServerStatus = errors.New("server error status")
+)
+
+// Error is returned by the client when the request fails, the response status is
+// not 2xx or the response body cannot be decoded.
+type Error struct {
+	Method string
+	URL    string
+	// StatusCode is zero when there is no response
+	StatusCode int
+	// Body holds the beginning of the response body
+	Body      string
+	RequestID string
+	// Err is the transport or decoding error, nil for an unexpected status
+	Err error
+}
+
+func newError(req *http.Request, status int, body []byte, err error) *Error {
+	// the method and url of a transport error are already in the Error
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	if len(body) > maxErrorBodyLen {
+		body = body[:maxErrorBodyLen]
+	}
+	return &Error{
+		Method:     req.Method,
+		URL:        req.URL.Redacted(),
+		StatusCode: status,
+		Body:       string(body),
+		RequestID:  req.Header.Get(RequestIDHeader),
+		Err:        err,
+	}
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s %s", e.Method, e.URL)
+	if e.StatusCode != 0 {
+		msg += fmt.Sprintf(": status %d", e.StatusCode)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	} else if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches ErrTimeout, ErrClientStatus and ErrServerStatus
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrTimeout:
+		return e.timeout()
+	case ErrClientStatus:
+		return e.StatusCode >= 400 && e.StatusCode < 500
+	case ErrServerStatus:
+		return e.StatusCode >= 500
+	default:
+		return false
+	}
+}
+
+func (e *Error) timeout() bool {
+	if e.Err == nil {
+		return false
+	}
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// IsTimeout reports whether the request timed out
+func IsTimeout(err error) bool {
+	return errors.Is(err, ErrTimeout)
+}
+
+// IsClientError reports whether the response has a 4xx status
+func IsClientError(err error) bool {
+	return errors.Is(err, ErrClientStatus)
+}
+
+// IsServerError reports whether the response has a 5xx status
+func IsServerError(err error) bool {
+	return errors.Is(err, ErrServerStatus)
+}
@@ -0,0 +1,104 @@
+package xhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newStatusServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"id":1}`))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"id":404,"message":"` + strings.Repeat("x", maxErrorBodyLen) + `"}`))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"id":500}`))
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/invalid":
+			_, _ = w.Write([]byte(`not json`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestStatusContract(t *testing.T) {
+	server := newStatusServer(t)
+	c := NewClient(WithSkipLog(true))
+	ctx := context.WithValue(context.Background(), "context_id", "req-1") // nolint: staticcheck
+
+	type output struct {
+		ID int `json:"id"`
+	}
+	requests := map[string]func(path string, out *output) (int, error){
+		"Get": func(path string, out *output) (int, error) {
+			return c.Get(ctx, server.URL+path, out)
+		},
+		"PostJSON": func(path string, out *output) (int, error) {
+			return c.PostJSON(ctx, server.URL+path, map[string]string{}, out)
+		},
+		"SendHTTPRequest": func(path string, out *output) (int, error) {
+			return c.SendHTTPRequest(ctx, http.MethodPost, server.URL+path, map[string]string{}, out)
+		},
+	}
+	for name, request := range requests {
+		var out output
+		status, err := request("/created", &out)
+		require.NoError(t, err, name)
+		assert.Equal(t, http.StatusCreated, status, name)
+		assert.Equal(t, 1, out.ID, name)
+
+		out = output{}
+		status, err = request("/missing", &out)
+		assert.Equal(t, http.StatusNotFound, status, name)
+		assert.True(t, IsClientError(err), name)
+		assert.False(t, IsServerError(err), name)
+		assert.Zero(t, out.ID, "%s does not decode an error response", name)
+		var httpErr *Error
+		require.True(t, errors.As(err, &httpErr), name)
+		assert.Equal(t, server.URL+"/missing", httpErr.URL, name)
+		assert.Equal(t, "req-1", httpErr.RequestID, name)
+		assert.Len(t, httpErr.Body, maxErrorBodyLen, name)
+
+		status, err = request("/broken", &out)
+		assert.Equal(t, http.StatusInternalServerError, status, name)
+		assert.True(t, IsServerError(err), name)
+		assert.Zero(t, out.ID, name)
+
+		status, err = request("/invalid", &out)
+		assert.Equal(t, http.StatusOK, status, name)
+		require.True(t, errors.As(err, &httpErr), name)
+		assert.Equal(t, "not json", httpErr.Body, name)
+		assert.False(t, IsClientError(err) || IsServerError(err), name)
+	}
+}
+
+func TestTransportErrors(t *testing.T) {
+	server := newStatusServer(t)
+	c := NewClient(WithSkipLog(true), WithTimeout(20*time.Millisecond))
+
+	status, err := c.Get(context.Background(), server.URL+"/slow", nil)
+	assert.Zero(t, status)
+	assert.True(t, IsTimeout(err))
+
+	server.Close()
+	status, err = c.SendHTTPRequest(context.Background(), http.MethodGet, server.URL, nil, nil)
+	assert.Zero(t, status)
+	var httpErr *Error
+	require.True(t, errors.As(err, &httpErr))
+	assert.Error(t, httpErr.Err)
+	assert.False(t, IsTimeout(err))
+}
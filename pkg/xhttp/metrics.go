@@ -15,6 +15,9 @@ type outgoingMetrics struct {
 	dnsDuration *prometheus.HistogramVec
 	tlsDuration *prometheus.HistogramVec
 	inflight    prometheus.Gauge
+	// retries and breakerState are only set by the retry and circuit breaker options
+	retries      *prometheus.CounterVec
+	breakerState *prometheus.GaugeVec
 }
 
 // Describe implements prometheus.Collector interface.
@@ -24,6 +27,8 @@ func (i *outgoingMetrics) Describe(in chan<- *prometheus.Desc) {
 	i.dnsDuration.Describe(in)
 	i.tlsDuration.Describe(in)
 	i.inflight.Describe(in)
+	i.retries.Describe(in)
+	i.breakerState.Describe(in)
 }
 
 // Collect implements prometheus.Collector interface.
@@ -33,6 +38,8 @@ func (i *outgoingMetrics) Collect(in chan<- prometheus.Metric) {
 	i.dnsDuration.Collect(in)
 	i.tlsDuration.Collect(in)
 	i.inflight.Collect(in)
+	i.retries.Collect(in)
+	i.breakerState.Collect(in)
 }
 
 func NewOutgoingMetrics(subsystem string, constLabels map[string]string) *outgoingMetrics {
@@ -88,6 +95,26 @@ func NewOutgoingMetrics(subsystem string, constLabels map[string]string) *outgoi
 			Help:        "A gauge of in-flight outgoing requests for the wrapped client.",
 			ConstLabels: constLabels,
 		}),
+		retries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace:   namespace,
+				Subsystem:   subsystem,
+				Name:        "http_outgoing_retries_total",
+				Help:        "A counter for retried outgoing requests.",
+				ConstLabels: constLabels,
+			},
+			[]string{"method", "path"},
+		),
+		breakerState: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace:   namespace,
+				Subsystem:   subsystem,
+				Name:        "http_outgoing_circuit_breaker_state",
+				Help:        "State of the circuit breaker of each host, 0 closed, 1 open and 2 half open.",
+				ConstLabels: constLabels,
+			},
+			[]string{"host"},
+		),
 	}
 }
 
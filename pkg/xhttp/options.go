@@ -2,6 +2,7 @@ package xhttp
 
 import (
 	"crypto/tls"
+	"message-core/pkg/breaker"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,6 +17,8 @@ type clientOptions struct {
 	promCfg           PromConfig
 	tlsClientConfig   *tls.Config
 	forceAttemptHTTP2 bool
+	retry             *RetryPolicy
+	breaker           *breaker.Config
 }
 
 type PromConfig struct {
@@ -111,3 +114,19 @@ func WithForceAttemptHTTP2(forceAttemptHTTP2 bool) Option {
 		args.forceAttemptHTTP2 = forceAttemptHTTP2
 	})
 }
+
+// WithRetry retries the requests failing with a network error or a retryable status,
+// each attempt is subject to the circuit breaker.
+func WithRetry(policy RetryPolicy) Option {
+	return optionFunc(func(args *clientOptions) {
+		args.retry = &policy
+	})
+}
+
+// WithCircuitBreaker rejects the requests to a host with ErrCircuitOpen after
+// cfg.Threshold consecutive network errors or 5xx responses.
+func WithCircuitBreaker(cfg breaker.Config) Option {
+	return optionFunc(func(args *clientOptions) {
+		args.breaker = &cfg
+	})
+}
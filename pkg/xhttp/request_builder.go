@@ -3,10 +3,7 @@ package xhttp
 import (
 	"bytes"
 	"context"
-	"encoding/json"
 	"net/http"
-
-	"github.com/gin-gonic/gin/binding"
 )
 
 const contentTypeField = "Content-Type"
@@ -36,10 +33,11 @@ func (b *builder) WithMethod(method string) *builder {
 	return b
 }
 
+// WithBody sets the body encoded by the codec registered for contentType, JSON when it is empty.
+// The Content-Type header is the encoded type unless it is set with WithHeaders.
 func (b *builder) WithBody(contentType string, data interface{}) *builder {
 	b.contentType = contentType
 	b.bodyData = data
-	b.headers[contentTypeField] = contentType
 	return b
 }
 
@@ -62,7 +60,7 @@ func (b *builder) Build() (req *http.Request, err error) {
 	if b.method == http.MethodGet {
 		return b.buildGetRequest()
 	}
-	bodyByte, err := b.buildBody()
+	bodyByte, contentType, err := encodeBody(b.contentType, b.bodyData)
 	if err != nil {
 		return nil, err
 	}
@@ -73,6 +71,7 @@ func (b *builder) Build() (req *http.Request, err error) {
 	for k, v := range b.headers {
 		req.Header.Set(k, v)
 	}
+	req.Header.Set(contentTypeField, requestContentType(req.Header.Get(contentTypeField), contentType))
 	return req, nil
 }
 
@@ -86,15 +85,3 @@ func (b *builder) buildGetRequest() (req *http.Request, err error) {
 	}
 	return
 }
-
-func (b *builder) buildBody() ([]byte, error) {
-	switch b.contentType {
-	case binding.MIMEJSON:
-		return json.Marshal(b.bodyData)
-	case binding.MIMEPOSTForm:
-		//TODO: transform bodyData to bodyData by form-urlencoded
-		return nil, nil
-	default:
-		return json.Marshal(b.bodyData)
-	}
-}
@@ -0,0 +1,174 @@
+package xhttp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"message-core/pkg/breaker"
+	"message-core/pkg/retry"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryStatusCodes are the statuses retried when RetryPolicy.StatusCodes is empty
+var DefaultRetryStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DefaultRetryMethods are the idempotent methods retried when RetryPolicy.Methods is empty
+var DefaultRetryMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodOptions,
+	http.MethodTrace,
+	http.MethodPut,
+	http.MethodDelete,
+}
+
+// RetryPolicy retries the requests failing with a network error or a retryable status
+type RetryPolicy struct {
+	retry.Policy
+	// StatusCodes are the retried statuses, DefaultRetryStatusCodes when empty
+	StatusCodes []int
+	// Methods are the retried methods, DefaultRetryMethods when empty
+	Methods []string
+	// MaxRetryAfter is the longest Retry-After honored, a response asking to wait
+	// longer is returned without retry. No limit when zero.
+	MaxRetryAfter time.Duration
+}
+
+func (p RetryPolicy) retriesMethod(method string) bool {
+	methods := p.Methods
+	if len(methods) == 0 {
+		methods = DefaultRetryMethods
+	}
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) retriesStatus(status int) bool {
+	statuses := p.StatusCodes
+	if len(statuses) == 0 {
+		statuses = DefaultRetryStatusCodes
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type retryTransport struct {
+	policy  RetryPolicy
+	next    http.RoundTripper
+	metrics *outgoingMetrics
+	now     func() time.Time
+}
+
+func newRetryTransport(policy RetryPolicy, next http.RoundTripper, metrics *outgoingMetrics) http.RoundTripper {
+	return &retryTransport{policy: policy, next: next, metrics: metrics, now: time.Now}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.policy.Attempts <= 1 || !t.policy.retriesMethod(req.Method) {
+		return t.next.RoundTrip(req)
+	}
+	getBody, err := replayableBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		attemptReq := req.Clone(ctx)
+		if getBody != nil {
+			if attemptReq.Body, err = getBody(); err != nil {
+				return nil, err
+			}
+			attemptReq.GetBody = getBody
+		}
+
+		resp, err := t.next.RoundTrip(attemptReq)
+		if attempt >= t.policy.Attempts || ctx.Err() != nil || !t.retryable(resp, err) {
+			return resp, err
+		}
+
+		delay := t.policy.Delay(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.now()); ok {
+				if t.policy.MaxRetryAfter > 0 && retryAfter > t.policy.MaxRetryAfter {
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+			// the connection is reused once the body is read
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		if t.metrics != nil {
+			t.metrics.retries.WithLabelValues(req.Method, extractGroupPath(req)).Inc()
+		}
+		if err := retry.Sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (t *retryTransport) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, breaker.ErrOpen) && !errors.Is(err, context.Canceled)
+	}
+	return t.policy.retriesStatus(resp.StatusCode)
+}
+
+// replayableBody returns a function returning a new copy of the request body,
+// the body is read in memory when the request cannot recreate it.
+func replayableBody(req *http.Request) (func() (io.ReadCloser, error), error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		return req.GetBody, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	_ = req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}, nil
+}
+
+// parseRetryAfter parses a Retry-After header holding seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
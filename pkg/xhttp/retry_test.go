@@ -0,0 +1,103 @@
+package xhttp
+
+import (
+	"context"
+	"io/ioutil"
+	"message-core/pkg/retry"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{Policy: retry.Policy{Attempts: 3, BaseDelay: time.Millisecond}}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	var calls int32
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	policy := testRetryPolicy()
+	policy.Methods = []string{http.MethodPut}
+	promCfg := NewBasePromConfig("retry_test", "test")
+	promCfg.Register = prometheus.NewRegistry()
+	c := NewClient(WithSkipLog(true), WithRetry(policy), WithPromConfig(promCfg))
+
+	var out struct{ OK bool }
+	status, err := c.SendHTTPRequest(context.Background(), http.MethodPut, server.URL, map[string]string{"a": "b"}, &out,
+		RequestOption{Header: map[string]string{contentTypeField: MIMEJSON}})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, out.OK)
+	assert.Equal(t, []string{`{"a":"b"}`, `{"a":"b"}`, `{"a":"b"}`}, bodies)
+
+	metrics := c.(*client).client.Transport.(*Transport).transport.(*retryTransport).metrics
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.retries))
+}
+
+func TestRetrySkipsNonIdempotentMethods(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := NewClient(WithSkipLog(true), WithRetry(testRetryPolicy()))
+	status, _ := c.PostJSON(context.Background(), server.URL, map[string]string{}, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	status, _ = c.Get(context.Background(), server.URL, nil)
+	assert.Equal(t, http.StatusServiceUnavailable, status, "the last response is returned")
+	assert.EqualValues(t, 4, atomic.LoadInt32(&calls))
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	policy := testRetryPolicy()
+	policy.MaxRetryAfter = time.Minute
+	c := NewClient(WithSkipLog(true), WithRetry(policy))
+	status, _ := c.Get(context.Background(), server.URL, nil)
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&calls), "a longer Retry-After than allowed is not retried")
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for value, expected := range map[string]time.Duration{
+		"3": 3 * time.Second,
+		now.Add(time.Minute).Format(http.TimeFormat):  time.Minute,
+		now.Add(-time.Minute).Format(http.TimeFormat): 0,
+	} {
+		delay, ok := parseRetryAfter(value, now)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, delay, value)
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok := parseRetryAfter(value, now)
+		assert.False(t, ok, value)
+	}
+}
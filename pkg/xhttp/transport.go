@@ -50,16 +50,24 @@ func getTransport(opts clientOptions) http.RoundTripper {
 		transport = transportTemp
 	}
 
-	if !opts.promCfg.Enable {
-		return transport
+	var metrics *outgoingMetrics
+	if opts.promCfg.Enable {
+		promCfg := opts.promCfg
+		metrics = NewOutgoingMetrics(promCfg.Subsystem, promCfg.ConstLabel)
+		transport = buildTraceTransport(transport, metrics)
+		if err := promCfg.Register.Register(metrics); err != nil {
+			logrus.WithField("failed to register http outgoing metrics error: ", err).WithError(err).Error()
+		}
+	}
+
+	// every attempt of a retried request goes through the breaker and is measured
+	if opts.breaker != nil {
+		transport = newBreakerTransport(*opts.breaker, transport, metrics)
 	}
-	promCfg := opts.promCfg
-	metrics := NewOutgoingMetrics(promCfg.Subsystem, promCfg.ConstLabel)
-	promTransport := buildTraceTransport(transport, metrics)
-	if err := promCfg.Register.Register(metrics); err != nil {
-		logrus.WithField("failed to register http outgoing metrics error: ", err).WithError(err).Error()
+	if opts.retry != nil {
+		transport = newRetryTransport(*opts.retry, transport, metrics)
 	}
-	return promTransport
+	return transport
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (res *http.Response, err error) {
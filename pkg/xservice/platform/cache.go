@@ -2,17 +2,151 @@ package platform
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"message-core/pkg/ruleengine"
 	"message-core/redis"
+	"sync"
 	"time"
 
+	goredis "github.com/go-redis/redis/v8"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	cachePrefix      = "platform:"
+	credentialsCache = cachePrefix + "credentials:"
+	rulesCache       = cachePrefix + "rules:"
+
+	defaultCacheTTL         = 5 * time.Minute
+	defaultNegativeCacheTTL = 30 * time.Second
+	defaultFallbackCacheTTL = 24 * time.Hour
+)
+
+// states of the cached validations
+const (
+	UserStateValidated = "Validated"
+	UserStateInvalid   = "Invalid"
+)
+
 type UserCacheModel struct {
-	UserState string         `json:"is_valid"`
-	Rules     []RulesDevices `json:"rules"`
+	UserState     string            `json:"is_valid"`
+	Rules         []RulesDevices    `json:"rules"`
+	AdvancedRules []ruleengine.Rule `json:"advanced_rules,omitempty"`
+}
+
+var (
+	// cacheDB returns the redis client holding the cache
+	cacheDB = redis.GetRedisClient
+
+	cacheKeyMu sync.RWMutex
+	cacheKey   []byte
+
+	// cacheTTL applies to validated credentials and rules, negativeCacheTTL to invalid credentials
+	cacheTTL         = defaultCacheTTL
+	negativeCacheTTL = defaultNegativeCacheTTL
+	// fallbackCacheTTL applies to the validated credentials accepted in fail open mode
+	fallbackCacheTTL = defaultFallbackCacheTTL
+)
+
+// SetCacheTTL sets how long validated and invalid results are cached, zero keeps the default
+func SetCacheTTL(positive, negative time.Duration) {
+	if positive > 0 {
+		cacheTTL = positive
+	}
+	if negative > 0 {
+		negativeCacheTTL = negative
+	}
+}
+
+// SetCacheKey sets the secret keying the hash of the cached credentials,
+// a random key is used when it is empty so the cache is not shared with other instances.
+func SetCacheKey(key string) {
+	secret := []byte(key)
+	if len(secret) == 0 {
+		logrus.Warn("PLATFORM_CACHE_KEY is not set, the credentials cache is not shared between instances")
+		secret = randomCacheKey()
+	}
+
+	cacheKeyMu.Lock()
+	defer cacheKeyMu.Unlock()
+	cacheKey = secret
+}
+
+func randomCacheKey() []byte {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		logrus.WithError(err).Fatal("failed to generate the credentials cache key")
+	}
+	return secret
+}
+
+// getCacheKey returns the secret keying the hashes, a random one until SetCacheKey is called
+func getCacheKey() []byte {
+	cacheKeyMu.RLock()
+	secret := cacheKey
+	cacheKeyMu.RUnlock()
+	if secret != nil {
+		return secret
+	}
+
+	cacheKeyMu.Lock()
+	defer cacheKeyMu.Unlock()
+	if cacheKey == nil {
+		cacheKey = randomCacheKey()
+	}
+	return cacheKey
+}
+
+// hash returns the keyed hash of the parts, each part is length prefixed
+// so the parts ("ab", "c") and ("a", "bc") do not collide.
+func hash(parts ...string) string {
+	mac := hmac.New(sha256.New, getCacheKey())
+	var size [8]byte
+	for _, part := range parts {
+		binary.BigEndian.PutUint64(size[:], uint64(len(part)))
+		mac.Write(size[:])
+		mac.Write([]byte(part))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// userKey returns the key segment of the user, hashed so it is safe in key patterns
+func userKey(userName string) string {
+	return hash("user", userName)
+}
+
+// credentialsKey returns the key of the cached credentials,
+// the keys of a user share the prefix credentialsCache + userKey.
+func credentialsKey(userName, password string) string {
+	return credentialsCache + userKey(userName) + ":" + hash("credentials", userName, password)
+}
+
+// fallbackKey returns the key of the long lived copy of validated credentials used
+// while the platform is unavailable, it is evicted with the other credentials of the user.
+func fallbackKey(userName, password string) string {
+	return credentialsKey(userName, password) + ":fallback"
+}
+
+func rulesKey(userName string) string {
+	return rulesCache + userKey(userName)
+}
+
+// lastRulesKey returns the key of the last known rules of the user, served once
+// the rules expired until they are fetched again
+func lastRulesKey(userName string) string {
+	return rulesKey(userName) + ":last"
+}
+
+// invalidatedRulesKey returns the key marking the rules of the user as evicted by an
+// invalidation, until they are fetched again
+func invalidatedRulesKey(userName string) string {
+	return rulesKey(userName) + ":invalidated"
 }
 
 func SetUserCache(
@@ -21,16 +155,7 @@ func SetUserCache(
 	password string,
 	req UserCacheModel,
 ) error {
-	data, _ := json.Marshal(req)
-	cmd := redis.GetRedisClient().Set(
-		ctx,
-		fmt.Sprintf("%s-%s", userName, password),
-		data, 5*time.Minute)
-	_, err := cmd.Result()
-	if err != nil {
-		return nil
-	}
-	return nil
+	return setCache(ctx, credentialsKey(userName, password), req)
 }
 
 // get cache not return error
@@ -39,42 +164,39 @@ func GetUserCache(
 	userName string,
 	password string,
 ) (resp UserCacheModel, err error) {
-	cmd := redis.GetRedisClient().Get(
-		ctx,
-		fmt.Sprintf("%s-%s", userName, password))
-	data, err := cmd.Result()
-	if err != nil {
-		logrus.WithError(err).
-			WithField("GetRedisClient",
-				fmt.Sprintf("%s-%s", userName, password)).Error()
-		return resp, nil
-	}
-	if len(data) == 0 {
-		return
-	}
-	err = json.Unmarshal([]byte(data), &resp)
-	if err != nil {
-		return resp, nil
-	}
+	return getCache(ctx, credentialsKey(userName, password), userName)
+}
 
-	return
+// setFallbackCache keeps validated credentials for the degraded mode
+func setFallbackCache(ctx context.Context, userName, password string, req UserCacheModel) error {
+	return setCacheTTL(ctx, fallbackKey(userName, password), req, fallbackCacheTTL)
 }
 
+func getFallbackCache(ctx context.Context, userName, password string) (UserCacheModel, error) {
+	return getCache(ctx, fallbackKey(userName, password), userName)
+}
+
+// SetRuleCache caches the rules of the user, validated rules are also kept as the last
+// known rules and end an invalidation of the rules
 func SetRuleCache(
 	ctx context.Context,
 	userName string,
 	req UserCacheModel,
 ) error {
-	data, _ := json.Marshal(req)
-	cmd := redis.GetRedisClient().Set(
-		ctx,
-		userName,
-		data, 5*time.Minute)
-	_, err := cmd.Result()
+	if req.UserState != UserStateValidated {
+		return setCache(ctx, rulesKey(userName), req)
+	}
+
+	data, err := json.Marshal(req)
 	if err != nil {
-		return nil
+		return err
 	}
-	return nil
+	pipe := cacheDB().TxPipeline()
+	pipe.Set(ctx, rulesKey(userName), data, cacheTTL)
+	pipe.Set(ctx, lastRulesKey(userName), data, fallbackCacheTTL)
+	pipe.Del(ctx, invalidatedRulesKey(userName))
+	_, err = pipe.Exec(ctx)
+	return err
 }
 
 // get cache not return error
@@ -82,23 +204,101 @@ func GetRuleCache(
 	ctx context.Context,
 	userName string,
 ) (resp UserCacheModel, err error) {
-	cmd := redis.GetRedisClient().Get(
-		ctx,
-		userName,
-	)
-	data, err := cmd.Result()
+	return getCache(ctx, rulesKey(userName), userName)
+}
+
+// InvalidateCredentials removes the cached validation of the credentials
+func InvalidateCredentials(ctx context.Context, userName, password string) error {
+	return cacheDB().Del(ctx, credentialsKey(userName, password), fallbackKey(userName, password)).Err()
+}
+
+// getRuleCaches returns the cached rules, the last known rules and whether an invalidation
+// evicted the rules of the user, with a single call to redis
+func getRuleCaches(ctx context.Context, userName string) (rules, last UserCacheModel, invalidated bool, err error) {
+	values, err := cacheDB().MGet(ctx, rulesKey(userName), lastRulesKey(userName), invalidatedRulesKey(userName)).Result()
 	if err != nil {
-		logrus.WithError(err).
-			WithField("GetRedisClient", userName).Error()
-		return resp, nil
-	}
-	if len(data) == 0 {
 		return
 	}
-	err = json.Unmarshal([]byte(data), &resp)
+	decode := func(value any, model *UserCacheModel) {
+		if data, ok := value.(string); ok {
+			_ = json.Unmarshal([]byte(data), model)
+		}
+	}
+	decode(values[0], &rules)
+	decode(values[1], &last)
+	return rules, last, values[2] != nil, nil
+}
+
+// InvalidateRules removes the cached rules of the user and marks them invalidated
+func InvalidateRules(ctx context.Context, userName string) error {
+	if err := markRulesInvalidated(ctx, userName); err != nil {
+		return err
+	}
+	return cacheDB().Del(ctx, rulesKey(userName), lastRulesKey(userName)).Err()
+}
+
+// markRulesInvalidated marks the rules invalidated before they are removed,
+// so no publish reads the rules of the user as never cached
+func markRulesInvalidated(ctx context.Context, userName string) error {
+	return cacheDB().Set(ctx, invalidatedRulesKey(userName), 1, fallbackCacheTTL).Err()
+}
+
+// InvalidateUserCredentials removes the cached validations of every password of the user
+func InvalidateUserCredentials(ctx context.Context, userName string) error {
+	return deleteKeys(ctx, nil, credentialsCache+userKey(userName)+":*")
+}
+
+// InvalidateUser removes the cached validations of every password of the user and its rules
+func InvalidateUser(ctx context.Context, userName string) error {
+	if err := markRulesInvalidated(ctx, userName); err != nil {
+		return err
+	}
+	return deleteKeys(ctx, []string{rulesKey(userName), lastRulesKey(userName)}, credentialsCache+userKey(userName)+":*")
+}
+
+// deleteKeys deletes the keys and the keys matching pattern
+func deleteKeys(ctx context.Context, keys []string, pattern string) error {
+	db := cacheDB()
+	iter := db.Scan(ctx, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return db.Del(ctx, keys...).Err()
+}
+
+func setCache(ctx context.Context, key string, req UserCacheModel) error {
+	ttl := cacheTTL
+	if req.UserState == UserStateInvalid {
+		ttl = negativeCacheTTL
+	}
+	return setCacheTTL(ctx, key, req, ttl)
+}
+
+func setCacheTTL(ctx context.Context, key string, req UserCacheModel, ttl time.Duration) error {
+	data, err := json.Marshal(req)
 	if err != nil {
-		return resp, nil
+		return err
 	}
+	return cacheDB().Set(ctx, key, data, ttl).Err()
+}
 
-	return
+// getCache returns an empty model when the entry is missing or unreadable
+func getCache(ctx context.Context, key, userName string) (resp UserCacheModel, err error) {
+	data, err := cacheDB().Get(ctx, key).Bytes()
+	if err != nil {
+		if !errors.Is(err, goredis.Nil) {
+			logrus.WithError(err).WithField("PLATFORM_CACHE_ERROR", userName).Error()
+		}
+		return resp, nil
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return UserCacheModel{}, nil
+	}
+	return resp, nil
 }
@@ -0,0 +1,122 @@
+package platform
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	miniredis "github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testUser     = "device1"
+	testPassword = "s3cr3t-passw0rd"
+)
+
+func newTestCache(t *testing.T) *miniredis.Miniredis {
+	mr := miniredis.RunT(t)
+	db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.Close() })
+
+	cacheDB = func() *goredis.Client { return db }
+	SetCacheKey("test-key")
+	// the rules fetched in the background are not written to the cache of the next test
+	t.Cleanup(func() { waitForRefresh(t) })
+	return mr
+}
+
+// waitForRefresh waits until the rules fetched in the background are cached
+func waitForRefresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, Drain(ctx))
+}
+
+func validated() UserCacheModel {
+	return UserCacheModel{
+		UserState: "Validated",
+		Rules:     []RulesDevices{{Atribute: "temp", Comparison: "<", RuleValue: "50"}},
+	}
+}
+
+// assertNoPassword checks neither the keys nor the values stored in redis contain the password
+func assertNoPassword(t *testing.T, mr *miniredis.Miniredis) {
+	for _, key := range mr.Keys() {
+		assert.NotContains(t, key, testPassword)
+		value, err := mr.Get(key)
+		require.NoError(t, err)
+		assert.NotContains(t, value, testPassword)
+	}
+}
+
+func TestUserCache(t *testing.T) {
+	mr := newTestCache(t)
+	ctx := context.Background()
+
+	require.NoError(t, SetUserCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, SetRuleCache(ctx, testUser, validated()))
+	assert.Len(t, mr.Keys(), 3, "credentials, rules and last known rules")
+	assertNoPassword(t, mr)
+	for _, key := range mr.Keys() {
+		assert.NotContains(t, key, testUser, "user names are hashed too")
+	}
+
+	cached, err := GetUserCache(ctx, testUser, testPassword)
+	require.NoError(t, err)
+	assert.Equal(t, validated(), cached)
+
+	cached, err = GetUserCache(ctx, testUser, "wrong")
+	require.NoError(t, err)
+	assert.Empty(t, cached.UserState)
+
+	// another key does not find the entries
+	SetCacheKey("other-key")
+	cached, err = GetUserCache(ctx, testUser, testPassword)
+	require.NoError(t, err)
+	assert.Empty(t, cached.UserState)
+}
+
+func TestCacheKeysDoNotCollide(t *testing.T) {
+	newTestCache(t)
+
+	assert.NotEqual(t, credentialsKey("ab", "c"), credentialsKey("a", "bc"))
+	assert.True(t, strings.HasPrefix(credentialsKey("ab", "c"), credentialsCache+userKey("ab")+":"))
+}
+
+func TestInvalidateCache(t *testing.T) {
+	mr := newTestCache(t)
+	ctx := context.Background()
+
+	require.NoError(t, SetUserCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, SetUserCache(ctx, testUser, "old-password", validated()))
+	require.NoError(t, SetUserCache(ctx, "device2", testPassword, validated()))
+	require.NoError(t, SetRuleCache(ctx, testUser, validated()))
+	assertNoPassword(t, mr)
+
+	require.NoError(t, InvalidateCredentials(ctx, testUser, "old-password"))
+	assert.Len(t, mr.Keys(), 4)
+
+	require.NoError(t, InvalidateRules(ctx, testUser))
+	cached, err := GetRuleCache(ctx, testUser)
+	require.NoError(t, err)
+	assert.Empty(t, cached.UserState)
+	assert.False(t, mr.Exists(lastRulesKey(testUser)))
+	assert.True(t, mr.Exists(invalidatedRulesKey(testUser)))
+
+	require.NoError(t, SetRuleCache(ctx, testUser, validated()))
+	assert.False(t, mr.Exists(invalidatedRulesKey(testUser)), "the fetched rules end the invalidation")
+	require.NoError(t, InvalidateUser(ctx, testUser))
+	cached, err = GetUserCache(ctx, testUser, testPassword)
+	require.NoError(t, err)
+	assert.Empty(t, cached.UserState)
+
+	// the entries of the other users are kept
+	cached, err = GetUserCache(ctx, "device2", testPassword)
+	require.NoError(t, err)
+	assert.Equal(t, "Validated", cached.UserState)
+	assert.Equal(t, []string{credentialsKey("device2", testPassword), invalidatedRulesKey(testUser)}, mr.Keys())
+}
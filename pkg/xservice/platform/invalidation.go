@@ -0,0 +1,126 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"message-core/pkg/retry"
+	"sync"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+// types of the invalidation events, an event without type evicts both
+const (
+	// InvalidationCredentials evicts the cached validations of every password of the user
+	InvalidationCredentials = "credentials"
+	// InvalidationRules evicts the cached rules of the user, and its cached validations
+	// which carry a copy of the rules restored on the next connection
+	InvalidationRules = "rules"
+)
+
+var (
+	errMissingUsername         = errors.New("invalidation event without username")
+	errInvalidInvalidationType = errors.New("invalid invalidation event type")
+)
+
+// InvalidationEvent is sent by the platform when the credentials or the rules of a user change
+type InvalidationEvent struct {
+	Username string `json:"username"`
+	Type     string `json:"type,omitempty"`
+}
+
+// ParseInvalidation reads an invalidation event
+func ParseInvalidation(data []byte) (event InvalidationEvent, err error) {
+	if err = json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	if len(event.Username) == 0 {
+		return event, errMissingUsername
+	}
+	switch event.Type {
+	case "", InvalidationCredentials, InvalidationRules:
+	default:
+		return event, errInvalidInvalidationType
+	}
+	return
+}
+
+// Apply evicts the cache entries of the event, the cache is shared by the instances
+// so an event is applied by any of them.
+func (e InvalidationEvent) Apply(ctx context.Context) error {
+	if e.Type == InvalidationCredentials {
+		return InvalidateUserCredentials(ctx, e.Username)
+	}
+	return InvalidateUser(ctx, e.Username)
+}
+
+// HandleInvalidationMessage applies the invalidation event of a kafka message,
+// malformed events are not retried.
+func HandleInvalidationMessage(ctx context.Context, m kafka.Message) error {
+	event, err := ParseInvalidation(m.Value)
+	if err != nil {
+		return retry.Permanent(err)
+	}
+	if err := event.Apply(ctx); err != nil {
+		return err
+	}
+	logrus.WithField("Platform cache invalidated", event.Username).WithField("Type", event.Type).Info()
+	return nil
+}
+
+// InvalidationListener applies the invalidation events published on a redis pub/sub channel
+type InvalidationListener struct {
+	db      *goredis.Client
+	channel string
+	sub     *goredis.PubSub
+	wg      sync.WaitGroup
+}
+
+// NewInvalidationListener create new listener of the channel
+func NewInvalidationListener(db *goredis.Client, channel string) *InvalidationListener {
+	return &InvalidationListener{db: db, channel: channel}
+}
+
+// Start subscribes to the channel and applies the events until Close
+func (l *InvalidationListener) Start(ctx context.Context) error {
+	l.sub = l.db.Subscribe(ctx, l.channel)
+	// wait for the subscription so no event published after Start is missed
+	if _, err := l.sub.Receive(ctx); err != nil {
+		l.sub.Close()
+		return err
+	}
+
+	l.wg.Add(1)
+	go l.receive()
+	return nil
+}
+
+// Close stops applying events
+func (l *InvalidationListener) Close() error {
+	if l.sub == nil {
+		return nil
+	}
+	err := l.sub.Close()
+	l.wg.Wait()
+	return err
+}
+
+func (l *InvalidationListener) receive() {
+	defer l.wg.Done()
+
+	for msg := range l.sub.Channel() {
+		event, err := ParseInvalidation([]byte(msg.Payload))
+		if err != nil {
+			logrus.WithField("PLATFORM_INVALID_INVALIDATION", msg.Payload).WithError(err).Warn()
+			continue
+		}
+		if err := event.Apply(context.Background()); err != nil {
+			logrus.WithField("PLATFORM_INVALIDATION_ERROR", event.Username).WithError(err).Error()
+			continue
+		}
+		logrus.WithField("Platform cache invalidated", event.Username).WithField("Type", event.Type).Info()
+	}
+}
@@ -0,0 +1,88 @@
+package platform
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInvalidation(t *testing.T) {
+	event, err := ParseInvalidation([]byte(`{"username":"device1","type":"rules"}`))
+	require.NoError(t, err)
+	assert.Equal(t, InvalidationEvent{Username: "device1", Type: InvalidationRules}, event)
+
+	_, err = ParseInvalidation([]byte(`{"type":"rules"}`))
+	assert.ErrorIs(t, err, errMissingUsername)
+	_, err = ParseInvalidation([]byte(`{"username":"device1","type":"devices"}`))
+	assert.ErrorIs(t, err, errInvalidInvalidationType)
+	_, err = ParseInvalidation([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestCacheTTL(t *testing.T) {
+	mr := newTestCache(t)
+	defer SetCacheTTL(defaultCacheTTL, defaultNegativeCacheTTL)
+	SetCacheTTL(time.Hour, 10*time.Second)
+	ctx := context.Background()
+
+	require.NoError(t, SetUserCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, SetUserCache(ctx, testUser, "wrong", UserCacheModel{UserState: UserStateInvalid}))
+	require.NoError(t, SetRuleCache(ctx, testUser, validated()))
+
+	assert.Equal(t, time.Hour, mr.TTL(credentialsKey(testUser, testPassword)))
+	assert.Equal(t, 10*time.Second, mr.TTL(credentialsKey(testUser, "wrong")))
+	assert.Equal(t, time.Hour, mr.TTL(rulesKey(testUser)))
+	assert.Equal(t, defaultFallbackCacheTTL, mr.TTL(lastRulesKey(testUser)))
+}
+
+func TestInvalidationEvents(t *testing.T) {
+	mr := newTestCache(t)
+	ctx := context.Background()
+
+	require.NoError(t, SetUserCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, SetRuleCache(ctx, testUser, validated()))
+
+	require.NoError(t, InvalidationEvent{Username: testUser, Type: InvalidationCredentials}.Apply(ctx))
+	assert.False(t, mr.Exists(credentialsKey(testUser, testPassword)))
+	assert.True(t, mr.Exists(rulesKey(testUser)))
+
+	require.NoError(t, SetUserCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, HandleInvalidationMessage(ctx, kafka.Message{
+		Value: []byte(`{"username":"device1","type":"rules"}`),
+	}))
+	assert.Equal(t, []string{invalidatedRulesKey(testUser)}, mr.Keys(),
+		"rules events evict the validations carrying the rules")
+
+	err := HandleInvalidationMessage(ctx, kafka.Message{Value: []byte(`{}`)})
+	var permanent interface{ Unwrap() error }
+	assert.True(t, errors.As(err, &permanent), "malformed events are not retried")
+}
+
+func TestInvalidationListener(t *testing.T) {
+	mr := newTestCache(t)
+	ctx := context.Background()
+	db := goredis.NewClient(&goredis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { db.Close() })
+
+	listener := NewInvalidationListener(db, "test-invalidation")
+	require.NoError(t, listener.Start(ctx))
+	t.Cleanup(func() { listener.Close() })
+
+	require.NoError(t, SetUserCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, SetUserCache(ctx, "device2", testPassword, validated()))
+	require.NoError(t, SetRuleCache(ctx, testUser, validated()))
+
+	require.NoError(t, db.Publish(ctx, "test-invalidation", `not json`).Err())
+	require.NoError(t, db.Publish(ctx, "test-invalidation", `{"username":"device1"}`).Err())
+	require.Eventually(t, func() bool {
+		return !mr.Exists(rulesKey(testUser))
+	}, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{credentialsKey("device2", testPassword), invalidatedRulesKey(testUser)}, mr.Keys())
+	assert.True(t, mr.Exists(credentialsKey("device2", testPassword)))
+}
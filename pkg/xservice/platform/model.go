@@ -1,5 +1,7 @@
 package platform
 
+import "message-core/pkg/ruleengine"
+
 type GatewayValidationRequest struct {
 	UserName string `json:"user_name"`
 	Password string `json:"password"`
@@ -14,7 +16,8 @@ type PlatformBaseResponse struct {
 }
 
 type RulesDevicesResponse struct {
-	RulesDevices []RulesDevices `json:"rules"`
+	RulesDevices  []RulesDevices    `json:"rules"`
+	AdvancedRules []ruleengine.Rule `json:"advanced_rules"`
 }
 
 type RulesDevices struct {
@@ -3,61 +3,364 @@ package platform
 import (
 	"context"
 	"errors"
+	"fmt"
+	"message-core/pkg/breaker"
+	"message-core/pkg/config"
+	"message-core/pkg/retry"
 	"message-core/pkg/xhttp"
-	"os"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// degraded modes, how connections are validated while the platform is unavailable
+const (
+	// FailClosed rejects every connection
+	FailClosed = "fail_closed"
+	// FailOpen accepts the credentials validated within the fallback cache ttl
+	FailOpen = "fail_open"
+)
+
+var (
+	// ErrUnavailable is returned when the platform could not validate the credentials
+	ErrUnavailable = errors.New("platform is unavailable")
+	// ErrRulesUnavailable is returned in fail closed mode while the rules evicted by an
+	// invalidation are not fetched again
+	ErrRulesUnavailable = errors.New("rules are unavailable")
 )
 
+// Options of the platform client
+type Options struct {
+	BaseURL string
+	// Timeout applies to each call
+	Timeout time.Duration
+	// Retry applies to the calls failing with a network error or a status other than 200, 401 and 403
+	Retry   retry.Policy
+	Breaker breaker.Config
+	// DegradedMode is FailClosed or FailOpen
+	DegradedMode string
+	// FallbackCacheTTL is how long validated credentials are accepted in fail open mode,
+	// and how long the last known rules are served once expired
+	FallbackCacheTTL time.Duration
+	// ServiceToken authenticates the instance fetching the rules of a user, the rules
+	// are only fetched with the user validation when it is empty
+	ServiceToken string
+}
+
 var (
-	httpClient xhttp.Client
-	baseUrl    string
+	httpClient   xhttp.Client
+	baseUrl      string
+	retryPolicy  retry.Policy
+	circuit      = breaker.New(breaker.Config{})
+	degradedMode = FailClosed
+	serviceToken string
+	// refreshing holds the users whose rules are being fetched, refreshes counts the fetches
+	refreshing sync.Map
+	refreshes  sync.WaitGroup
 )
 
 func NewClien() {
-	httpClient = xhttp.NewClient()
-	baseUrl = os.Getenv("PLATFORM_BASE_URL")
+	platformCfg := config.PlatformConfig()
+	SetCacheKey(platformCfg.CacheKey)
+	SetCacheTTL(
+		time.Duration(platformCfg.CacheTTL)*time.Second,
+		time.Duration(platformCfg.NegativeCacheTTL)*time.Second,
+	)
+	Configure(Options{
+		BaseURL: platformCfg.BaseURL,
+		Timeout: time.Duration(platformCfg.Timeout) * time.Second,
+		Retry: retry.Policy{
+			Attempts:  platformCfg.RetryAttempts,
+			BaseDelay: time.Duration(platformCfg.RetryDelay) * time.Millisecond,
+			MaxDelay:  time.Duration(platformCfg.RetryMaxDelay) * time.Millisecond,
+		},
+		Breaker: breaker.Config{
+			Threshold:   platformCfg.BreakerThreshold,
+			OpenTimeout: time.Duration(platformCfg.BreakerTimeout) * time.Second,
+		},
+		DegradedMode:     platformCfg.DegradedMode,
+		FallbackCacheTTL: time.Duration(platformCfg.DegradedCacheTTL) * time.Second,
+		ServiceToken:     platformCfg.ServiceToken,
+	})
+}
+
+// Configure creates the platform client
+func Configure(opts Options) {
+	// the request bodies carry the device credentials, they are not logged
+	xopts := []xhttp.Option{xhttp.WithBaseProm("platform", "platform"), xhttp.WithSkipLog(true)}
+	if opts.Timeout > 0 {
+		xopts = append(xopts, xhttp.WithTimeout(opts.Timeout))
+	}
+	httpClient = xhttp.NewClient(xopts...)
+	baseUrl = opts.BaseURL
+	retryPolicy = opts.Retry
+	serviceToken = opts.ServiceToken
+
+	circuit = breaker.New(opts.Breaker)
+	circuit.OnStateChange(func(from, to breaker.State) {
+		logrus.WithField("PLATFORM_CIRCUIT_BREAKER", to.String()).Warnf("platform circuit breaker changed from %s", from)
+	})
+
+	switch opts.DegradedMode {
+	case FailOpen, FailClosed:
+		degradedMode = opts.DegradedMode
+	case "":
+		degradedMode = FailClosed
+	default:
+		logrus.Warnf("unknown PLATFORM_DEGRADED_MODE %q, using %s", opts.DegradedMode, FailClosed)
+		degradedMode = FailClosed
+	}
+	if opts.FallbackCacheTTL > 0 {
+		fallbackCacheTTL = opts.FallbackCacheTTL
+	}
+}
+
+// Ping checks the platform answers, any response below 500 means it is reachable
+func Ping(ctx context.Context) error {
+	if len(baseUrl) == 0 {
+		return errors.New("platform base url is not configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("platform responded %s", resp.Status)
+	}
+	return nil
 }
 
 func ValidationUser(
 	ctx context.Context,
 	req GatewayValidationRequest,
 ) (err error) {
+	_, err = validateUser(ctx, req)
+	return err
+}
+
+// GetRules returns the cached rules of the user. Once they expired, the last known rules are
+// served while they are fetched again in the background. Rules evicted by an invalidation
+// are fetched again the same way, ErrRulesUnavailable is returned until then in fail closed mode.
+func GetRules(ctx context.Context, userName string) (UserCacheModel, error) {
+	rules, last, invalidated, err := getRuleCaches(ctx, userName)
+	if err != nil {
+		logrus.WithError(err).WithField("PLATFORM_CACHE_ERROR", userName).Error()
+		return UserCacheModel{}, nil
+	}
+	if rules.UserState == UserStateValidated {
+		return rules, nil
+	}
+	if last.UserState == UserStateValidated {
+		refreshRules(userName)
+		return last, nil
+	}
+	if !invalidated {
+		return UserCacheModel{}, nil
+	}
+
+	refreshRules(userName)
+	if degradedMode == FailClosed {
+		return UserCacheModel{}, ErrRulesUnavailable
+	}
+	return UserCacheModel{}, nil
+}
+
+// refreshRules fetches the rules of the user in the background, once at a time per user
+func refreshRules(userName string) {
+	if len(serviceToken) == 0 {
+		return
+	}
+	if _, loaded := refreshing.LoadOrStore(userName, struct{}{}); loaded {
+		return
+	}
+
+	refreshes.Add(1)
+	go func() {
+		defer refreshes.Done()
+		defer refreshing.Delete(userName)
+
+		ctx := context.Background()
+		rules, err := fetchRules(ctx, userName)
+		if err != nil {
+			logrus.WithError(err).WithField("PLATFORM_RULES_UNAVAILABLE", userName).Warn()
+			return
+		}
+		if err := SetRuleCache(ctx, userName, rules); err != nil {
+			logrus.WithError(err).WithField("PLATFORM_CACHE_ERROR", userName).Error()
+		}
+	}()
+}
+
+// Drain waits until the rules being fetched in the background are cached, or ctx is done
+func Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		refreshes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetchRules calls the platform for the rules of the user with the service token, through the
+// circuit breaker, retrying network errors and the 429 and 5xx statuses
+func fetchRules(ctx context.Context, userName string) (UserCacheModel, error) {
+	if err := circuit.Allow(); err != nil {
+		return UserCacheModel{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	path := baseUrl + "/api/internal/v1/topics/rules?" + url.Values{"user_name": {userName}}.Encode()
+	xopt := xhttp.RequestOption{
+		GroupPath: "api/internal/v1/topics/rules",
+		Header:    map[string]string{"Authorization": "Bearer " + serviceToken},
+	}
+	var resp PlatformBaseResponse
+	_, err := retry.Do(ctx, retryPolicy, func(ctx context.Context) error {
+		resp = PlatformBaseResponse{}
+		status, err := httpClient.Get(ctx, path, &resp, xopt)
+		if xhttp.IsClientError(err) && status != http.StatusTooManyRequests {
+			// the platform answered, the request is not retried
+			return retry.Permanent(err)
+		}
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("platform responded status code %d", resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		if !xhttp.IsClientError(err) {
+			circuit.Failure()
+		}
+		return UserCacheModel{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	circuit.Success()
+
+	return UserCacheModel{
+		UserState:     UserStateValidated,
+		Rules:         resp.Data.RulesDevices,
+		AdvancedRules: resp.Data.AdvancedRules,
+	}, nil
+}
+
+// validateUser returns the cached user state with the rules of the user once the credentials are validated
+func validateUser(ctx context.Context, req GatewayValidationRequest) (UserCacheModel, error) {
 	userCache, _ := GetUserCache(ctx, req.UserName, req.Password)
-	if userCache.UserState == "Validated" {
+	if userCache.UserState == UserStateValidated {
 		// if valid user from cache set key rule cache
 		go SetRuleCache(context.Background(), req.UserName, userCache)
-		return nil
+		return userCache, nil
 	}
 
-	if userCache.UserState == "Invalid" {
-		return errors.New("Invalid user name or password")
+	if userCache.UserState == UserStateInvalid {
+		return userCache, errors.New("Invalid user name or password")
+	}
+
+	resp, err := validate(ctx, req)
+	if err != nil {
+		return degraded(ctx, req, err)
+	}
+	if isRejection(resp.StatusCode) {
+		go func() {
+			// the platform rejects the credentials, they must not be accepted in fail open mode
+			cacheDB().Del(context.Background(), fallbackKey(req.UserName, req.Password))
+			SetUserCache(
+				context.Background(),
+				req.UserName,
+				req.Password,
+				UserCacheModel{
+					UserState: UserStateInvalid,
+				})
+		}()
+		return UserCacheModel{}, errors.New("Error when validate user from patform.")
+	}
+
+	userCache = UserCacheModel{
+		UserState:     UserStateValidated,
+		Rules:         resp.Data.RulesDevices,
+		AdvancedRules: resp.Data.AdvancedRules,
+	}
+	go func() {
+		SetUserCache(context.Background(), req.UserName, req.Password, userCache)
+		setFallbackCache(context.Background(), req.UserName, req.Password, userCache)
+		// the rules apply to the publishes of the connection
+		SetRuleCache(context.Background(), req.UserName, userCache)
+	}()
+
+	return userCache, nil
+}
+
+// validate calls the platform through the circuit breaker, retrying network errors and
+// the statuses other than 200, 401 and 403, a 401 or 403 status rejects the credentials.
+// It returns ErrUnavailable when the platform gave no answer.
+func validate(ctx context.Context, req GatewayValidationRequest) (resp PlatformBaseResponse, err error) {
+	if err = circuit.Allow(); err != nil {
+		return resp, fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
 
 	// http://host.docker.internal
-	var resp PlatformBaseResponse
 	path := baseUrl + "/api/internal/v1/topics/validation"
 	xopt := xhttp.RequestOption{GroupPath: "api/internal/v1/topics/validation"}
-	if _, err = httpClient.PostJSON(ctx, path, &req, &resp, xopt); err != nil {
-		return
+	_, err = retry.Do(ctx, retryPolicy, func(ctx context.Context) error {
+		resp = PlatformBaseResponse{}
+		status, err := httpClient.PostJSON(ctx, path, &req, &resp, xopt)
+		if xhttp.IsClientError(err) && isRejection(status) {
+			// the platform answered, it rejects the credentials
+			resp.StatusCode = status
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// throttled or failed answers, such as 429, do not reject the credentials
+		if resp.StatusCode != http.StatusOK && !isRejection(resp.StatusCode) {
+			return fmt.Errorf("platform responded status code %d", resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		circuit.Failure()
+		return resp, fmt.Errorf("%w: %v", ErrUnavailable, err)
 	}
-	if resp.StatusCode != 200 {
-		go SetUserCache(
-			context.Background(),
-			req.UserName,
-			req.Password,
-			UserCacheModel{
-				UserState: "Invalid",
-			})
-		return errors.New("Error when validate user from patform.")
-	}
-
-	go SetUserCache(
-		context.Background(),
-		req.UserName,
-		req.Password,
-		UserCacheModel{
-			UserState: "Validated",
-			Rules:     resp.Data.RulesDevices,
-		})
-
-	return
+	circuit.Success()
+	return resp, nil
+}
+
+// isRejection reports whether the platform rejects the credentials with the status
+func isRejection(status int) bool {
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// degraded validates the credentials while the platform is unavailable
+func degraded(ctx context.Context, req GatewayValidationRequest, cause error) (UserCacheModel, error) {
+	log := logrus.WithError(cause).WithField("PLATFORM_DEGRADED_MODE", degradedMode)
+	if degradedMode != FailOpen {
+		log.Error("rejecting the connection, the platform is unavailable")
+		return UserCacheModel{}, cause
+	}
+
+	fallback, _ := getFallbackCache(ctx, req.UserName, req.Password)
+	if fallback.UserState != UserStateValidated {
+		log.Error("rejecting the connection, the platform is unavailable and the credentials were not validated before")
+		return UserCacheModel{}, cause
+	}
+
+	log.Warn("accepting previously validated credentials, the platform is unavailable")
+	go SetRuleCache(context.Background(), req.UserName, fallback)
+	return fallback, nil
 }
@@ -0,0 +1,340 @@
+package platform
+
+import (
+	"context"
+	"encoding/json"
+	"message-core/pkg/xhttp"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"message-core/pkg/breaker"
+	"message-core/pkg/retry"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidationUserCachesNoPassword(t *testing.T) {
+	mr := newTestCache(t)
+
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req GatewayValidationRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		status := http.StatusOK
+		if req.Password != testPassword {
+			status = http.StatusUnauthorized
+		}
+		_ = json.NewEncoder(w).Encode(PlatformBaseResponse{StatusCode: status})
+	}))
+	t.Cleanup(platform.Close)
+	httpClient = xhttp.NewClient(xhttp.WithSkipLog(true))
+	baseUrl = platform.URL
+
+	ctx := context.Background()
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	assert.Error(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: "wrong"}))
+
+	require.Eventually(t, func() bool {
+		return len(mr.Keys()) == 5
+	}, time.Second, 10*time.Millisecond)
+	assertNoPassword(t, mr)
+
+	// the cached result is used without calling the platform, and restores the rules
+	platform.Close()
+	mr.Del(rulesKey(testUser))
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	require.Eventually(t, func() bool {
+		return mr.Exists(rulesKey(testUser))
+	}, time.Second, 10*time.Millisecond)
+}
+
+// newTestPlatform starts a platform answering the status codes in turn, the last one repeated.
+// A zero status code closes the connection, 403 and 429 are answered as the http status.
+func newTestPlatform(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var calls int32
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(atomic.AddInt32(&calls, 1))
+		status := statuses[len(statuses)-1]
+		if call <= len(statuses) {
+			status = statuses[call-1]
+		}
+		if status == 0 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		if status == http.StatusForbidden || status == http.StatusTooManyRequests {
+			// the rejection is in the http status only
+			w.WriteHeader(status)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(PlatformBaseResponse{StatusCode: status})
+	}))
+	t.Cleanup(platform.Close)
+	t.Cleanup(func() { Configure(Options{}) })
+	return platform, &calls
+}
+
+// waitForKey waits for the background cache writes of a validation, so they do not
+// reach the cache of the next test
+func waitForKey(t *testing.T, mr *miniredis.Miniredis, key string) {
+	require.Eventually(t, func() bool {
+		return mr.Exists(key)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func testOptions(url string) Options {
+	return Options{
+		BaseURL: url,
+		Timeout: time.Second,
+		Retry:   retry.Policy{Attempts: 3, BaseDelay: time.Millisecond},
+	}
+}
+
+func TestValidationUserRetriesUnavailablePlatform(t *testing.T) {
+	mr := newTestCache(t)
+	platform, calls := newTestPlatform(t, 0, http.StatusServiceUnavailable, http.StatusOK)
+	Configure(testOptions(platform.URL))
+
+	require.NoError(t, ValidationUser(context.Background(), GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	assert.EqualValues(t, 3, atomic.LoadInt32(calls))
+	waitForKey(t, mr, rulesKey(testUser))
+}
+
+func TestValidationUserDoesNotRetryRejections(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		mr := newTestCache(t)
+		platform, calls := newTestPlatform(t, status)
+		Configure(testOptions(platform.URL))
+
+		err := ValidationUser(context.Background(), GatewayValidationRequest{UserName: testUser, Password: testPassword})
+		assert.Error(t, err, status)
+		assert.NotErrorIs(t, err, ErrUnavailable, status)
+		assert.EqualValues(t, 1, atomic.LoadInt32(calls), status)
+		waitForKey(t, mr, credentialsKey(testUser, testPassword))
+	}
+}
+
+func TestValidationUserRetriesThrottledPlatform(t *testing.T) {
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusBadRequest, http.StatusNotFound} {
+		mr := newTestCache(t)
+		platform, calls := newTestPlatform(t, status, http.StatusOK)
+		Configure(testOptions(platform.URL))
+
+		require.NoError(t, ValidationUser(context.Background(), GatewayValidationRequest{UserName: testUser, Password: testPassword}), status)
+		assert.EqualValues(t, 2, atomic.LoadInt32(calls), status)
+		waitForKey(t, mr, rulesKey(testUser))
+	}
+
+	// a throttling platform is unavailable, the credentials are not rejected
+	mr := newTestCache(t)
+	platform, calls := newTestPlatform(t, http.StatusTooManyRequests)
+	opts := testOptions(platform.URL)
+	opts.DegradedMode = FailOpen
+	Configure(opts)
+
+	ctx := context.Background()
+	require.NoError(t, setFallbackCache(ctx, testUser, testPassword, validated()))
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}),
+		"the previously validated credentials are accepted")
+	assert.EqualValues(t, 3, atomic.LoadInt32(calls))
+	waitForKey(t, mr, rulesKey(testUser))
+	assert.False(t, mr.Exists(credentialsKey(testUser, testPassword)), "no rejection is cached")
+	assert.True(t, mr.Exists(fallbackKey(testUser, testPassword)))
+}
+
+func TestValidationUserCircuitBreaker(t *testing.T) {
+	newTestCache(t)
+	platform, calls := newTestPlatform(t, http.StatusInternalServerError)
+	opts := testOptions(platform.URL)
+	opts.Retry.Attempts = 1
+	opts.Breaker = breaker.Config{Threshold: 2, OpenTimeout: time.Hour}
+	Configure(opts)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		assert.ErrorIs(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}), ErrUnavailable)
+	}
+	assert.Equal(t, breaker.Open, circuit.State())
+
+	// the open breaker rejects without calling the platform
+	assert.ErrorIs(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}), ErrUnavailable)
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls))
+}
+
+func TestValidationUserDegradedModes(t *testing.T) {
+	mr := newTestCache(t)
+	platform, _ := newTestPlatform(t, http.StatusOK)
+	Configure(testOptions(platform.URL))
+
+	ctx := context.Background()
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	require.Eventually(t, func() bool {
+		return mr.Exists(fallbackKey(testUser, testPassword))
+	}, time.Second, 10*time.Millisecond)
+	assertNoPassword(t, mr)
+
+	// the validation expired while the platform is down
+	platform.Close()
+	mr.Del(credentialsKey(testUser, testPassword))
+	mr.Del(rulesKey(testUser))
+
+	assert.ErrorIs(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}), ErrUnavailable,
+		"fail closed rejects every connection")
+
+	opts := testOptions(platform.URL)
+	opts.DegradedMode = FailOpen
+	Configure(opts)
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	require.Eventually(t, func() bool {
+		return mr.Exists(rulesKey(testUser))
+	}, time.Second, 10*time.Millisecond, "the rules are restored from the fallback cache")
+	assert.ErrorIs(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: "wrong"}), ErrUnavailable,
+		"fail open only accepts previously validated credentials")
+}
+
+func TestValidationUserRejectionRemovesFallback(t *testing.T) {
+	mr := newTestCache(t)
+	platform, _ := newTestPlatform(t, http.StatusUnauthorized)
+	opts := testOptions(platform.URL)
+	opts.DegradedMode = FailOpen
+	Configure(opts)
+
+	ctx := context.Background()
+	require.NoError(t, setFallbackCache(ctx, testUser, testPassword, UserCacheModel{UserState: UserStateValidated}))
+	assert.Error(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	require.Eventually(t, func() bool {
+		return !mr.Exists(fallbackKey(testUser, testPassword))
+	}, time.Second, 10*time.Millisecond)
+}
+
+// newTestRulesPlatform starts a platform validating testPassword and serving the rules
+// of the users to the service token, with a legacy rule keeping the temp below the threshold
+func newTestRulesPlatform(t *testing.T, threshold *atomic.Value) (*httptest.Server, *int32) {
+	var fetches int32
+	platform := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&fetches, 1)
+			if r.URL.Path != "/api/internal/v1/topics/rules" || r.Header.Get("Authorization") != "Bearer service-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else {
+			var req GatewayValidationRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			if req.Password != testPassword {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		_ = json.NewEncoder(w).Encode(PlatformBaseResponse{
+			StatusCode: http.StatusOK,
+			Data: RulesDevicesResponse{RulesDevices: []RulesDevices{
+				{Atribute: "temp", Comparison: "LESS THAN", RuleValue: threshold.Load().(string)},
+			}},
+		})
+	}))
+	t.Cleanup(platform.Close)
+	t.Cleanup(func() { Configure(Options{}) })
+
+	opts := testOptions(platform.URL)
+	opts.ServiceToken = "service-token"
+	Configure(opts)
+	return platform, &fetches
+}
+
+// ruleValue returns the value of the single legacy rule
+func ruleValue(t *testing.T, rules UserCacheModel) string {
+	require.Len(t, rules.Rules, 1)
+	return rules.Rules[0].RuleValue
+}
+
+func TestGetRulesAfterInvalidation(t *testing.T) {
+	mr := newTestCache(t)
+	var threshold atomic.Value
+	threshold.Store("50")
+	newTestRulesPlatform(t, &threshold)
+
+	ctx := context.Background()
+	rules, err := GetRules(ctx, testUser)
+	require.NoError(t, err, "no rules for users never validated")
+	assert.Empty(t, rules.Rules)
+
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	waitForKey(t, mr, lastRulesKey(testUser))
+
+	threshold.Store("100")
+	require.NoError(t, InvalidationEvent{Username: testUser, Type: InvalidationRules}.Apply(ctx))
+	require.False(t, mr.Exists(rulesKey(testUser)))
+	require.False(t, mr.Exists(lastRulesKey(testUser)))
+
+	// the invalidated rules are not skipped in fail closed mode until they are fetched again
+	_, err = GetRules(ctx, testUser)
+	assert.ErrorIs(t, err, ErrRulesUnavailable)
+	require.Eventually(t, func() bool {
+		rules, err := GetRules(ctx, testUser)
+		return err == nil && len(rules.Rules) == 1 && rules.Rules[0].RuleValue == "100"
+	}, 5*time.Second, 10*time.Millisecond, "the rules are fetched again with the service token")
+	assert.False(t, mr.Exists(invalidatedRulesKey(testUser)))
+	assertNoPassword(t, mr)
+}
+
+func TestGetRulesExpiredWhilePlatformIsDown(t *testing.T) {
+	mr := newTestCache(t)
+	var threshold atomic.Value
+	threshold.Store("50")
+	platform, fetches := newTestRulesPlatform(t, &threshold)
+
+	ctx := context.Background()
+	require.NoError(t, ValidationUser(ctx, GatewayValidationRequest{UserName: testUser, Password: testPassword}))
+	waitForKey(t, mr, lastRulesKey(testUser))
+
+	// the last known rules are served once expired, they are fetched again in the background
+	threshold.Store("100")
+	mr.FastForward(cacheTTL)
+	require.False(t, mr.Exists(rulesKey(testUser)))
+	rules, err := GetRules(ctx, testUser)
+	require.NoError(t, err)
+	assert.Equal(t, "50", ruleValue(t, rules))
+	waitForKey(t, mr, rulesKey(testUser))
+	rules, err = GetRules(ctx, testUser)
+	require.NoError(t, err)
+	assert.Equal(t, "100", ruleValue(t, rules))
+
+	// the platform being down does not make the expired rules unavailable
+	platform.Close()
+	mr.FastForward(cacheTTL)
+	for i := 0; i < 3; i++ {
+		rules, err = GetRules(ctx, testUser)
+		require.NoError(t, err)
+		assert.Equal(t, "100", ruleValue(t, rules))
+	}
+	assert.False(t, mr.Exists(invalidatedRulesKey(testUser)))
+
+	// only the rules evicted by an invalidation are unavailable, in fail closed mode
+	require.NoError(t, InvalidateRules(ctx, testUser))
+	_, err = GetRules(ctx, testUser)
+	assert.ErrorIs(t, err, ErrRulesUnavailable)
+
+	waitForRefresh(t)
+	opts := testOptions(platform.URL)
+	opts.DegradedMode = FailOpen
+	opts.ServiceToken = "service-token"
+	Configure(opts)
+	rules, err = GetRules(ctx, testUser)
+	require.NoError(t, err, "fail open applies no rules")
+	assert.Empty(t, rules.Rules)
+
+	// without service token, the rules are only fetched again with the user validation
+	waitForRefresh(t)
+	Configure(testOptions(platform.URL))
+	calls := atomic.LoadInt32(fetches)
+	_, err = GetRules(ctx, testUser)
+	assert.ErrorIs(t, err, ErrRulesUnavailable)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, calls, atomic.LoadInt32(fetches))
+}
@@ -0,0 +1,70 @@
+package xtopic
+
+import "strings"
+
+// MQTT topic level separator, wildcards and the prefix of system topics
+const (
+	Separator           = "/"
+	SingleLevelWildcard = "+"
+	MultiLevelWildcard  = "#"
+	SysPrefix           = "$"
+)
+
+// Match reports whether an MQTT topic name matches a topic filter.
+// The filter may contain the single level (+) and multi level (#) wildcards,
+// wildcards in the first level never match topics starting with $.
+func Match(filter, topic string) bool {
+	if len(filter) == 0 || len(topic) == 0 {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, Separator)
+	topicLevels := strings.Split(topic, Separator)
+
+	if strings.HasPrefix(topic, SysPrefix) &&
+		(filterLevels[0] == SingleLevelWildcard || filterLevels[0] == MultiLevelWildcard) {
+		return false
+	}
+
+	for i, level := range filterLevels {
+		if level == MultiLevelWildcard {
+			// # must be the last level and also matches the parent level
+			return i == len(filterLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != SingleLevelWildcard && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
+
+// IsWildcard reports whether the filter contains any wildcard level.
+func IsWildcard(filter string) bool {
+	return strings.ContainsAny(filter, SingleLevelWildcard+MultiLevelWildcard)
+}
+
+// IsValidFilter reports whether filter is a valid MQTT topic filter,
+// wildcards must occupy a whole level and # must be the last level.
+func IsValidFilter(filter string) bool {
+	if len(filter) == 0 {
+		return false
+	}
+
+	levels := strings.Split(filter, Separator)
+	for i, level := range levels {
+		if level == MultiLevelWildcard {
+			if i != len(levels)-1 {
+				return false
+			}
+			continue
+		}
+		if level != SingleLevelWildcard && strings.ContainsAny(level, SingleLevelWildcard+MultiLevelWildcard) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package xtopic
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sensors/temp", "sensors/temp", true},
+		{"sensors/temp", "sensors/humidity", false},
+		{"sensors/+", "sensors/temp", true},
+		{"sensors/+", "sensors/temp/1", false},
+		{"+/private", "device1/private", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/temp/1", true},
+		{"#", "sensors/temp", true},
+		{"#", "$SYS/broker", false},
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"sensors/#/temp", "sensors/a/temp", false},
+		{"", "sensors", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, Match(c.filter, c.topic), "%s <> %s", c.filter, c.topic)
+	}
+}
+
+func TestIsValidFilter(t *testing.T) {
+	assert.True(t, IsValidFilter("sensors/+/temp"))
+	assert.True(t, IsValidFilter("sensors/#"))
+	assert.True(t, IsValidFilter("#"))
+	assert.False(t, IsValidFilter(""))
+	assert.False(t, IsValidFilter("sensors/#/temp"))
+	assert.False(t, IsValidFilter("sensors/te+mp"))
+	assert.False(t, IsValidFilter("sensors#"))
+}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"message-core/pkg/config"
@@ -52,6 +53,17 @@ func GetRedisClient() *redis.Client {
 	return redisClientSingleton.Client
 }
 
-func Close() {
-	redisClientSingleton.Client.Close()
+// Ping checks the redis server answers
+func Ping(ctx context.Context) error {
+	if redisClientSingleton == nil {
+		return errors.New("redis client is not initialized")
+	}
+	return redisClientSingleton.Client.Ping(ctx).Err()
+}
+
+func Close() error {
+	if redisClientSingleton == nil {
+		return nil
+	}
+	return redisClientSingleton.Client.Close()
 }
@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"message-core/pkg/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// headers and query parameters carrying websocket credentials
+const (
+	usernameHeader = "X-Username"
+	passwordHeader = "X-Password"
+	usernameQuery  = "username"
+	tokenQuery     = "token"
+)
+
+// anyOrigin in the allowed origins allows the browsers of any site to connect
+const anyOrigin = "*"
+
+var errInvalidHandshake = errors.New("invalid auth handshake")
+
+// credentialsFromRequest reads credentials from the basic auth or credential headers,
+// then from the username and token query parameters.
+func credentialsFromRequest(r *http.Request) (username, password string, ok bool) {
+	if username, password, ok = r.BasicAuth(); ok {
+		return
+	}
+
+	username, password = r.Header.Get(usernameHeader), r.Header.Get(passwordHeader)
+	if len(username) > 0 {
+		return username, password, true
+	}
+
+	query := r.URL.Query()
+	username, password = query.Get(usernameQuery), query.Get(tokenQuery)
+	if len(username) > 0 {
+		return username, password, true
+	}
+
+	return "", "", false
+}
+
+// readHandshake waits for the first frame carrying the credentials
+func readHandshake(conn *websocket.Conn) (username, password string, err error) {
+	timeout := time.Duration(config.WebsocketConfig().AuthTimeout) * time.Second
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+
+	m := Message{}
+	if err = json.Unmarshal(msg, &m); err != nil {
+		return
+	}
+	if m.Action != auth || len(m.Username) == 0 {
+		return "", "", errInvalidHandshake
+	}
+
+	return m.Username, m.Password, nil
+}
+
+// checkOrigin allows the configured origins, any origin when they hold anyOrigin,
+// or the origin of the server host when none is configured
+func checkOrigin(r *http.Request) bool {
+	websocketCfg := config.WebsocketConfig()
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		// non browser clients do not send an origin
+		return websocketCfg.AllowNoOrigin
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	allowedOrigins := websocketCfg.GetAllowedOrigins()
+	if len(allowedOrigins) == 0 {
+		return strings.EqualFold(originURL.Host, r.Host)
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == anyOrigin || allowed == origin || allowed == originURL.Host {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"message-core/pkg/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testAuthenticator accepts the password of its users and denies reading the denied topics
+type testAuthenticator struct {
+	users  map[string]string
+	denied map[string]bool
+}
+
+func (a *testAuthenticator) Authenticate(_ context.Context, username, password string) error {
+	if expected, ok := a.users[username]; !ok || expected != password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
+
+func (a *testAuthenticator) VerifyRead(_, topic string) error {
+	if a.denied[topic] {
+		return errors.New("topic writeonly")
+	}
+	return nil
+}
+
+// testLimiter allows the first connects of each username
+type testLimiter struct {
+	mu       sync.Mutex
+	connects map[string]int
+	burst    int
+}
+
+func (l *testLimiter) AllowConnect(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.connects[username]++
+	return l.connects[username] <= l.burst
+}
+
+// setWebsocketEnv sets a websocket variable and reloads the config
+func setWebsocketEnv(t *testing.T, key, value string) {
+	t.Setenv(key, value)
+	config.SetConfig()
+	t.Cleanup(config.SetConfig)
+}
+
+// newTestWSServer serves HandleWS with an authenticator knowing device1
+func newTestWSServer(t *testing.T) string {
+	config.SetConfig()
+	previous := server.authenticator
+	server.SetAuthenticator(&testAuthenticator{
+		users:  map[string]string{"device1": "s3cr3t"},
+		denied: map[string]bool{"device1/writeonly": true},
+	})
+	t.Cleanup(func() { server.SetAuthenticator(previous) })
+
+	srv := httptest.NewServer(http.HandlerFunc(HandleWS))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dial(t *testing.T, url string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if conn != nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, resp, err
+}
+
+func readText(t *testing.T, conn *websocket.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	return string(msg)
+}
+
+// assertAuthenticated checks the frames of the connection are processed by the server
+func assertAuthenticated(t *testing.T, conn *websocket.Conn) {
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"action":"ping","topic":"device1"}`)))
+	assert.Equal(t, errActionUnrecognizable, readText(t, conn))
+}
+
+func TestCredentialsFromRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		basic    []string
+		headers  map[string]string
+		query    string
+		username string
+		password string
+		ok       bool
+	}{
+		{
+			name:     "basic auth first",
+			basic:    []string{"basic", "p1"},
+			headers:  map[string]string{usernameHeader: "header", passwordHeader: "p2"},
+			query:    "?username=query&token=p3",
+			username: "basic", password: "p1", ok: true,
+		},
+		{
+			name:     "headers before the query",
+			headers:  map[string]string{usernameHeader: "header", passwordHeader: "p2"},
+			query:    "?username=query&token=p3",
+			username: "header", password: "p2", ok: true,
+		},
+		{
+			name:     "query token",
+			query:    "?username=query&token=p3",
+			username: "query", password: "p3", ok: true,
+		},
+		{
+			name:    "password header without username",
+			headers: map[string]string{passwordHeader: "p2"},
+			query:   "?token=p3",
+		},
+		{
+			name: "no credentials",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ws"+tt.query, nil)
+			if tt.basic != nil {
+				r.SetBasicAuth(tt.basic[0], tt.basic[1])
+			}
+			for key, value := range tt.headers {
+				r.Header.Set(key, value)
+			}
+
+			username, password, ok := credentialsFromRequest(r)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.username, username)
+			assert.Equal(t, tt.password, password)
+		})
+	}
+}
+
+func TestHandleWSRequestCredentials(t *testing.T) {
+	url := newTestWSServer(t)
+
+	header := http.Header{usernameHeader: {"device1"}, passwordHeader: {"s3cr3t"}}
+	conn, _, err := dial(t, url, header)
+	require.NoError(t, err)
+	assertAuthenticated(t, conn)
+
+	conn, _, err = dial(t, url+"?username=device1&token=s3cr3t", nil)
+	require.NoError(t, err)
+	assertAuthenticated(t, conn)
+
+	// the basic auth is validated even when the query holds valid credentials
+	header = http.Header{}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.SetBasicAuth("device1", "wrong")
+	header.Set("Authorization", r.Header.Get("Authorization"))
+	_, resp, err := dial(t, url+"?username=device1&token=s3cr3t", header)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	_, resp, err = dial(t, url, http.Header{usernameHeader: {"device2"}, passwordHeader: {"s3cr3t"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHandleWSHandshake(t *testing.T) {
+	url := newTestWSServer(t)
+
+	conn, _, err := dial(t, url, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage,
+		[]byte(`{"action":"auth","username":"device1","password":"s3cr3t"}`)))
+	assertAuthenticated(t, conn)
+
+	rejected := []struct {
+		name  string
+		frame string
+	}{
+		{name: "bad credentials", frame: `{"action":"auth","username":"device1","password":"wrong"}`},
+		{name: "malformed frame", frame: `{"action":"auth",`},
+		{name: "not an auth frame", frame: `{"action":"subscribe","topic":"device1","username":"device1"}`},
+		{name: "missing username", frame: `{"action":"auth","password":"s3cr3t"}`},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := dial(t, url, nil)
+			require.NoError(t, err)
+			require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)))
+			assert.Equal(t, errUnauthorized, readText(t, conn))
+
+			// the server closes the connection
+			_, _, err = conn.ReadMessage()
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestHandleWSHandshakeTimeout(t *testing.T) {
+	setWebsocketEnv(t, "WS_AUTH_TIMEOUT", "1")
+	url := newTestWSServer(t)
+
+	conn, _, err := dial(t, url, nil)
+	require.NoError(t, err)
+	start := time.Now()
+	assert.Equal(t, errUnauthorized, readText(t, conn))
+	assert.Less(t, time.Since(start), 3*time.Second)
+}
+
+func TestHandleWSOrigin(t *testing.T) {
+	setWebsocketEnv(t, "WS_ALLOWED_ORIGINS", "https://app.example.com, devices.example.com")
+	url := newTestWSServer(t)
+	query := "?username=device1&token=s3cr3t"
+
+	_, resp, err := dial(t, url+query, http.Header{"Origin": {"https://evil.example.com"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	for _, origin := range []string{"https://app.example.com", "https://devices.example.com"} {
+		conn, _, err := dial(t, url+query, http.Header{"Origin": {origin}})
+		require.NoError(t, err, origin)
+		assertAuthenticated(t, conn)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := func(origin string) bool {
+		r := httptest.NewRequest(http.MethodGet, "http://mqtt.example.com/ws", nil)
+		if len(origin) > 0 {
+			r.Header.Set("Origin", origin)
+		}
+		return checkOrigin(r)
+	}
+
+	setWebsocketEnv(t, "WS_ALLOWED_ORIGINS", "")
+	assert.False(t, check("https://evil.example.com"), "the same origin only when none is configured")
+	assert.True(t, check("https://mqtt.example.com"))
+	assert.True(t, check(""), "non browser clients")
+
+	setWebsocketEnv(t, "WS_ALLOWED_ORIGINS", "*")
+	assert.True(t, check("https://evil.example.com"), "any origin is an explicit opt-in")
+
+	setWebsocketEnv(t, "WS_ALLOWED_ORIGINS", "https://app.example.com,devices.example.com")
+	assert.True(t, check("https://app.example.com"))
+	assert.True(t, check("http://devices.example.com"), "hosts match any scheme")
+	assert.True(t, check(""), "non browser clients")
+	assert.False(t, check("https://evil.example.com"))
+	assert.False(t, check("http://app.example.com"), "full origins match exactly")
+	assert.False(t, check("%zz"))
+	assert.False(t, check("https://mqtt.example.com"), "the configured origins replace the same origin")
+
+	setWebsocketEnv(t, "WS_ALLOW_NO_ORIGIN", "false")
+	assert.False(t, check(""))
+}
+
+func TestHandleWSForeignOriginByDefault(t *testing.T) {
+	setWebsocketEnv(t, "WS_ALLOWED_ORIGINS", "")
+	url := newTestWSServer(t)
+	query := "?username=device1&token=s3cr3t"
+
+	_, resp, err := dial(t, url+query, http.Header{"Origin": {"https://evil.example.com"}})
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// the browser pages served by the same host connect
+	host := strings.TrimPrefix(url, "ws://")
+	conn, _, err := dial(t, url+query, http.Header{"Origin": {"http://" + host}})
+	require.NoError(t, err)
+	assertAuthenticated(t, conn)
+}
+
+func TestHandleWSSubscribeDenied(t *testing.T) {
+	url := newTestWSServer(t)
+
+	conn, _, err := dial(t, url+"?username=device1&token=s3cr3t", nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage,
+		[]byte(`{"action":"subscribe","topic":"device1/writeonly"}`)))
+	assert.Equal(t, errSubscribeDenied, readText(t, conn))
+}
+
+func TestHandleWSConnectLimit(t *testing.T) {
+	url := newTestWSServer(t)
+	limiter := &testLimiter{connects: make(map[string]int), burst: 1}
+	server.SetConnectLimiter(limiter)
+	t.Cleanup(func() { server.SetConnectLimiter(nil) })
+
+	conn, _, err := dial(t, url+"?username=device1&token=s3cr3t", nil)
+	require.NoError(t, err)
+	assertAuthenticated(t, conn)
+
+	// refused before the upgrade, even with bad credentials
+	_, resp, err := dial(t, url+"?username=device1&token=wrong", nil)
+	require.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// the handshake is limited before its credentials are validated
+	conn, _, err = dial(t, url, nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteMessage(websocket.TextMessage,
+		[]byte(`{"action":"auth","username":"device1","password":"s3cr3t"}`)))
+	assert.Equal(t, errRateLimited, readText(t, conn))
+	_, _, err = conn.ReadMessage()
+	assert.Error(t, err)
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	assert.Equal(t, 3, limiter.connects["device1"])
+}
@@ -1,11 +1,14 @@
 package websocket
 
 import (
+	"message-core/pkg/config"
+	"message-core/pkg/metrics"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 )
 
 const (
@@ -21,10 +24,12 @@ const (
 	readBufferSize = 1024
 	// I/O write buffer size
 	writeBufferSize = 1024
+	// outbound messages queued per client when not configured
+	defaultQueueSize = 256
 )
 
 // Initialize server with empty subscription
-var server = &Server{Subscriptions: make(Subscription)}
+var server = NewServer()
 
 func GetServerConn() *Server {
 	return server
@@ -34,44 +39,92 @@ func GetServerConn() *Server {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  readBufferSize,
 	WriteBufferSize: writeBufferSize,
-	CheckOrigin: func(r *http.Request) bool {
-		// allow all origin
-		return true
-	},
+	CheckOrigin:     checkOrigin,
 }
 
 func HandleWS(w http.ResponseWriter, r *http.Request) {
+	if server.authenticator == nil {
+		http.Error(w, "server is not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	// credentials sent with the upgrade request are limited and validated before upgrading
+	username, password, hasCredentials := credentialsFromRequest(r)
+	if hasCredentials {
+		if !server.allowConnect(username) {
+			http.Error(w, "too many connects", http.StatusTooManyRequests)
+			return
+		}
+		if err := server.authenticator.Authenticate(r.Context(), username, password); err != nil {
+			logrus.WithField("WS authentication failed", username).WithError(err).Warn()
+			metrics.AuthFailed(metrics.ProtocolWS)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	// upgrades connection to websocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("failed upgrading connection"))
+		// the upgrader already replied with the error
 		return
 	}
 	defer conn.Close()
 
+	// otherwise the first frame must be the auth handshake
+	if !hasCredentials {
+		username, password, err = readHandshake(conn)
+		if err == nil && !server.allowConnect(username) {
+			conn.WriteMessage(websocket.TextMessage, []byte(errRateLimited))
+			return
+		}
+		if err == nil {
+			err = server.authenticator.Authenticate(r.Context(), username, password)
+		}
+		if err != nil {
+			logrus.WithField("WS authentication failed", username).WithError(err).Warn()
+			metrics.AuthFailed(metrics.ProtocolWS)
+			// the writer is not started yet, reply directly
+			conn.WriteMessage(websocket.TextMessage, []byte(errUnauthorized))
+			return
+		}
+	}
+
 	// create new client id
 	clientID := uuid.New().String()
 
-	// greet the new client
-	topic := r.URL.Query().Get("topic")
-	if len(topic) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("missing parameters topic name"))
-		return
+	websocketCfg := config.WebsocketConfig()
+	session := NewSession(
+		clientID,
+		username,
+		conn,
+		websocketCfg.OutboundQueueSize,
+		SlowConsumerPolicy(websocketCfg.SlowConsumerPolicy),
+	)
+	server.Register(session)
+
+	// subscribe to the initial topic if requested,
+	// more topics can be subscribed by subscribe messages
+	if topic := r.URL.Query().Get("topic"); len(topic) > 0 {
+		server.SubscribeSession(session, topic)
 	}
 
-	server.Subscribe(conn, clientID, topic)
-
-	// create channel to signal client health
-	done := make(chan struct{})
+	go session.writePump()
+	readPump(session)
+}
 
-	go writePump(conn, clientID, done)
-	readPump(conn, clientID, done, topic)
+// allowConnect reports whether the username may connect again
+func (s *Server) allowConnect(username string) bool {
+	if s.limiter == nil || s.limiter.AllowConnect(username) {
+		return true
+	}
+	logrus.WithField("WS connect rate limit exceeded", username).Warn()
+	return false
 }
 
 // readPump process incoming messages and set the settings
-func readPump(conn *websocket.Conn, clientID string, done chan<- struct{}, topic string) {
+func readPump(session *Session) {
+	conn := session.Conn
 	// set limit, deadline to read & pong handler
 	conn.SetReadLimit(maxMessageSize)
 	conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -80,43 +133,21 @@ func readPump(conn *websocket.Conn, clientID string, done chan<- struct{}, topic
 		return nil
 	})
 
+	// remove from the server and stop the writer once reading fails
+	defer func() {
+		server.RemoveClient(session.ClientID)
+		session.Close()
+	}()
+
 	// message handling
 	for {
 		// read incoming message
-		_, _, err := conn.ReadMessage()
-		// if error occured
+		_, msg, err := conn.ReadMessage()
+		// if error occured, stop process
 		if err != nil {
-			// remove from the client
-			server.RemoveClient(clientID)
-			// set health status to unhealthy by closing channel
-			close(done)
-			// stop process
-			break
-		}
-		// if no error, process incoming message
-	}
-}
-
-// writePump sends ping to the client
-func writePump(conn *websocket.Conn, clientID string, done <-chan struct{}) {
-	// create ping ticker
-	ticker := time.NewTicker(pingPeriod)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			// send ping message
-			err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
-			if err != nil {
-				// if error sending ping, remove this client from the server
-				server.RemoveClient(clientID)
-				// stop sending ping
-				return
-			}
-		case <-done:
-			// if process is done, stop sending ping
 			return
 		}
+		// if no error, process incoming message
+		server.ProcessMessage(session, msg)
 	}
 }
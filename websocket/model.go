@@ -1,16 +1,50 @@
 package websocket
 
-import "github.com/gorilla/websocket"
+import "context"
 
-// Subscription is a type for each string of topic and the clients that subscribe to it
-type Subscription map[string]Client
+// Client is a type that describe the clients' ID and their session
+type Client map[string]*Session
 
-// Client is a type that describe the clients' ID and their connection
-type Client map[string]*websocket.Conn
+// SlowConsumerPolicy is the action taken when a session outbound queue is full
+type SlowConsumerPolicy string
+
+const (
+	// DropOldest discards the oldest queued message to make room for the new one
+	DropOldest SlowConsumerPolicy = "drop_oldest"
+	// DropNewest discards the new message
+	DropNewest SlowConsumerPolicy = "drop_newest"
+	// Disconnect closes the connection of the slow client
+	Disconnect SlowConsumerPolicy = "disconnect"
+)
 
 // Message is a struct for message to be sent by the client
 type Message struct {
 	Action  string `json:"action"`
 	Topic   string `json:"topic"`
 	Message string `json:"message"`
+	// credentials of the first frame handshake
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// Publisher injects messages published by websocket clients into the broker
+type Publisher interface {
+	Publish(clientID, username, topic string, payload []byte) error
+}
+
+// Relay shares the messages published on this instance with the other instances,
+// which deliver them with PublishLocal.
+type Relay interface {
+	Broadcast(topic string, message []byte) bool
+}
+
+// Authenticator validates websocket credentials and topic access
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) error
+	VerifyRead(username, topic string) error
+}
+
+// ConnectLimiter limits the connects of a username, shared with the mqtt clients
+type ConnectLimiter interface {
+	AllowConnect(username string) bool
 }
@@ -1,7 +1,12 @@
 package websocket
 
 import (
+	"context"
+	"encoding/json"
+	"message-core/pkg/metrics"
+	"message-core/pkg/xtopic"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
@@ -12,116 +17,239 @@ const (
 	publish     = "publish"
 	subscribe   = "subscribe"
 	unsubscribe = "unsubscribe"
+	auth        = "auth"
 )
 
 // constants for server message
 const (
 	errInvalidMessage       = "Server: Invalid msg"
 	errActionUnrecognizable = "Server: Action unrecognized"
+	errPublishUnavailable   = "Server: Publish unavailable"
+	errPublishFailed        = "Server: Publish failed: "
+	errSubscribeDenied      = "Server: Subscribe denied"
+	errUnauthorized         = "Server: Unauthorized"
+	errRateLimited          = "Server: Rate limit exceeded"
+	closeShuttingDown       = "Server: Shutting down"
 )
 
 // Server is the struct to handle the Server functions & manage the Subscriptions
 type Server struct {
-	Subscriptions Subscription
+	// mu guards Subscriptions and sessions
+	mu            sync.RWMutex
+	Subscriptions *Subscription
+	sessions      map[string]*Session
+	publisher     Publisher
+	authenticator Authenticator
+	relay         Relay
+	limiter       ConnectLimiter
 }
 
-// Send simply sends message to the websocket client
-func (s *Server) Send(conn *websocket.Conn, message string) {
-	// send simple message
-	conn.WriteMessage(websocket.TextMessage, []byte(message))
+// NewServer create new server with empty subscription
+func NewServer() *Server {
+	return &Server{
+		Subscriptions: NewSubscription(),
+		sessions:      make(map[string]*Session),
+	}
+}
+
+// SetAuthenticator sets the validation of websocket credentials and topic access
+func (s *Server) SetAuthenticator(authenticator Authenticator) {
+	s.authenticator = authenticator
 }
 
-// SendWithWait sends message to the websocket client using wait group, allowing usage with goroutines
-func (s *Server) SendWithWait(conn *websocket.Conn, message string, wg *sync.WaitGroup) {
-	// send simple message
-	conn.WriteMessage(websocket.TextMessage, []byte(message))
+// SetConnectLimiter sets the limit of the connects, connects are not limited when nil
+func (s *Server) SetConnectLimiter(limiter ConnectLimiter) {
+	s.limiter = limiter
+}
 
-	// set the task as done
-	wg.Done()
+// SetPublisher sets the broker receiving messages published by websocket clients
+func (s *Server) SetPublisher(publisher Publisher) {
+	s.publisher = publisher
+}
+
+// SetRelay sets the relay sharing published messages with the other instances
+func (s *Server) SetRelay(relay Relay) {
+	s.relay = relay
+}
+
+// Send queues a simple message for the websocket client
+func (s *Server) Send(session *Session, message string) {
+	session.Enqueue([]byte(message))
+}
+
+// Register adds the session to the server so it can be found by its client id
+func (s *Server) Register(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.ClientID] = session
+	metrics.ClientConnected(metrics.ProtocolWS)
 }
 
 // RemoveClient removes the clients from the server subscription map
 func (s *Server) RemoveClient(clientID string) {
-	// loop all topics
-	for _, client := range s.Subscriptions {
-		// delete the client from all the topic's client map
-		delete(client, clientID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// delete the client from all the topic filters
+	s.Subscriptions.RemoveClient(clientID)
+	if _, ok := s.sessions[clientID]; ok {
+		delete(s.sessions, clientID)
+		metrics.ClientDisconnected(metrics.ProtocolWS)
+	}
+}
+
+// Sessions returns the registered sessions
+func (s *Server) Sessions() []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Filters returns the topic filters subscribed by the client
+func (s *Server) Filters(clientID string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Subscriptions.Filters(clientID)
+}
+
+// Kick closes the session of the client, it returns false when the client is not connected
+func (s *Server) Kick(clientID string, reason string) bool {
+	s.mu.RLock()
+	session, ok := s.sessions[clientID]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	session.CloseWith(websocket.ClosePolicyViolation, reason)
+	return true
+}
+
+// Shutdown sends a going away close frame to every client and waits until
+// their writers have stopped or ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	sessions := s.Sessions()
+	for _, session := range sessions {
+		session.CloseWith(websocket.CloseGoingAway, closeShuttingDown)
 	}
+	for _, session := range sessions {
+		select {
+		case <-session.Stopped():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
 }
 
 // ProcessMessage handle message according to the action type
-func (s *Server) ProcessMessage(
-	conn *websocket.Conn,
-	clientID string,
-	msg []byte,
-	topic string,
-) *Server {
-	s.Publish(topic, msg)
+func (s *Server) ProcessMessage(session *Session, msg []byte) *Server {
+	m := Message{}
+	if err := json.Unmarshal(msg, &m); err != nil || len(m.Topic) == 0 {
+		s.Send(session, errInvalidMessage)
+		return s
+	}
+
+	switch m.Action {
+	case publish:
+		if s.publisher == nil {
+			s.Send(session, errPublishUnavailable)
+			break
+		}
+		// publish through the broker so the message meets the same acl and rules as mqtt
+		err := s.publisher.Publish(session.ClientID, session.Username, m.Topic, []byte(m.Message))
+		if err != nil {
+			s.Send(session, errPublishFailed+err.Error())
+		}
+	case subscribe:
+		s.SubscribeSession(session, m.Topic)
+	case unsubscribe:
+		s.Unsubscribe(session.ClientID, m.Topic)
+	default:
+		s.Send(session, errActionUnrecognizable)
+	}
+
 	return s
 }
 
-// Publish sends a message to all subscribing clients of a topic
+// Publish queues a message for all clients with a filter matching the topic,
+// on this instance and through the relay on the other instances.
 func (s *Server) Publish(topic string, message []byte) {
+	s.PublishLocal(topic, message)
+	if s.relay != nil {
+		s.relay.Broadcast(topic, message)
+	}
+}
+
+// PublishLocal queues a message for the clients of this instance only
+func (s *Server) PublishLocal(topic string, message []byte) {
 	logrus.
 		WithField("WS Publisher recieved message with topic: ", topic).
 		WithField("Topic name: ", topic).
 		WithField("Message :", string(message)).
 		Info()
-	// if topic does not exist, stop the process
-	if _, exist := s.Subscriptions[topic]; !exist {
-		return
+	start := time.Now()
+
+	// copy the subscribers so slow queues never hold the lock
+	s.mu.RLock()
+	client := s.Subscriptions.Subscribers(topic)
+	sessions := make([]*Session, 0, len(client))
+	for _, session := range client {
+		sessions = append(sessions, session)
 	}
-
-	// read cache rule and everithings here
-
-	// if topic exist
-	client := s.Subscriptions[topic]
-
-	// send the message to the clients
-	var wg sync.WaitGroup
-	for _, conn := range client {
-		// add 1 job to wait group
-		wg.Add(1)
-
-		// send with goroutines
-		go s.SendWithWait(conn, string(message), &wg)
+	s.mu.RUnlock()
+
+	// each session writer sends the message on its own connection
+	for _, session := range sessions {
+		if session.Enqueue(message) {
+			metrics.Delivered(metrics.ProtocolWS, topic)
+		} else {
+			metrics.Dropped(metrics.ProtocolWS, topic, metrics.ReasonSlowConsumer)
+		}
 	}
-
-	// wait until all goroutines jobs done
-	wg.Wait()
+	metrics.ObserveFanout(topic, start)
 }
 
-// Subscribe adds a client to a topic's client map
-func (s *Server) Subscribe(conn *websocket.Conn, clientID string, topic string) {
-	// if topic exist, check the client map
-	if _, exist := s.Subscriptions[topic]; exist {
-		client := s.Subscriptions[topic]
-
-		// if client already subbed, stop the process
-		if _, subbed := client[clientID]; subbed {
-			return
-		}
+// SubscribeSession subscribes the session to a topic its username is allowed to read
+func (s *Server) SubscribeSession(session *Session, topic string) {
+	if !xtopic.IsValidFilter(topic) {
+		s.Send(session, errInvalidMessage)
+		return
+	}
 
-		// if not subbed, add to client map
-		client[clientID] = conn
+	if err := s.authenticator.VerifyRead(session.Username, topic); err != nil {
+		metrics.ACLDenied(metrics.ProtocolWS, metrics.ActionSubscribe)
+		logrus.WithField("WS subscribe denied", topic).
+			WithField("Client: ", session.ClientID).
+			WithField("Username: ", session.Username).
+			WithError(err).
+			Warn()
+		s.Send(session, errSubscribeDenied)
 		return
 	}
 
-	// if topic does not exist, create a new topic
-	newClient := make(Client)
-	s.Subscriptions[topic] = newClient
+	s.Subscribe(session, topic)
+}
+
+// Subscribe adds a client to a topic filter, the filter may use + and # wildcards
+func (s *Server) Subscribe(session *Session, topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// add the client to the topic
-	s.Subscriptions[topic][clientID] = conn
+	s.Subscriptions.Add(topic, session)
 }
 
-// Unsubscribe removes a clients from a topic's client map
+// Unsubscribe removes a clients from a topic filter
 func (s *Server) Unsubscribe(clientID string, topic string) {
-	// if topic exist, check the client map
-	if _, exist := s.Subscriptions[topic]; exist {
-		client := s.Subscriptions[topic]
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		// remove the client from the topic's client map
-		delete(client, clientID)
-	}
+	s.Subscriptions.Remove(topic, clientID)
 }
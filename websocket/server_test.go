@@ -0,0 +1,232 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConns returns both ends of a websocket connection
+func newTestConns(t *testing.T) (serverConn, clientConn *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		require.NoError(t, err)
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	clientConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { clientConn.Close() })
+
+	return <-conns, clientConn
+}
+
+func TestServerPublishToSubscribers(t *testing.T) {
+	s := NewServer()
+	serverConn, clientConn := newTestConns(t)
+	session := NewSession("client-1", "device1", serverConn, 10, DropOldest)
+	s.Register(session)
+	go session.writePump()
+	defer session.Close()
+
+	s.Subscribe(session, "device1")
+	s.Publish("device1", []byte("hello"))
+	s.Publish("device2", []byte("ignored"))
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := clientConn.ReadMessage()
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+
+	s.Unsubscribe("client-1", "device1")
+	assert.Equal(t, 0, s.Subscriptions.Len())
+}
+
+func TestServerShutdownSendsCloseFrame(t *testing.T) {
+	s := NewServer()
+	serverConn, clientConn := newTestConns(t)
+	session := NewSession("client-1", "device1", serverConn, 10, DropOldest)
+	s.Register(session)
+	go session.writePump()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := clientConn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
+
+func TestServerConcurrentSubscriptions(t *testing.T) {
+	const (
+		clients  = 20
+		topics   = 5
+		messages = 200
+	)
+	s := NewServer()
+
+	var readers sync.WaitGroup
+	sessions := make([]*Session, clients)
+	for i := range sessions {
+		serverConn, clientConn := newTestConns(t)
+		sessions[i] = NewSession(fmt.Sprintf("client-%d", i), "", serverConn, 16, DropOldest)
+		s.Register(sessions[i])
+		go sessions[i].writePump()
+
+		// drain the client side until the session closes the connection
+		readers.Add(1)
+		go func(conn *websocket.Conn) {
+			defer readers.Done()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}(clientConn)
+	}
+
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		wg.Add(2)
+		go func(i int, session *Session) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				topic := fmt.Sprintf("topic-%d", (i+j)%topics)
+				s.Subscribe(session, topic)
+				if j%3 == 0 {
+					s.Unsubscribe(session.ClientID, topic)
+				}
+			}
+		}(i, session)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				s.Publish(fmt.Sprintf("topic-%d", j%topics), []byte(fmt.Sprintf("msg-%d-%d", i, j)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, session := range sessions {
+		s.RemoveClient(session.ClientID)
+		session.Close()
+	}
+	readers.Wait()
+
+	assert.Equal(t, 0, s.Subscriptions.Len())
+}
+
+func TestSessionSlowConsumerPolicy(t *testing.T) {
+	drain := func(session *Session) (queued []string) {
+		for len(session.outbound) > 0 {
+			queued = append(queued, string(<-session.outbound))
+		}
+		return
+	}
+
+	session := NewSession("client-1", "", nil, 2, DropOldest)
+	for _, msg := range []string{"m1", "m2", "m3"} {
+		assert.True(t, session.Enqueue([]byte(msg)))
+	}
+	assert.Equal(t, []string{"m2", "m3"}, drain(session))
+	assert.Equal(t, uint64(1), session.Dropped())
+
+	session = NewSession("client-2", "", nil, 2, DropNewest)
+	for _, msg := range []string{"m1", "m2", "m3"} {
+		session.Enqueue([]byte(msg))
+	}
+	assert.Equal(t, []string{"m1", "m2"}, drain(session))
+
+	session = NewSession("client-3", "", nil, 1, Disconnect)
+	assert.True(t, session.Enqueue([]byte("m1")))
+	assert.False(t, session.Enqueue([]byte("m2")))
+	select {
+	case <-session.Done():
+	default:
+		t.Fatal("slow session should be closed")
+	}
+	assert.False(t, session.Enqueue([]byte("m3")))
+}
+
+// testPublisher records the publishes and fails the denied topics
+type testPublisher struct {
+	published []Message
+	denied    map[string]bool
+}
+
+func (p *testPublisher) Publish(clientID, username, topic string, payload []byte) error {
+	if p.denied[topic] {
+		return errors.New("not authorized to publish to topic")
+	}
+	p.published = append(p.published, Message{Topic: topic, Message: string(payload), Username: username})
+	return nil
+}
+
+func TestServerProcessMessage(t *testing.T) {
+	replies := func(session *Session) (queued []string) {
+		for len(session.outbound) > 0 {
+			queued = append(queued, string(<-session.outbound))
+		}
+		return
+	}
+
+	s := NewServer()
+	s.SetAuthenticator(&testAuthenticator{denied: map[string]bool{"device1/writeonly": true}})
+	session := NewSession("client-1", "device1", nil, 10, DropNewest)
+	s.Register(session)
+	defer s.RemoveClient(session.ClientID)
+
+	// without publisher
+	s.ProcessMessage(session, []byte(`{"action":"publish","topic":"device1","message":"1"}`))
+	assert.Equal(t, []string{errPublishUnavailable}, replies(session))
+
+	publisher := &testPublisher{denied: map[string]bool{"device2": true}}
+	s.SetPublisher(publisher)
+	tests := []struct {
+		name    string
+		frame   string
+		replies []string
+	}{
+		{name: "publish", frame: `{"action":"publish","topic":"device1/private","message":"{\"temp\":1}"}`},
+		{name: "publish denied", frame: `{"action":"publish","topic":"device2","message":"1"}`,
+			replies: []string{errPublishFailed + "not authorized to publish to topic"}},
+		{name: "subscribe", frame: `{"action":"subscribe","topic":"device1/+"}`},
+		{name: "subscribe denied", frame: `{"action":"subscribe","topic":"device1/writeonly"}`,
+			replies: []string{errSubscribeDenied}},
+		{name: "invalid filter", frame: `{"action":"subscribe","topic":"device1/#/a"}`,
+			replies: []string{errInvalidMessage}},
+		{name: "missing topic", frame: `{"action":"subscribe"}`, replies: []string{errInvalidMessage}},
+		{name: "malformed frame", frame: `{"action":`, replies: []string{errInvalidMessage}},
+		{name: "unknown action", frame: `{"action":"ping","topic":"device1"}`,
+			replies: []string{errActionUnrecognizable}},
+	}
+	for _, tt := range tests {
+		s.ProcessMessage(session, []byte(tt.frame))
+		assert.Equal(t, tt.replies, replies(session), tt.name)
+	}
+
+	assert.Equal(t, []Message{{Topic: "device1/private", Message: `{"temp":1}`, Username: "device1"}},
+		publisher.published)
+	assert.Equal(t, []string{"device1/+"}, s.Filters(session.ClientID), "the denied filters are not subscribed")
+
+	s.PublishLocal("device1/private", []byte("hello"))
+	assert.Equal(t, []string{"hello"}, replies(session))
+
+	s.ProcessMessage(session, []byte(`{"action":"unsubscribe","topic":"device1/+"}`))
+	s.PublishLocal("device1/private", []byte("ignored"))
+	assert.Empty(t, replies(session))
+	assert.Empty(t, s.Filters(session.ClientID))
+}
@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// Session is a type that describe a websocket connection, its identity
+// and the bounded queue of messages waiting to be written by its writer.
+type Session struct {
+	ClientID    string
+	Username    string
+	Conn        *websocket.Conn
+	ConnectedAt time.Time
+
+	outbound  chan []byte
+	policy    SlowConsumerPolicy
+	dropped   uint64
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+	// close frame sent by the writer once the session is closed
+	closeMessage []byte
+}
+
+// NewSession create new session with an outbound queue of queueSize messages
+func NewSession(clientID, username string, conn *websocket.Conn, queueSize int, policy SlowConsumerPolicy) *Session {
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+	switch policy {
+	case DropOldest, DropNewest, Disconnect:
+	default:
+		policy = DropOldest
+	}
+
+	return &Session{
+		ClientID:    clientID,
+		Username:    username,
+		Conn:        conn,
+		ConnectedAt: time.Now(),
+		outbound:    make(chan []byte, queueSize),
+		policy:      policy,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// Enqueue queues the message for the writer without blocking,
+// applying the slow consumer policy when the queue is full.
+func (s *Session) Enqueue(message []byte) bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+
+	select {
+	case s.outbound <- message:
+		return true
+	default:
+	}
+
+	atomic.AddUint64(&s.dropped, 1)
+	switch s.policy {
+	case DropNewest:
+		return false
+	case Disconnect:
+		logrus.WithField("WS slow consumer disconnected", s.ClientID).Warn()
+		s.Close()
+		return false
+	}
+
+	// drop oldest, the writer may drain the queue concurrently so never block
+	for {
+		select {
+		case <-s.outbound:
+		default:
+		}
+		select {
+		case s.outbound <- message:
+			return true
+		default:
+		}
+	}
+}
+
+// Dropped returns the number of messages dropped by the slow consumer policy
+func (s *Session) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the writer which sends a close frame and closes the connection
+func (s *Session) Close() {
+	s.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith closes the session with the given close code and reason
+func (s *Session) CloseWith(code int, reason string) {
+	s.closeOnce.Do(func() {
+		s.closeMessage = websocket.FormatCloseMessage(code, reason)
+		close(s.done)
+	})
+}
+
+// Done is closed once the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stopped is closed once the writer has sent the close frame and closed the connection
+func (s *Session) Stopped() <-chan struct{} {
+	return s.stopped
+}
+
+// writePump is the only goroutine writing to the connection,
+// it sends queued messages and pings until the session is closed.
+func (s *Session) writePump() {
+	// create ping ticker
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		// closing the connection stops the read pump
+		s.Conn.Close()
+		close(s.stopped)
+	}()
+
+	for {
+		select {
+		case message := <-s.outbound:
+			s.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				s.Close()
+				return
+			}
+		case <-ticker.C:
+			// send ping message
+			err := s.Conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait))
+			if err != nil {
+				s.Close()
+				return
+			}
+		case <-s.done:
+			s.Conn.WriteControl(websocket.CloseMessage, s.closeMessage, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	"message-core/pkg/xtopic"
+	"strings"
+)
+
+// topicNode is a level of the subscription trie
+type topicNode struct {
+	children map[string]*topicNode
+	clients  Client
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{
+		children: make(map[string]*topicNode),
+		clients:  make(Client),
+	}
+}
+
+// Subscription is a trie of topic filters and the clients that subscribe to them,
+// it is not safe for concurrent use and is guarded by the server lock.
+type Subscription struct {
+	root *topicNode
+	// filters subscribed by each client id
+	filters map[string]map[string]struct{}
+}
+
+// NewSubscription create new empty subscription trie
+func NewSubscription() *Subscription {
+	return &Subscription{
+		root:    newTopicNode(),
+		filters: make(map[string]map[string]struct{}),
+	}
+}
+
+// Add subscribes the session to the filter, subscribing twice is a no-op
+func (t *Subscription) Add(filter string, session *Session) {
+	node := t.root
+	for _, level := range strings.Split(filter, xtopic.Separator) {
+		child, exist := node.children[level]
+		if !exist {
+			child = newTopicNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.clients[session.ClientID] = session
+
+	if _, exist := t.filters[session.ClientID]; !exist {
+		t.filters[session.ClientID] = make(map[string]struct{})
+	}
+	t.filters[session.ClientID][filter] = struct{}{}
+}
+
+// Remove unsubscribes the client from the filter and prunes empty levels
+func (t *Subscription) Remove(filter, clientID string) {
+	levels := strings.Split(filter, xtopic.Separator)
+	path := make([]*topicNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, exist := node.children[level]
+		if !exist {
+			return
+		}
+		node = child
+		path = append(path, node)
+	}
+	delete(node.clients, clientID)
+
+	for i := len(levels) - 1; i >= 0; i-- {
+		child := path[i+1]
+		if len(child.clients) > 0 || len(child.children) > 0 {
+			break
+		}
+		delete(path[i].children, levels[i])
+	}
+
+	if filters, exist := t.filters[clientID]; exist {
+		delete(filters, filter)
+		if len(filters) == 0 {
+			delete(t.filters, clientID)
+		}
+	}
+}
+
+// RemoveClient unsubscribes the client from all its filters
+func (t *Subscription) RemoveClient(clientID string) {
+	for filter := range t.filters[clientID] {
+		t.Remove(filter, clientID)
+	}
+}
+
+// Filters returns the filters subscribed by the client
+func (t *Subscription) Filters(clientID string) []string {
+	filters := make([]string, 0, len(t.filters[clientID]))
+	for filter := range t.filters[clientID] {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// Len returns the number of subscribed clients
+func (t *Subscription) Len() int {
+	return len(t.filters)
+}
+
+// Subscribers returns the sessions with a filter matching the topic,
+// each session is returned once even when several of its filters match.
+func (t *Subscription) Subscribers(topic string) Client {
+	subscribers := make(Client)
+	levels := strings.Split(topic, xtopic.Separator)
+	// wildcards in the first level never match system topics
+	isSys := strings.HasPrefix(topic, xtopic.SysPrefix)
+	t.collect(t.root, levels, 0, isSys, subscribers)
+	return subscribers
+}
+
+func (t *Subscription) collect(node *topicNode, levels []string, depth int, isSys bool, subscribers Client) {
+	wildcards := !(isSys && depth == 0)
+
+	// # also matches the parent level
+	if wildcards {
+		if multi, exist := node.children[xtopic.MultiLevelWildcard]; exist {
+			for clientID, session := range multi.clients {
+				subscribers[clientID] = session
+			}
+		}
+	}
+
+	if depth == len(levels) {
+		for clientID, session := range node.clients {
+			subscribers[clientID] = session
+		}
+		return
+	}
+
+	if child, exist := node.children[levels[depth]]; exist {
+		t.collect(child, levels, depth+1, isSys, subscribers)
+	}
+	if wildcards {
+		if single, exist := node.children[xtopic.SingleLevelWildcard]; exist {
+			t.collect(single, levels, depth+1, isSys, subscribers)
+		}
+	}
+}
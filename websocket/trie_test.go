@@ -0,0 +1,56 @@
+package websocket
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func subscriberIDs(client Client) []string {
+	ids := make([]string, 0, len(client))
+	for id := range client {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSubscriptionWildcards(t *testing.T) {
+	trie := NewSubscription()
+	trie.Add("sensors/#", &Session{ClientID: "all"})
+	trie.Add("sensors/+/temp", &Session{ClientID: "temp"})
+	trie.Add("sensors/room1/temp", &Session{ClientID: "room1"})
+	trie.Add("sensors/room1/temp", &Session{ClientID: "all"})
+	trie.Add("#", &Session{ClientID: "root"})
+
+	assert.Equal(t, []string{"all", "room1", "root", "temp"}, subscriberIDs(trie.Subscribers("sensors/room1/temp")))
+	assert.Equal(t, []string{"all", "root", "temp"}, subscriberIDs(trie.Subscribers("sensors/room2/temp")))
+	assert.Equal(t, []string{"all", "root"}, subscriberIDs(trie.Subscribers("sensors")))
+	assert.Equal(t, []string{"root"}, subscriberIDs(trie.Subscribers("devices/1")))
+	assert.Empty(t, trie.Subscribers("$SYS/broker"))
+
+	trie.Remove("sensors/room1/temp", "room1")
+	trie.RemoveClient("all")
+	assert.Equal(t, []string{"root", "temp"}, subscriberIDs(trie.Subscribers("sensors/room1/temp")))
+	assert.Equal(t, 2, trie.Len())
+
+	trie.RemoveClient("temp")
+	trie.RemoveClient("root")
+	assert.Equal(t, 0, trie.Len())
+	assert.Empty(t, trie.root.children)
+}
+
+func BenchmarkSubscriptionSubscribers(b *testing.B) {
+	trie := NewSubscription()
+	for i := 0; i < 10000; i++ {
+		trie.Add(fmt.Sprintf("sensors/device%d/+", i), &Session{ClientID: fmt.Sprintf("client-%d", i)})
+	}
+	trie.Add("sensors/#", &Session{ClientID: "dashboard"})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		trie.Subscribers(fmt.Sprintf("sensors/device%d/temp", i%10000))
+	}
+}